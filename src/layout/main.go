@@ -0,0 +1,149 @@
+package main
+
+// generate the servers of the config for the nodes, or plan to move buckets
+// of a config when nodes are added or removed:
+//
+//   layout -buckets 16 -n 3 host1:7900 host2:7900,weight=2 host3:7900,zone=b
+//   layout -conf conf/example.yaml -add host4:7900,zone=b -remove host1:7900
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	. "memcache"
+	"os"
+	"strings"
+)
+
+type nodeList []string
+
+func (l *nodeList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *nodeList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var (
+	conf    = flag.String("conf", "", "config whose servers are moved, yaml only")
+	buckets = flag.Int("buckets", 16, "number of buckets, read from the config if set")
+	n       = flag.Int("n", 3, "replicas of each bucket, read from the config if set")
+	adds    nodeList
+	removes nodeList
+)
+
+func init() {
+	flag.Var(&adds, "add", "node added to the config, like host:7900,weight=2,zone=a (repeatable)")
+	flag.Var(&removes, "remove", "address of the node removed from the config (repeatable)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] [node ...]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "nodes are like host:7900,weight=2,zone=a")
+		flag.PrintDefaults()
+	}
+}
+
+type config struct {
+	Servers []string
+	Buckets int
+	N       int
+}
+
+func parseNodes(specs []string) ([]Node, error) {
+	nodes := make([]Node, 0, len(specs))
+	for _, spec := range specs {
+		node, err := ParseNode(spec)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func printServers(l *Layout) {
+	fmt.Println("servers:")
+	for _, s := range l.Servers() {
+		fmt.Println("- " + s)
+	}
+}
+
+func generate() error {
+	nodes, err := parseNodes(flag.Args())
+	if err != nil {
+		return err
+	}
+	l, err := GenerateLayout(nodes, *buckets, *n)
+	if err != nil {
+		return err
+	}
+	printServers(l)
+	return nil
+}
+
+func plan() error {
+	content, err := ioutil.ReadFile(*conf)
+	if err != nil {
+		return err
+	}
+	c := config{Buckets: *buckets, N: *n}
+	if err := yaml.Unmarshal(content, &c); err != nil {
+		return fmt.Errorf("unmarshal yaml format config failed: %s", err)
+	}
+	old, err := ParseLayout(c.Servers, c.Buckets)
+	if err != nil {
+		return err
+	}
+	added, err := parseNodes(adds)
+	if err != nil {
+		return err
+	}
+
+	var nodes []Node
+	for _, node := range old.Nodes {
+		removed := false
+		for _, addr := range removes {
+			removed = removed || addr == node.Addr
+		}
+		if !removed {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes)+len(removes) != len(old.Nodes) {
+		return fmt.Errorf("removed nodes are not all in %s", *conf)
+	}
+	nodes = append(nodes, added...)
+
+	p, err := PlanLayout(old, nodes, c.N)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# %d buckets to copy\n", len(p.Moves))
+	for _, m := range p.Moves {
+		fmt.Println("#   " + m.String())
+	}
+	for i, step := range p.Steps {
+		fmt.Printf("\n# step %d: %s\n", i+1, step.Name)
+		printServers(step.Layout)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	var err error
+	if *conf != "" {
+		err = plan()
+	} else if flag.NArg() > 0 {
+		err = generate()
+	} else {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
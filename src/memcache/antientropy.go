@@ -0,0 +1,304 @@
+/*
+ * anti-entropy: compare the hash trees of replicas of a bucket, which are
+ * listed by `@`, `@0`, `@0a` ..., and repair the different keys.
+ */
+
+package memcache
+
+import (
+    "bytes"
+    "fmt"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+var AntiEntropyThrottle = time.Millisecond * 10 // sleep between requests
+var AntiEntropyMaxDiffs = 1000                   // keys kept in a report
+
+// an entry of `@` listings, "0/ hash count" for a directory,
+// "key hash version" for a record
+type listEntry struct {
+    name    string
+    isDir   bool
+    hash    int
+    count   int
+    version int
+}
+
+func parseListing(body []byte) (entries []*listEntry) {
+    for _, line := range bytes.Split(body, []byte("\n")) {
+        vv := bytes.Fields(line)
+        if len(vv) != 3 {
+            continue
+        }
+        e := &listEntry{name: string(vv[0])}
+        e.hash, _ = strconv.Atoi(string(vv[1]))
+        n, _ := strconv.Atoi(string(vv[2]))
+        if bytes.HasSuffix(vv[0], []byte("/")) {
+            e.name = e.name[:len(e.name)-1]
+            e.isDir = true
+            e.count = n
+        } else {
+            e.version = n
+        }
+        entries = append(entries, e)
+    }
+    return
+}
+
+func (host *Host) list(prefix string) ([]*listEntry, error) {
+    rs, err := host.Get("@" + prefix)
+    if err != nil {
+        return nil, err
+    }
+    if rs == nil {
+        return nil, nil
+    }
+    return parseListing(rs.Body), nil
+}
+
+// a key differs between replicas, version 0 means missing
+type KeyDiff struct {
+    Bucket   int
+    Key      string
+    Versions map[string]int
+}
+
+type AntiEntropyReport struct {
+    Start, End time.Time
+    DryRun     bool
+    Buckets    int
+    Listings   int
+    Diffs      int
+    Repaired   int
+    Keys       []*KeyDiff
+    Errors     []string
+}
+
+type AntiEntropy struct {
+    sync.Mutex
+    scheduler *ManualScheduler
+    running   bool
+    last      *AntiEntropyReport
+}
+
+func NewAntiEntropy(sch *ManualScheduler) *AntiEntropy {
+    return &AntiEntropy{scheduler: sch}
+}
+
+// Start repairs all buckets every interval in background
+func (ae *AntiEntropy) Start(interval time.Duration) {
+    go func() {
+        for {
+            time.Sleep(interval)
+            ae.Run(false)
+        }
+    }()
+}
+
+// SetScheduler is used by the next scan
+func (ae *AntiEntropy) SetScheduler(sch *ManualScheduler) {
+    ae.Lock()
+    defer ae.Unlock()
+    ae.scheduler = sch
+}
+
+func (ae *AntiEntropy) LastReport() *AntiEntropyReport {
+    ae.Lock()
+    defer ae.Unlock()
+    return ae.last
+}
+
+func (ae *AntiEntropy) Running() bool {
+    ae.Lock()
+    defer ae.Unlock()
+    return ae.running
+}
+
+// Run scans all buckets once, return nil if another scan is running
+func (ae *AntiEntropy) Run(dryRun bool) *AntiEntropyReport {
+    ae.Lock()
+    if ae.running {
+        ae.Unlock()
+        return nil
+    }
+    ae.running = true
+    sch := ae.scheduler
+    ae.Unlock()
+
+    r := &AntiEntropyReport{Start: time.Now(), DryRun: dryRun}
+    bs := sch.BucketCount()
+    for b := 0; b < bs; b++ {
+        prefix, err := bucketPrefix(b, bs)
+        if err != nil {
+            r.Errors = append(r.Errors, err.Error())
+            break
+        }
+        ae.compare(r, b, prefix, sch.GetHostsByBucket(b))
+        r.Buckets++
+    }
+    r.End = time.Now()
+
+    ae.Lock()
+    ae.running = false
+    ae.last = r
+    ae.Unlock()
+    return r
+}
+
+// the prefix of keys in the bucket in `@` listings
+func bucketPrefix(bucket, buckets int) (string, error) {
+    width := calBitWidth(buckets)
+    if width%4 != 0 {
+        return "", fmt.Errorf("can not list %d buckets, need a power of 16", buckets)
+    }
+    if width == 0 {
+        return "", nil
+    }
+    return fmt.Sprintf(fmt.Sprintf("%%0%dx", width/4), bucket), nil
+}
+
+func (ae *AntiEntropy) listAll(r *AntiEntropyReport, prefix string, hosts []*Host) ([][]*listEntry, error) {
+    ls := make([][]*listEntry, len(hosts))
+    for i, host := range hosts {
+        time.Sleep(antiEntropyThrottle())
+        es, err := host.list(prefix)
+        r.Listings++
+        if err != nil {
+            return nil, fmt.Errorf("list @%s in %s failed: %s", prefix, host.Addr, err)
+        }
+        ls[i] = es
+    }
+    return ls, nil
+}
+
+// walk down the directories with different hashes
+func (ae *AntiEntropy) compare(r *AntiEntropyReport, bucket int, prefix string, hosts []*Host) {
+    ls, err := ae.listAll(r, prefix, hosts)
+    if err != nil {
+        r.Errors = append(r.Errors, err.Error())
+        return
+    }
+
+    dirs := make(map[string][]*listEntry)
+    hasRecords := false
+    for i, es := range ls {
+        for _, e := range es {
+            if !e.isDir {
+                hasRecords = true
+                continue
+            }
+            if _, ok := dirs[e.name]; !ok {
+                dirs[e.name] = make([]*listEntry, len(hosts))
+            }
+            dirs[e.name][i] = e
+        }
+    }
+
+    if !hasRecords {
+        names := make([]string, 0, len(dirs))
+        for name := range dirs {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            if !sameHash(dirs[name]) {
+                ae.compare(r, bucket, prefix+name, hosts)
+            }
+        }
+        return
+    }
+
+    // the leaves, or replicas split the directory differently,
+    // so compare all the records under it
+    records := make([]map[string]*listEntry, len(hosts))
+    for i, host := range hosts {
+        records[i] = make(map[string]*listEntry)
+        if err := collectRecords(host, prefix, ls[i], records[i], &r.Listings); err != nil {
+            r.Errors = append(r.Errors, err.Error())
+            return
+        }
+    }
+    ae.diffRecords(r, bucket, hosts, records)
+}
+
+func sameHash(es []*listEntry) bool {
+    for _, e := range es {
+        if e == nil || e.hash != es[0].hash {
+            return false
+        }
+    }
+    return true
+}
+
+// collect the records under the directories, listings are counted
+func collectRecords(host *Host, prefix string, es []*listEntry, records map[string]*listEntry,
+    listings *int) error {
+    for _, e := range es {
+        if !e.isDir {
+            records[e.name] = e
+            continue
+        }
+        time.Sleep(antiEntropyThrottle())
+        sub, err := host.list(prefix + e.name)
+        *listings++
+        if err != nil {
+            return fmt.Errorf("list @%s in %s failed: %s", prefix+e.name, host.Addr, err)
+        }
+        if err := collectRecords(host, prefix+e.name, sub, records, listings); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (ae *AntiEntropy) diffRecords(r *AntiEntropyReport, bucket int, hosts []*Host,
+    records []map[string]*listEntry) {
+    keys := make(map[string]bool)
+    for _, rs := range records {
+        for key := range rs {
+            keys[key] = true
+        }
+    }
+    sorted := make([]string, 0, len(keys))
+    for key := range keys {
+        sorted = append(sorted, key)
+    }
+    sort.Strings(sorted)
+
+    for _, key := range sorted {
+        d := &KeyDiff{Bucket: bucket, Key: key, Versions: make(map[string]int, len(hosts))}
+        same := true
+        first := records[0][key]
+        for i, host := range hosts {
+            e := records[i][key]
+            if e == nil {
+                d.Versions[host.Addr] = 0
+            } else {
+                d.Versions[host.Addr] = e.version
+            }
+            if e == nil || first == nil || e.hash != first.hash || e.version != first.version {
+                same = false
+            }
+        }
+        if same {
+            continue
+        }
+
+        r.Diffs++
+        if len(r.Keys) < AntiEntropyMaxDiffs {
+            r.Keys = append(r.Keys, d)
+        }
+        if r.DryRun {
+            continue
+        }
+        time.Sleep(antiEntropyThrottle())
+        n, err := repairKey(key, hosts)
+        r.Repaired += n
+        if err != nil {
+            r.Errors = append(r.Errors, "repair "+key+" failed: "+err.Error())
+        }
+    }
+}
@@ -0,0 +1,46 @@
+package memcache
+
+import "testing"
+
+func TestParseListing(t *testing.T) {
+    es := parseListing([]byte("0/ 1234 10\n1/ 2345 0\nabc 321 3\nbad line\n"))
+    if len(es) != 3 {
+        t.Fatalf("expect 3 entries but %d", len(es))
+    }
+    if !es[0].isDir || es[0].name != "0" || es[0].hash != 1234 || es[0].count != 10 {
+        t.Errorf("unexpected dir entry: %v", es[0])
+    }
+    if es[2].isDir || es[2].name != "abc" || es[2].hash != 321 || es[2].version != 3 {
+        t.Errorf("unexpected record entry: %v", es[2])
+    }
+}
+
+func TestDiffRecords(t *testing.T) {
+    hosts := []*Host{NewHost("host1:7900"), NewHost("host2:7900")}
+    records := []map[string]*listEntry{
+        map[string]*listEntry{
+            "a": &listEntry{name: "a", hash: 1, version: 1},
+            "b": &listEntry{name: "b", hash: 2, version: 2},
+            "c": &listEntry{name: "c", hash: 3, version: 1},
+        },
+        map[string]*listEntry{
+            "a": &listEntry{name: "a", hash: 1, version: 1},
+            "b": &listEntry{name: "b", hash: 5, version: 1},
+        },
+    }
+    r := &AntiEntropyReport{DryRun: true}
+    ae := NewAntiEntropy(nil)
+    ae.diffRecords(r, 3, hosts, records)
+    if r.Diffs != 2 || len(r.Keys) != 2 {
+        t.Fatalf("expect 2 diffs but %d", r.Diffs)
+    }
+    if r.Keys[0].Key != "b" || r.Keys[0].Versions["host2:7900"] != 1 {
+        t.Errorf("unexpected diff: %v", r.Keys[0])
+    }
+    if r.Keys[1].Key != "c" || r.Keys[1].Versions["host2:7900"] != 0 || r.Keys[1].Bucket != 3 {
+        t.Errorf("unexpected diff: %v", r.Keys[1])
+    }
+    if r.Repaired != 0 {
+        t.Error("dry run should not repair")
+    }
+}
@@ -0,0 +1,376 @@
+/*
+ * memcached binary protocol, translated into the ascii Request
+ */
+
+package memcache
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "io"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    binaryReqMagic  = 0x80
+    binaryRespMagic = 0x81
+    binaryHeaderLen = 24
+)
+
+const (
+    opGet      = 0x00
+    opSet      = 0x01
+    opAdd      = 0x02
+    opReplace  = 0x03
+    opDelete   = 0x04
+    opIncr     = 0x05
+    opDecr     = 0x06
+    opQuit     = 0x07
+    opFlush    = 0x08
+    opGetQ     = 0x09
+    opNoop     = 0x0a
+    opVersion  = 0x0b
+    opGetK     = 0x0c
+    opGetKQ    = 0x0d
+    opAppend   = 0x0e
+    opStat     = 0x10
+    opSetQ     = 0x11
+    opAddQ     = 0x12
+    opReplaceQ = 0x13
+    opDeleteQ  = 0x14
+    opIncrQ    = 0x15
+    opDecrQ    = 0x16
+    opQuitQ    = 0x17
+    opFlushQ   = 0x18
+    opAppendQ  = 0x19
+)
+
+const (
+    statusOK          = 0x00
+    statusNotFound    = 0x01
+    statusExists      = 0x02
+    statusTooLarge    = 0x03
+    statusInvalidArgs = 0x04
+    statusNotStored   = 0x05
+    statusNonNumeric  = 0x06
+    statusUnknownCmd  = 0x81
+    statusInternalErr = 0x84
+)
+
+// quiet commands do not reply on success (or miss for gets)
+var binaryQuietOps = map[byte]byte{
+    opGetQ: opGet, opGetKQ: opGetK, opSetQ: opSet, opAddQ: opAdd,
+    opReplaceQ: opReplace, opDeleteQ: opDelete, opIncrQ: opIncr,
+    opDecrQ: opDecr, opQuitQ: opQuit, opFlushQ: opFlush, opAppendQ: opAppend,
+}
+
+var binaryStoreCmds = map[byte]string{
+    opSet: "set", opAdd: "add", opReplace: "replace", opAppend: "append",
+}
+
+type binaryHeader struct {
+    magic    byte
+    opcode   byte
+    keyLen   uint16
+    extraLen uint8
+    dataType uint8
+    status   uint16 // vbucket in request
+    bodyLen  uint32
+    opaque   uint32
+    cas      uint64
+}
+
+func (h *binaryHeader) Read(r io.Reader) error {
+    var buf [binaryHeaderLen]byte
+    if _, err := io.ReadFull(r, buf[:]); err != nil {
+        return err
+    }
+    h.magic = buf[0]
+    h.opcode = buf[1]
+    h.keyLen = binary.BigEndian.Uint16(buf[2:])
+    h.extraLen = buf[4]
+    h.dataType = buf[5]
+    h.status = binary.BigEndian.Uint16(buf[6:])
+    h.bodyLen = binary.BigEndian.Uint32(buf[8:])
+    h.opaque = binary.BigEndian.Uint32(buf[12:])
+    h.cas = binary.BigEndian.Uint64(buf[16:])
+    return nil
+}
+
+func (h *binaryHeader) Write(w io.Writer) error {
+    var buf [binaryHeaderLen]byte
+    buf[0] = h.magic
+    buf[1] = h.opcode
+    binary.BigEndian.PutUint16(buf[2:], h.keyLen)
+    buf[4] = h.extraLen
+    buf[5] = h.dataType
+    binary.BigEndian.PutUint16(buf[6:], h.status)
+    binary.BigEndian.PutUint32(buf[8:], h.bodyLen)
+    binary.BigEndian.PutUint32(buf[12:], h.opaque)
+    binary.BigEndian.PutUint64(buf[16:], h.cas)
+    return WriteFull(w, buf[:])
+}
+
+type binaryRequest struct {
+    binaryHeader
+    extras []byte
+    key    string
+    value  []byte
+}
+
+func (req *binaryRequest) Read(r io.Reader) error {
+    if err := req.binaryHeader.Read(r); err != nil {
+        return err
+    }
+    if req.magic != binaryReqMagic {
+        return errors.New("invalid magic")
+    }
+    klen, elen := int(req.keyLen), int(req.extraLen)
+    if int(req.bodyLen) < klen+elen || req.bodyLen > MaxBodyLength {
+        return errors.New("invalid body length")
+    }
+    body := make([]byte, req.bodyLen)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return err
+    }
+    req.extras = body[:elen]
+    req.key = string(body[elen : elen+klen])
+    req.value = body[elen+klen:]
+    return nil
+}
+
+type binaryResponse struct {
+    binaryHeader
+    extras []byte
+    key    string
+    value  []byte
+}
+
+func (resp *binaryResponse) Write(w io.Writer) error {
+    resp.magic = binaryRespMagic
+    resp.extraLen = uint8(len(resp.extras))
+    resp.keyLen = uint16(len(resp.key))
+    resp.bodyLen = uint32(len(resp.extras) + len(resp.key) + len(resp.value))
+    if err := resp.binaryHeader.Write(w); err != nil {
+        return err
+    }
+    WriteFull(w, resp.extras)
+    io.WriteString(w, resp.key)
+    return WriteFull(w, resp.value)
+}
+
+func (c *ServerConn) serveBinary(rbuf *bufio.Reader, wbuf *bufio.Writer,
+    store DistributeStorage, stats *Stats) (e error) {
+    for {
+        breq := new(binaryRequest)
+        if e = breq.Read(rbuf); e != nil {
+            break
+        }
+
+        quit := c.processBinary(breq, wbuf, store, stats)
+        // flush when all the pipelined requests are processed
+        if quit || rbuf.Buffered() == 0 {
+            if e = wbuf.Flush(); e != nil {
+                break
+            }
+        }
+        if quit || c.closeAfterReply {
+            break
+        }
+    }
+    return
+}
+
+// translate the binary request into Request, return true to close
+func (c *ServerConn) processBinary(breq *binaryRequest, w io.Writer,
+    store DistributeStorage, stats *Stats) (quit bool) {
+    op := breq.opcode
+    quiet := false
+    if o, ok := binaryQuietOps[op]; ok {
+        op = o
+        quiet = true
+    }
+    resp := &binaryResponse{}
+    resp.opcode = breq.opcode
+    resp.opaque = breq.opaque
+    reply := func(status uint16, msg string) {
+        resp.status = status
+        if msg != "" {
+            resp.value = []byte(msg)
+        }
+        resp.Write(w)
+    }
+
+    req := &Request{}
+    var create *Request // of incr and decr on missing keys
+    switch op {
+    case opGet, opGetK:
+        req.Cmd = "get"
+        req.Keys = []string{breq.key}
+
+    case opSet, opAdd, opReplace, opAppend:
+        req.Cmd = binaryStoreCmds[op]
+        req.Keys = []string{breq.key}
+        req.Item = &Item{Body: breq.value}
+        if op != opAppend {
+            if len(breq.extras) != 8 {
+                reply(statusInvalidArgs, "Invalid arguments")
+                return
+            }
+            req.Item.Flag = int(binary.BigEndian.Uint32(breq.extras))
+            req.Item.Exptime = int(binary.BigEndian.Uint32(breq.extras[4:]))
+        }
+        if breq.cas != 0 && op == opSet {
+            req.Cmd = "cas"
+            req.Item.Cas = int(breq.cas)
+        }
+
+    case opDelete:
+        req.Cmd = "delete"
+        req.Keys = []string{breq.key}
+
+    case opIncr, opDecr:
+        if len(breq.extras) != 20 {
+            reply(statusInvalidArgs, "Invalid arguments")
+            return
+        }
+        delta := strconv.FormatUint(binary.BigEndian.Uint64(breq.extras), 10)
+        if op == opDecr {
+            delta = "-" + delta
+        }
+        req.Cmd = "incr"
+        req.Keys = []string{breq.key}
+        req.Item = &Item{Body: []byte(delta)}
+        // a missing key is created with the initial value, unless the
+        // expiration is all ones
+        if exptime := binary.BigEndian.Uint32(breq.extras[16:]); exptime != 0xffffffff {
+            initial := strconv.FormatUint(binary.BigEndian.Uint64(breq.extras[8:]), 10)
+            create = &Request{Cmd: "set", Keys: req.Keys,
+                Item: &Item{Body: []byte(initial), Exptime: int(exptime)}}
+        }
+
+    case opNoop:
+        reply(statusOK, "")
+        return
+
+    case opQuit:
+        if !quiet {
+            reply(statusOK, "")
+        }
+        return true
+
+    case opVersion:
+        reply(statusOK, VERSION)
+        return
+
+    case opFlush:
+        if !quiet {
+            reply(statusOK, "")
+        }
+        return
+
+    case opStat:
+        req.Cmd = "stats"
+        if breq.key != "" {
+            req.Keys = []string{breq.key}
+        }
+
+    default:
+        reply(statusUnknownCmd, "Unknown command")
+        return
+    }
+
+    if len(breq.key) > MaxKeyLength {
+        reply(statusInvalidArgs, "key too long")
+        return
+    }
+
+    t := time.Now()
+    r, hosts, err := req.Process(store, stats)
+    if create != nil && r.status == "NOT_FOUND" {
+        // two creations at the same time may both return the initial value
+        r, hosts, err = create.Process(store, stats)
+        if r.status == "STORED" {
+            r.status, r.msg = "INCR", string(create.Item.Body)
+        }
+    }
+    dt := time.Since(t)
+    if dt > slowCmdTime() {
+        stats.UpdateStat("slow_cmd", 1)
+    }
+    if r == nil {
+        reply(statusUnknownCmd, "Unknown command")
+        return
+    }
+    if AccessLog != nil {
+        c.logAccess(req, r, hosts, err, dt)
+    }
+    defer r.CleanBuffer()
+
+    switch r.status {
+    case "VALUE":
+        item, ok := r.items[breq.key]
+        if !ok {
+            if !quiet {
+                if op == opGetK {
+                    resp.key = breq.key
+                }
+                reply(statusNotFound, "Not found")
+            }
+            return
+        }
+        if op == opGetK {
+            resp.key = breq.key
+        }
+        resp.extras = make([]byte, 4)
+        binary.BigEndian.PutUint32(resp.extras, uint32(item.Flag))
+        resp.cas = uint64(item.Cas)
+        resp.value = item.Body
+        reply(statusOK, "")
+
+    case "STAT":
+        for _, line := range strings.Split(r.msg, "\r\n") {
+            parts := strings.Fields(line)
+            if len(parts) != 3 {
+                continue
+            }
+            resp.key = parts[1]
+            reply(statusOK, parts[2])
+        }
+        resp.key = ""
+        resp.value = nil
+        reply(statusOK, "")
+
+    case "INCR":
+        n, _ := strconv.ParseUint(r.msg, 10, 64)
+        if !quiet {
+            resp.value = make([]byte, 8)
+            binary.BigEndian.PutUint64(resp.value, n)
+            reply(statusOK, "")
+        }
+
+    case "STORED", "DELETED":
+        if !quiet {
+            reply(statusOK, "")
+        }
+
+    case "NOT_FOUND":
+        reply(statusNotFound, "Not found")
+
+    case "EXISTS":
+        reply(statusExists, "Data exists for key")
+
+    case "NOT_STORED":
+        reply(statusNotStored, "Not stored")
+
+    case "CLIENT_ERROR":
+        reply(statusInvalidArgs, r.msg)
+
+    default:
+        reply(statusInternalErr, r.msg)
+    }
+    return
+}
@@ -0,0 +1,170 @@
+package memcache
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "net"
+    "testing"
+)
+
+// DistributeStorage backed by a mapStore
+type mapDistStore struct {
+    *mapStore
+}
+
+func (s mapDistStore) Get(key string) (*Item, []string, error) {
+    item, err := s.mapStore.Get(key)
+    return item, []string{"map"}, err
+}
+
+func (s mapDistStore) Gets(key string) (*Item, []string, error) {
+    return s.Get(key)
+}
+
+func (s mapDistStore) GetMulti(keys []string) (map[string]*Item, []string, error) {
+    items, err := s.mapStore.GetMulti(keys)
+    return items, []string{"map"}, err
+}
+
+func (s mapDistStore) Set(key string, item *Item, noreply bool) (bool, []string, error) {
+    ok, err := s.mapStore.Set(key, item, noreply)
+    return ok, []string{"map"}, err
+}
+
+func (s mapDistStore) Cas(key string, item *Item, noreply bool) (string, []string, error) {
+    old, _ := s.mapStore.Get(key)
+    if old == nil {
+        return "NOT_FOUND", nil, nil
+    }
+    if old.Cas != item.Cas {
+        return "EXISTS", nil, nil
+    }
+    s.mapStore.Set(key, item, noreply)
+    return "STORED", []string{"map"}, nil
+}
+
+func (s mapDistStore) Append(key string, value []byte) (bool, []string, error) {
+    ok, err := s.mapStore.Append(key, value)
+    return ok, []string{"map"}, err
+}
+
+func (s mapDistStore) Incr(key string, value int) (int, []string, error) {
+    n, err := s.mapStore.Incr(key, value)
+    return n, []string{"map"}, err
+}
+
+func (s mapDistStore) Delete(key string) (bool, []string, error) {
+    ok, err := s.mapStore.Delete(key)
+    return ok, []string{"map"}, err
+}
+
+func newTestConn(t *testing.T) (net.Conn, *bufio.Reader) {
+    client, server := net.Pipe()
+    c := &ServerConn{RemoteAddr: "pipe", rwc: server}
+    go c.Serve(mapDistStore{NewMapStore()}, NewStats())
+    return client, bufio.NewReader(client)
+}
+
+func writeBinary(t *testing.T, w net.Conn, op byte, key string, extras, value []byte) {
+    req := &binaryResponse{extras: extras, key: key, value: value}
+    req.opcode = op
+    req.opaque = uint32(op)
+    buf := new(bytes.Buffer)
+    req.Write(buf)
+    b := buf.Bytes()
+    b[0] = binaryReqMagic
+    w.Write(b)
+}
+
+func readBinary(t *testing.T, r *bufio.Reader) *binaryRequest {
+    resp := new(binaryRequest)
+    if err := resp.binaryHeader.Read(r); err != nil {
+        t.Fatal("read response failed", err)
+    }
+    body := make([]byte, resp.bodyLen)
+    r.Read(body)
+    resp.extras = body[:resp.extraLen]
+    resp.key = string(body[int(resp.extraLen) : int(resp.extraLen)+int(resp.keyLen)])
+    resp.value = body[int(resp.extraLen)+int(resp.keyLen):]
+    return resp
+}
+
+func TestBinaryProtocol(t *testing.T) {
+    conn, r := newTestConn(t)
+    defer conn.Close()
+
+    extras := make([]byte, 8)
+    binary.BigEndian.PutUint32(extras, 3)
+    writeBinary(t, conn, opSet, "key", extras, []byte("value"))
+    if resp := readBinary(t, r); resp.magic != binaryRespMagic || resp.status != statusOK || resp.opaque != opSet {
+        t.Errorf("set failed: %v", resp)
+    }
+
+    writeBinary(t, conn, opGetK, "key", nil, nil)
+    resp := readBinary(t, r)
+    if resp.status != statusOK || resp.key != "key" || string(resp.value) != "value" ||
+        binary.BigEndian.Uint32(resp.extras) != 3 {
+        t.Errorf("getk failed: %v", resp)
+    }
+
+    // quiet get of a missing key replies nothing before noop
+    writeBinary(t, conn, opGetQ, "missing", nil, nil)
+    writeBinary(t, conn, opNoop, "", nil, nil)
+    if resp := readBinary(t, r); resp.opcode != opNoop {
+        t.Errorf("getq should be quiet on miss, got %v", resp)
+    }
+
+    writeBinary(t, conn, opDelete, "key", nil, nil)
+    if resp := readBinary(t, r); resp.status != statusOK {
+        t.Errorf("delete failed: %v", resp)
+    }
+    writeBinary(t, conn, opGet, "key", nil, nil)
+    if resp := readBinary(t, r); resp.status != statusNotFound {
+        t.Errorf("get after delete should not found: %v", resp)
+    }
+
+    writeBinary(t, conn, opVersion, "", nil, nil)
+    if resp := readBinary(t, r); string(resp.value) != VERSION {
+        t.Errorf("unexpected version: %v", resp)
+    }
+
+    writeBinary(t, conn, 0x30, "", nil, nil)
+    if resp := readBinary(t, r); resp.status != statusUnknownCmd {
+        t.Errorf("should be unknown command: %v", resp)
+    }
+}
+
+func incrExtras(delta, initial uint64, exptime uint32) []byte {
+    extras := make([]byte, 20)
+    binary.BigEndian.PutUint64(extras, delta)
+    binary.BigEndian.PutUint64(extras[8:], initial)
+    binary.BigEndian.PutUint32(extras[16:], exptime)
+    return extras
+}
+
+func TestBinaryIncrMissing(t *testing.T) {
+    conn, r := newTestConn(t)
+    defer conn.Close()
+
+    writeBinary(t, conn, opIncr, "counter", incrExtras(5, 10, 0xffffffff), nil)
+    if resp := readBinary(t, r); resp.status != statusNotFound {
+        t.Errorf("incr of missing key with all ones expiration should not found: %v", resp)
+    }
+    writeBinary(t, conn, opIncr, "counter", incrExtras(5, 10, 0), nil)
+    if resp := readBinary(t, r); resp.status != statusOK || binary.BigEndian.Uint64(resp.value) != 10 {
+        t.Errorf("incr of missing key should create it with the initial value: %v", resp)
+    }
+    writeBinary(t, conn, opIncr, "counter", incrExtras(5, 10, 0), nil)
+    if resp := readBinary(t, r); resp.status != statusOK || binary.BigEndian.Uint64(resp.value) != 15 {
+        t.Errorf("incr of created key failed: %v", resp)
+    }
+    writeBinary(t, conn, opDecr, "counter", incrExtras(15, 10, 0), nil)
+    if resp := readBinary(t, r); resp.status != statusOK || binary.BigEndian.Uint64(resp.value) != 0 {
+        t.Errorf("decr to 0 should not be a miss: %v", resp)
+    }
+    writeBinary(t, conn, opGet, "counter", nil, nil)
+    if resp := readBinary(t, r); string(resp.value) != "0" {
+        t.Errorf("the key should not be created again: %v", resp)
+    }
+}
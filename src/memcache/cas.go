@@ -0,0 +1,99 @@
+/*
+ * check-and-set through the proxy: the cas token is derived from the
+ * version and hash of the key in the anchor replica, and the value of gets
+ * is read from the same replica. versions differ among replicas, so the
+ * anchor is the first primary in a fixed order, not the one of scores, and
+ * the next one is used only when it is unreachable
+ */
+
+package memcache
+
+import (
+    "errors"
+    "sync"
+)
+
+const casLockCount = 64
+
+// cas token of a key, 0 means it does not exist
+func casToken(m *Meta) int {
+    if m == nil || m.Version <= 0 {
+        return 0
+    }
+    return m.Version<<16 | m.Hash&0xffff
+}
+
+// schedulers which reorder the primaries by scores or zones keep a fixed
+// order of them for gets and cas
+type primaryOrderer interface {
+    GetPrimariesByKey(key string) []*Host
+}
+
+// the replicas to anchor gets and cas on, in the order to try
+func casReplicas(topo *topology, key string) []*Host {
+    if p, ok := topo.scheduler.(primaryOrderer); ok {
+        if hosts := p.GetPrimariesByKey(key); len(hosts) > 0 {
+            return hosts
+        }
+    }
+    return topo.scheduler.GetHostsByKey(key)[:topo.N]
+}
+
+// the meta of the first available replica, which is the anchor one
+func primaryMeta(hosts []*Host, key string) (m *Meta, err error) {
+    for _, host := range hosts {
+        if m, err = host.GetMeta(key); err == nil {
+            return
+        }
+    }
+    if err == nil {
+        err = errors.New("no replica available")
+    }
+    return
+}
+
+const getsRetries = 3
+
+// the value with the token of the meta read around it from the same host,
+// it is read again if a write lands in between
+func getsFrom(hosts []*Host, key string) (item *Item, targets []string, err error) {
+    for _, host := range hosts {
+        var m *Meta
+        if m, err = host.GetMeta(key); err != nil {
+            continue
+        }
+        for i := 0; i < getsRetries && err == nil; i++ {
+            if item, err = host.Get(key); err != nil {
+                break
+            }
+            after, e := host.GetMeta(key)
+            if err = e; err != nil {
+                break
+            }
+            if casToken(after) == casToken(m) {
+                if item != nil {
+                    item.Cas = casToken(m)
+                }
+                return item, []string{host.Addr}, nil
+            }
+            m = after
+        }
+        if err == nil {
+            // a hot key, the token could not be pinned to the value
+            return nil, nil, errors.New("key changed during gets")
+        }
+    }
+    if err == nil {
+        err = errors.New("no replica available")
+    }
+    return nil, nil, err
+}
+
+// serialize cas of the same key in this proxy only, other proxies in
+// front of the same replicas are not aware of them, a cas may overwrite a
+// write through another proxy between the check and the set
+type casLocks [casLockCount]sync.Mutex
+
+func (l *casLocks) get(key string) *sync.Mutex {
+    return &l[fnv1a([]byte(key))%casLockCount]
+}
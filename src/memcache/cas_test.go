@@ -0,0 +1,108 @@
+package memcache
+
+import "testing"
+
+func TestCasToken(t *testing.T) {
+    if casToken(nil) != 0 {
+        t.Error("token of missing key should be 0")
+    }
+    if casToken(&Meta{Version: -2, Hash: 3}) != 0 {
+        t.Error("token of deleted key should be 0")
+    }
+    a := casToken(&Meta{Version: 2, Hash: 3})
+    b := casToken(&Meta{Version: 3, Hash: 3})
+    c := casToken(&Meta{Version: 2, Hash: 4})
+    if a == 0 || a == b || a == c {
+        t.Errorf("tokens should differ: %d %d %d", a, b, c)
+    }
+    if a != casToken(&Meta{Version: 2, Hash: 3, Timestamp: 100}) {
+        t.Error("token should only depend on version and hash")
+    }
+}
+
+func TestCasLocks(t *testing.T) {
+    var l casLocks
+    if l.get("key") != l.get("key") {
+        t.Error("same key should get the same lock")
+    }
+}
+
+func TestGetsFromOneHost(t *testing.T) {
+    a, stopA := startMetaStore(t, "127.0.0.1:11313")
+    defer stopA()
+    b, stopB := startMetaStore(t, "127.0.0.1:11314")
+    defer stopB()
+    down, ha, hb := NewHost("127.0.0.1:11319"), NewHost("127.0.0.1:11313"), NewHost("127.0.0.1:11314")
+    defer ha.Close()
+    defer hb.Close()
+    a.Set("k", &Item{Body: []byte("new")}, false)
+    a.Set("k", &Item{Body: []byte("new")}, false)
+    b.Set("k", &Item{Body: []byte("old")}, false)
+
+    token := func(host *Host) int {
+        m, _ := host.GetMeta("k")
+        return casToken(m)
+    }
+    item, targets, err := getsFrom([]*Host{down, hb, ha}, "k")
+    if err != nil || item == nil || string(item.Body) != "old" || item.Cas != token(hb) {
+        t.Fatal("gets from the first reachable host", item, err)
+    }
+    if len(targets) != 1 || targets[0] != hb.Addr {
+        t.Error("unexpected targets", targets)
+    }
+
+    // the value changes between the meta and the value
+    changed := false
+    a.onGet = func(key string) {
+        if !changed {
+            changed = true
+            a.Set(key, &Item{Body: []byte("newer")}, false)
+        }
+    }
+    item, _, err = getsFrom([]*Host{ha, hb}, "k")
+    if err != nil || item == nil || string(item.Body) != "newer" || item.Cas != token(ha) {
+        t.Error("the token should match the value", item, err)
+    }
+}
+
+func TestCasAnchoredOnPrimary(t *testing.T) {
+    a, stopA := startMetaStore(t, "127.0.0.1:11315")
+    defer stopA()
+    b, stopB := startMetaStore(t, "127.0.0.1:11316")
+    defer stopB()
+    // the same value, of different versions in the replicas
+    a.Set("k", &Item{Body: []byte("v"), Exptime: 5}, false)
+    b.Set("k", &Item{Body: []byte("v")}, false)
+
+    schd := NewManualScheduler(map[string][]string{
+        "127.0.0.1:11316": {"0"}, "127.0.0.1:11315": {"0"}}, 1, 2)
+    defer schd.Close()
+    c := NewClient(schd, 2, 1, 1)
+    order := func(first, second string) {
+        schd.scoreLock.Lock()
+        defer schd.scoreLock.Unlock()
+        for _, host := range schd.hosts {
+            if host.Addr == first {
+                schd.buckets[0] = []int{host.offset, 1 - host.offset}
+            }
+        }
+        if schd.hosts[schd.buckets[0][1]].Addr != second {
+            t.Fatal("unexpected hosts", schd.hosts)
+        }
+    }
+
+    order("127.0.0.1:11315", "127.0.0.1:11316")
+    item, targets, err := c.Gets("k")
+    if err != nil || item == nil || len(targets) != 1 || targets[0] != "127.0.0.1:11315" {
+        t.Fatal("gets from the first primary", item, targets, err)
+    }
+    // the scores flip between gets and cas
+    order("127.0.0.1:11316", "127.0.0.1:11315")
+    status, _, err := c.Cas("k", &Item{Body: []byte("v2"), Cas: item.Cas}, false)
+    if err != nil || status != "STORED" {
+        t.Error("cas after the scores flipped", status, err)
+    }
+    if item, _, _ := c.Gets("k"); item == nil || string(item.Body) != "v2" {
+        t.Error("gets after the scores flipped", item)
+    }
+}
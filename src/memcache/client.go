@@ -6,53 +6,188 @@ package memcache
 
 import (
     "errors"
-    "math"
+    "math/rand"
     "sync"
     "time"
+    "unsafe"
 )
 
 // Client of memcached
 type Client struct {
-    scheduler Scheduler
-    N, W, R   int
+    topo      unsafe.Pointer // *topology
+    stats     *Stats
+    handoff   *HintedHandoff
+    hedger    *hedger
+    casLocks  casLocks
 }
 
 func NewClient(sch Scheduler, N, W, R int) (c *Client) {
     c = new(Client)
-    c.scheduler = sch
-    c.N = N
-    c.W = W
-    c.R = R
+    c.stats = NewStats()
+    swapTopology(&c.topo, sch, N, W, R, newReadRepairer(c.stats))
+    c.hedger = newHedger()
     return c
 }
 
+func (c *Client) topology() *topology {
+    return loadTopology(&c.topo)
+}
+
+// Reload swaps in the new scheduler and N/W/R, returns the old scheduler.
+// the read repairer of the old topology is stopped, with its pending tasks.
+func (c *Client) Reload(sch Scheduler, N, W, R int) Scheduler {
+    old := swapTopology(&c.topo, sch, N, W, R, newReadRepairer(c.stats))
+    old.repairer.Stop()
+    if c.handoff != nil {
+        c.handoff.setScheduler(sch)
+    }
+    return old.scheduler
+}
+
+// OpenHandoff enables hinted handoff, journaled in path
+func (c *Client) OpenHandoff(path string) (err error) {
+    c.handoff, err = newHintedHandoff(path, c.topology().scheduler, c.stats)
+    return
+}
+
+// remember the write missed by a primary replica
+func (c *Client) hint(primary bool, host *Host, key, op string) {
+    if c.handoff != nil && primary {
+        c.handoff.Add(host, key, op)
+    }
+}
+
+func (c *Client) Stats() map[string]int64 {
+    st := c.stats.Counters()
+    if c.handoff != nil {
+        st["handoff_depth"] = int64(c.handoff.Len())
+    }
+    return st
+}
+
+func (c *Client) Gets(key string) (*Item, []string, error) {
+    topo := c.topology()
+    return getsFrom(casReplicas(topo, key), key)
+}
+
+// Cas stores the item if its token matches the one of the anchor replica
+func (c *Client) Cas(key string, item *Item, noreply bool) (status string, targets []string, err error) {
+    lock := c.casLocks.get(key)
+    lock.Lock()
+    defer lock.Unlock()
+
+    topo := c.topology()
+    m, err := primaryMeta(casReplicas(topo, key), key)
+    if err != nil {
+        return
+    }
+    token := casToken(m)
+    if token == 0 {
+        return "NOT_FOUND", nil, nil
+    }
+    if token != item.Cas {
+        return "EXISTS", nil, nil
+    }
+    ok, targets, err := c.Set(key, item, noreply)
+    if err != nil {
+        return
+    }
+    if ok {
+        status = "STORED"
+    } else {
+        status = "NOT_STORED"
+    }
+    return
+}
+
+type getResult struct {
+    host    *Host
+    item    *Item
+    err     error
+    latency time.Duration
+}
+
+// try replicas in order, and hedge to the next one if the current one
+// does not answer within the percentile delay
 func (c *Client) Get(key string) (r *Item, targets []string, err error) {
-    hosts := c.scheduler.GetHostsByKey(key)
+    topo := c.topology()
+    hosts := topo.scheduler.GetHostsByKey(key)[:topo.N]
+    results := make(chan *getResult, len(hosts))
+    send := func(host *Host) {
+        go func() {
+            st := time.Now()
+            item, err := host.Get(key)
+            results <- &getResult{host, item, err, time.Since(st)}
+        }()
+    }
+
+    c.hedger.Earn()
+    delay := c.hedger.Delay()
+    hedged := make(map[*Host]bool)
+    var hedge <-chan time.Time
+
+    send(hosts[0])
+    next, pending := 1, 1
+    if next < len(hosts) {
+        hedge = time.After(delay)
+    }
     cnt := 0
-    for _, host := range hosts[:c.N] {
-        st := time.Now()
-        r, err = host.Get(key)
-        if err == nil {
-            cnt++
-            if r != nil {
-                t := float64(time.Now().Sub(st)) / 1e9
-                c.scheduler.Feedback(host, key, 1 - float64(math.Sqrt(t)*t))
-                // got the right rval
-                targets = []string{host.Addr}
-                err = nil
-                //return r, nil
-                return
-            } else {
-                targets = append(targets, host.Addr)
+    for pending > 0 {
+        select {
+        case <-hedge:
+            hedge = nil
+            if c.hedger.Allow() {
+                c.stats.UpdateStat("hedge_issued", 1)
+                hedged[hosts[next]] = true
+                send(hosts[next])
+                next++
+                pending++
+                if next < len(hosts) {
+                    hedge = time.After(delay)
+                }
+            }
+            continue
+        case res := <-results:
+            pending--
+            host := res.host
+            r, err = res.item, res.err
+            topo.scheduler.Feedback(host, key, res.latency, err)
+            if err == nil {
+                c.hedger.Observe(res.latency)
+                cnt++
+                if r != nil {
+                    // some replicas missed it, or check the versions by chance
+                    if cnt > 1 || rand.Float64() < ReadRepairChance {
+                        topo.repairer.Submit(key, hosts)
+                    }
+                    if hedged[host] {
+                        c.stats.UpdateStat("hedge_won", 1)
+                        delete(hedged, host)
+                    }
+                    c.stats.UpdateStat("hedge_wasted", int64(len(hedged)))
+                    // got the right rval
+                    targets = []string{host.Addr}
+                    err = nil
+                    //return r, nil
+                    return
+                } else {
+                    targets = append(targets, host.Addr)
+                }
+            }
+        }
+
+        if pending == 0 && next < len(hosts) {
+            send(hosts[next])
+            next++
+            pending++
+            if next < len(hosts) {
+                hedge = time.After(delay)
             }
-        } else if err.Error() != "wait for retry" {
-            c.scheduler.Feedback(host, key, -5)
-        } else {
-            c.scheduler.Feedback(host, key, -2)
         }
     }
+    c.stats.UpdateStat("hedge_wasted", int64(len(hedged)))
 
-    if cnt >= c.R {
+    if cnt >= topo.R {
         // because hosts are sorted
         err = nil
     }
@@ -60,25 +195,20 @@ func (c *Client) Get(key string) (r *Item, targets []string, err error) {
     return
 }
 
-func (c *Client) getMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
+func (c *Client) getMulti(topo *topology, keys []string) (rs map[string]*Item, targets []string, err error) {
     need := len(keys)
     rs = make(map[string]*Item, need)
-    hosts := c.scheduler.GetHostsByKey(keys[0])
+    hosts := topo.scheduler.GetHostsByKey(keys[0])
     suc := 0
-    for _, host := range hosts[:c.N] {
+    for _, host := range hosts[:topo.N] {
         st := time.Now()
         r, er := host.GetMulti(keys)
+        topo.scheduler.Feedback(host, keys[0], time.Since(st), er)
         if er == nil {
             suc += 1
             if r != nil {
                 targets = append(targets, host.Addr)
-                t := float64(time.Now().Sub(st)) / 1e9
-                c.scheduler.Feedback(host, keys[0], 1 - float64(math.Sqrt(t)*t))
             }
-        } else if er.Error() != "wait for retry" { // failed
-            c.scheduler.Feedback(host, keys[0], -5)
-        } else {
-            c.scheduler.Feedback(host, keys[0], -2)
         }
         err = er
         if er != nil {
@@ -104,7 +234,7 @@ func (c *Client) getMulti(keys []string) (rs map[string]*Item, targets []string,
             break // repeated keys
         }
     }
-    if suc > c.R {
+    if suc > topo.R {
         err = nil
     }
     return
@@ -114,12 +244,13 @@ func (c *Client) GetMulti(keys []string) (rs map[string]*Item, targets []string,
     var lock sync.Mutex
     rs = make(map[string]*Item, len(keys))
 
-    gs := c.scheduler.DivideKeysByBucket(keys)
+    topo := c.topology()
+    gs := topo.scheduler.DivideKeysByBucket(keys)
     reply := make(chan bool, len(gs))
     for _, ks := range gs {
         if len(ks) > 0 {
             go func(keys []string) {
-                r, t, e := c.getMulti(keys)
+                r, t, e := c.getMulti(topo, keys)
                 if e != nil {
                     err = e
                 } else {
@@ -143,22 +274,146 @@ func (c *Client) GetMulti(keys []string) (rs map[string]*Item, targets []string,
     return
 }
 
-func (c *Client) Set(key string, item *Item, noreply bool) (ok bool, targets []string, final_err error) {
-    suc := 0
-    for i, host := range c.scheduler.GetHostsByKey(key) {
-        if ok, err := host.Set(key, item, noreply); err == nil && ok {
+type writeResult struct {
+    index   int
+    host    *Host
+    ok      bool
+    err     error
+    latency time.Duration
+}
+
+// fan out the write to N primaries concurrently, a failed one falls back to
+// the next backup host. return once W of them succeeded, one outside of
+// the local zone if possible, or all finished,
+// the rest finish in background, then release is called.
+// the mirrors of a migrating bucket get the write too, but are not counted.
+func (c *Client) write(topo *topology, key, op string, release func(),
+    do func(host *Host) (bool, error)) (suc int, targets []string) {
+    hosts := topo.scheduler.GetHostsByKey(key)
+    mirrors := getMirrors(topo.scheduler, key)
+    if len(mirrors) > 0 && len(hosts) > topo.N {
+        hosts = append(hosts[:topo.N:topo.N], withoutHosts(hosts[topo.N:], mirrors)...)
+    }
+    results := make(chan *writeResult, len(hosts)+len(mirrors))
+    sendHost := func(i int, host *Host) {
+        go func() {
+            st := time.Now()
+            ok, err := do(host)
+            results <- &writeResult{i, host, ok, err, time.Since(st)}
+        }()
+    }
+    send := func(i int) {
+        sendHost(i, hosts[i])
+    }
+
+    next := min(topo.N, len(hosts))
+    for i := 0; i < next; i++ {
+        send(i)
+    }
+    for _, host := range mirrors {
+        sendHost(-1, host)
+    }
+    pending := next + len(mirrors)
+    // handle one result, return whether it succeeded
+    handle := func(r *writeResult) bool {
+        pending--
+        if r.index < 0 {
+            return false
+        }
+        topo.scheduler.Feedback(r.host, key, r.latency, r.err)
+        if r.err == nil && r.ok {
+            return true
+        }
+        if r.err != nil {
+            c.hint(r.index < topo.N, r.host, key, op)
+        }
+        if next < len(hosts) {
+            send(next)
+            next++
+            pending++
+        }
+        return false
+    }
+
+    // with W > 1, one of the acks should be outside of the local zone, it
+    // is waited for as long as the writes are pending
+    zone := localZone()
+    needRemote := zone != "" && topo.W > 1 && hasRemote(hosts, zone)
+    remote := false
+    for pending > 0 && (suc < topo.W || needRemote && !remote) {
+        r := <-results
+        if handle(r) {
             suc++
-            targets = append(targets, host.Addr)
-        } else if err.Error() != "wait for retry" {
-            c.scheduler.Feedback(host, key, -10)
+            targets = append(targets, r.host.Addr)
+            if r.host.Zone != zone {
+                remote = true
+            }
         }
+    }
+    // the write is durable in W replicas, the client should not retry it
+    if needRemote && !remote && suc >= topo.W {
+        ErrorLog.Printf("key: %s was written only in zone %s: %v", key, zone, targets)
+        c.stats.UpdateStat("write_local_only", 1)
+    }
 
-        if suc >= c.W && (i+1) >= c.N {
-            // at least try N backends, and succeed W backends
-            break
+    if pending == 0 {
+        release()
+        return
+    }
+    go func() {
+        for pending > 0 {
+            handle(<-results)
         }
+        release()
+    }()
+    return
+}
+
+func getMirrors(sch Scheduler, key string) []*Host {
+    if m, ok := sch.(Mirrorer); ok {
+        return m.GetMirrorsByKey(key)
     }
-    if suc < c.W {
+    return nil
+}
+
+func withoutHosts(hosts, excluded []*Host) []*Host {
+    r := make([]*Host, 0, len(hosts))
+    for _, h := range hosts {
+        found := false
+        for _, e := range excluded {
+            found = found || h == e
+        }
+        if !found {
+            r = append(r, h)
+        }
+    }
+    return r
+}
+
+func hasRemote(hosts []*Host, zone string) bool {
+    for _, h := range hosts {
+        if h != nil && h.Zone != zone {
+            return true
+        }
+    }
+    return false
+}
+
+func min(a, b int) int {
+    if a < b {
+        return a
+    }
+    return b
+}
+
+func (c *Client) Set(key string, item *Item, noreply bool) (ok bool, targets []string, final_err error) {
+    // the caller frees the item after return, keep it for background writes
+    release := item.detach()
+    topo := c.topology()
+    suc, targets := c.write(topo, key, "set", release, func(host *Host) (bool, error) {
+        return host.Set(key, item, noreply)
+    })
+    if suc < topo.W {
         ok = false
         final_err = errors.New("write failed")
         return
@@ -168,21 +423,15 @@ func (c *Client) Set(key string, item *Item, noreply bool) (ok bool, targets []s
 }
 
 func (c *Client) Append(key string, value []byte) (ok bool, targets []string, final_err error) {
-    suc := 0
-    for i, host := range c.scheduler.GetHostsByKey(key) {
-        if ok, err := host.Append(key, value); err == nil && ok {
-            suc++
-            targets = append(targets, host.Addr)
-        } else if err.Error() != "wait for retry" {
-            c.scheduler.Feedback(host, key, -5)
-        }
-
-        if suc >= c.W && (i+1) >= c.N {
-            // at least try N backends, and succeed W backends
-            break
-        }
+    if len(value) > AllocLimit {
+        // value may be allocated by cmem, which is freed by the caller after return
+        value = append([]byte(nil), value...)
     }
-    if suc < c.W {
+    topo := c.topology()
+    suc, targets := c.write(topo, key, "append", func() {}, func(host *Host) (bool, error) {
+        return host.Append(key, value)
+    })
+    if suc < topo.W {
         ok = false
         final_err = errors.New("write failed")
         return
@@ -194,7 +443,8 @@ func (c *Client) Append(key string, value []byte) (ok bool, targets []string, fi
 func (c *Client) Incr(key string, value int) (result int, targets []string, err error) {
     //result := 0
     suc := 0
-    for i, host := range c.scheduler.GetHostsByKey(key) {
+    topo := c.topology()
+    for i, host := range topo.scheduler.GetHostsByKey(key) {
         r, e := host.Incr(key, value)
         if e != nil {
             err = e
@@ -207,7 +457,7 @@ func (c *Client) Incr(key string, value int) (result int, targets []string, err
         if r > result {
             result = r
         }
-        if suc >= c.W && (i+1) >= c.N {
+        if suc >= topo.W && (i+1) >= topo.N {
             // at least try N backends, and succeed W backends
             break
         }
@@ -223,8 +473,13 @@ func (c *Client) Delete(key string) (r bool, targets []string, err error) {
     suc := 0
     err_count := 0
     failed_hosts := make([]string, 2)
-    for i, host := range c.scheduler.GetHostsByKey(key) {
+    topo := c.topology()
+    for i, host := range topo.scheduler.GetHostsByKey(key) {
+        st := time.Now()
         ok, er := host.Delete(key)
+        if i < topo.N {
+            topo.scheduler.Feedback(host, key, time.Since(st), er)
+        }
 
         if ok {
             suc++
@@ -233,18 +488,19 @@ func (c *Client) Delete(key string) (r bool, targets []string, err error) {
             err = er
             err_count++
             failed_hosts = append(failed_hosts, host.Addr)
-            if i >= c.N {
+            c.hint(i < topo.N, host, key, "delete")
+            if i >= topo.N {
                 continue
             }
-            if er.Error() != "wait for retry" {
-                c.scheduler.Feedback(host, key, -10)
-            }
         }
 
-        if suc >= c.N {
+        if suc >= topo.N {
             break
         }
     }
+    for _, host := range getMirrors(topo.scheduler, key) {
+        host.Delete(key)
+    }
     if err_count > 0 {
         ErrorLog.Printf("key: %s was delete failed in %v, and the last erorr is %s", key, failed_hosts, err)
     }
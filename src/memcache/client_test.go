@@ -2,20 +2,21 @@ package memcache
 
 import "testing"
 
-var config map[string][]int = map[string][]int{
-    "localhost":       []int{0},
-    "localhost:11599": []int{0},
+var config map[string][]string = map[string][]string{
+    "localhost:11291": []string{"0"},
+    "localhost:11292": []string{"0"},
 }
-var badconfig map[string][]int = map[string][]int{
-    "localhost:11599": []int{0},
+var badconfig map[string][]string = map[string][]string{
+    "localhost:11599": []string{"0"},
 }
 
 func TestClient(t *testing.T) {
-    client := NewClient(NewManualScheduler(config))
-    client.W = 1
-    testStore(t, client)
+    for addr := range config {
+        defer startTestServer(t, addr).Shutdown()
+    }
+    client := NewClient(NewManualScheduler(config, 1, 2), 2, 2, 1)
+    testDistributeStore(t, client)
 
-    client = NewClient(NewManualScheduler(badconfig))
-    client.W = 1
-    testFailStore(t, client)
+    client = NewClient(NewManualScheduler(badconfig, 1, 1), 1, 1, 1)
+    testFailDistributeStore(t, client)
 }
@@ -0,0 +1,333 @@
+/*
+ * hinted handoff: remember writes missed by a replica, replay them later
+ */
+
+package memcache
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+var HandoffReplayInterval = time.Second * 5
+var HandoffMaxHints = 1000000 // the oldest hints are dropped beyond it, 0 for no limit
+
+type hint struct {
+    op   string // set, append, delete
+    addr string
+    key  string
+    seq  uint64 // the order of adding
+}
+
+func (h *hint) String() string {
+    return fmt.Sprintf("%s %s %s", h.op, h.addr, h.key)
+}
+
+func parseHint(line string) (*hint, error) {
+    parts := strings.Fields(line)
+    if len(parts) != 3 {
+        return nil, errors.New("invalid hint: " + line)
+    }
+    return &hint{op: parts[0], addr: parts[1], key: parts[2]}, nil
+}
+
+// hints are appended to a journal, one per line, which is rewritten
+// after each replay round to drop the replayed ones. the same op on a key
+// is kept once per host, replaying it copies the newest version anyway.
+type HintedHandoff struct {
+    sync.Mutex
+    path      string
+    journal   *os.File
+    lines     int                // in the journal
+    hints     map[string][]*hint // by addr
+    pending   map[string]*hint   // hints not replayed yet, by String()
+    count     int
+    seq       uint64
+    hosts     map[string]*Host
+    scheduler Scheduler
+    stats     *Stats
+}
+
+func newHintedHandoff(path string, sch Scheduler, stats *Stats) (h *HintedHandoff, err error) {
+    h = new(HintedHandoff)
+    h.path = path
+    h.hints = make(map[string][]*hint)
+    h.pending = make(map[string]*hint)
+    h.hosts = make(map[string]*Host)
+    h.scheduler = sch
+    h.stats = stats
+    if err = h.load(); err != nil {
+        return nil, err
+    }
+    if err = h.compact(); err != nil {
+        return nil, err
+    }
+    go func() {
+        for {
+            time.Sleep(HandoffReplayInterval)
+            h.replay()
+        }
+    }()
+    return h, nil
+}
+
+func (h *HintedHandoff) load() error {
+    f, err := os.Open(h.path)
+    if os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+    defer f.Close()
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        ht, err := parseHint(scanner.Text())
+        if err != nil {
+            ErrorLog.Print("skip bad line in handoff journal: ", err)
+            continue
+        }
+        h.push(ht)
+    }
+    return scanner.Err()
+}
+
+// push queues a new hint, false if the same one is pending, must hold the lock
+func (h *HintedHandoff) push(ht *hint) bool {
+    s := ht.String()
+    if h.pending[s] != nil {
+        return false
+    }
+    h.seq++
+    ht.seq = h.seq
+    h.pending[s] = ht
+    h.hints[ht.addr] = append(h.hints[ht.addr], ht)
+    h.count++
+    limit := handoffMaxHints()
+    for limit > 0 && h.count > limit {
+        h.dropOldest()
+    }
+    return true
+}
+
+// the oldest hint is the first of some host, must hold the lock
+func (h *HintedHandoff) dropOldest() {
+    var oldest string
+    for addr, hs := range h.hints {
+        if oldest == "" || hs[0].seq < h.hints[oldest][0].seq {
+            oldest = addr
+        }
+    }
+    ht := h.hints[oldest][0]
+    h.remove(oldest, 1)
+    if h.stats != nil {
+        h.stats.UpdateStat("handoff_dropped", 1)
+    }
+    ErrorLog.Printf("too many hints, drop %s", ht)
+}
+
+// the same op is queued again after unpend, must hold the lock
+func (h *HintedHandoff) unpend(ht *hint) {
+    if s := ht.String(); h.pending[s] == ht {
+        delete(h.pending, s)
+    }
+}
+
+// undo unpend of a queued hint, unless the same op was queued meanwhile,
+// must hold the lock
+func (h *HintedHandoff) repend(ht *hint) {
+    if s := ht.String(); h.pending[s] == nil {
+        h.pending[s] = ht
+    }
+}
+
+// remove the first n hints of addr, must hold the lock
+func (h *HintedHandoff) remove(addr string, n int) {
+    hs := h.hints[addr]
+    for _, ht := range hs[:n] {
+        h.unpend(ht)
+    }
+    h.count -= n
+    if n == len(hs) {
+        delete(h.hints, addr)
+    } else {
+        h.hints[addr] = hs[n:]
+    }
+}
+
+// rewrite the journal with pending hints, must hold the lock
+func (h *HintedHandoff) compact() error {
+    tmp := h.path + ".tmp"
+    f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(f)
+    lines := 0
+    for _, hs := range h.hints {
+        for _, ht := range hs {
+            fmt.Fprintln(w, ht)
+        }
+        lines += len(hs)
+    }
+    if err = w.Flush(); err != nil {
+        f.Close()
+        return err
+    }
+    f.Close()
+    if err = os.Rename(tmp, h.path); err != nil {
+        return err
+    }
+    if h.journal != nil {
+        h.journal.Close()
+    }
+    h.lines = lines
+    h.journal, err = os.OpenFile(h.path, os.O_APPEND|os.O_WRONLY, 0644)
+    return err
+}
+
+// Add records that host missed an op on key
+func (h *HintedHandoff) Add(host *Host, key, op string) {
+    ht := &hint{op: op, addr: host.Addr, key: key}
+    h.Lock()
+    defer h.Unlock()
+    h.hosts[ht.addr] = host
+    if !h.push(ht) {
+        h.stats.UpdateStat("handoff_coalesced", 1)
+        return
+    }
+    h.stats.UpdateStat("handoff_queued", 1)
+    // dropped hints are left in the journal until it is compacted
+    if limit := handoffMaxHints(); limit > 0 && h.lines >= 2*limit {
+        if err := h.compact(); err != nil {
+            ErrorLog.Print("compact handoff journal failed: ", err)
+        }
+        return
+    }
+    if _, err := fmt.Fprintln(h.journal, ht); err != nil {
+        ErrorLog.Print("write handoff journal failed: ", err)
+    }
+    h.lines++
+}
+
+func (h *HintedHandoff) Len() int {
+    h.Lock()
+    defer h.Unlock()
+    return h.count
+}
+
+// hints are replayed by the hosts of the new scheduler after reload
+func (h *HintedHandoff) setScheduler(sch Scheduler) {
+    h.Lock()
+    defer h.Unlock()
+    h.scheduler = sch
+    h.hosts = make(map[string]*Host)
+}
+
+// find the Host for addr, hints loaded from journal have no Host yet
+func (h *HintedHandoff) findHost(ht *hint) *Host {
+    if host, ok := h.hosts[ht.addr]; ok {
+        return host
+    }
+    for _, host := range h.scheduler.GetHostsByKey(ht.key) {
+        if host.Addr == ht.addr {
+            h.hosts[ht.addr] = host
+            return host
+        }
+    }
+    return nil
+}
+
+// copy the newest version of the key to the host from the other replicas,
+// deletes are replayed as well because deleted keys keep their versions
+func (h *HintedHandoff) replayHint(sch Scheduler, host *Host, ht *hint) error {
+    if _, err := host.GetMeta(ht.key); err != nil {
+        return err
+    }
+    hosts := sch.GetHostsByKey(ht.key)
+    found := false
+    for _, other := range hosts {
+        if other == host {
+            found = true
+        }
+    }
+    if !found {
+        hosts = append(hosts, host)
+    }
+    _, err := repairKey(ht.key, hosts)
+    return err
+}
+
+func (h *HintedHandoff) replay() {
+    h.Lock()
+    addrs := make([]string, 0, len(h.hints))
+    for addr := range h.hints {
+        addrs = append(addrs, addr)
+    }
+    h.Unlock()
+
+    changed := false
+    for _, addr := range addrs {
+        h.Lock()
+        hs := h.hints[addr]
+        var host *Host
+        if len(hs) > 0 {
+            host = h.findHost(hs[0])
+        }
+        sch := h.scheduler
+        h.Unlock()
+        if len(hs) == 0 || host != nil && !host.Reachable() {
+            continue
+        }
+
+        done := len(hs)
+        if host == nil {
+            ErrorLog.Printf("drop %d hints for unknown host %s", len(hs), addr)
+        } else {
+            for i, ht := range hs {
+                // the same op added from now on is queued again
+                h.Lock()
+                h.unpend(ht)
+                h.Unlock()
+                if err := h.replayHint(sch, host, ht); err != nil {
+                    // it stays queued, so the same op coalesces into it again
+                    h.Lock()
+                    h.repend(ht)
+                    h.Unlock()
+                    ErrorLog.Printf("replay hint %s failed: %s", ht, err)
+                    h.stats.UpdateStat("handoff_failed", 1)
+                    done = i
+                    break
+                }
+            }
+            h.stats.UpdateStat("handoff_replayed", int64(done))
+        }
+        changed = changed || done > 0
+
+        // some of them may have been dropped meanwhile
+        h.Lock()
+        n := 0
+        for _, ht := range h.hints[addr] {
+            if n == done || ht.seq > hs[done-1].seq {
+                break
+            }
+            n++
+        }
+        if n > 0 {
+            h.remove(addr, n)
+        }
+        h.Unlock()
+    }
+
+    if changed {
+        h.Lock()
+        if err := h.compact(); err != nil {
+            ErrorLog.Print("compact handoff journal failed: ", err)
+        }
+        h.Unlock()
+    }
+}
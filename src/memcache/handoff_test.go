@@ -0,0 +1,129 @@
+package memcache
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestHandoffJournal(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "handoff")
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "handoff.journal")
+
+    schd := NewModScheduler([]string{"localhost:11911"}, "md5")
+    h, err := newHintedHandoff(path, schd, NewStats())
+    if err != nil {
+        t.Fatal("open handoff failed", err)
+    }
+    host := schd.GetHostsByKey("key")[0]
+    h.Add(host, "key", "set")
+    h.Add(host, "key2", "delete")
+    if h.Len() != 2 {
+        t.Errorf("expect 2 hints but %d", h.Len())
+    }
+
+    // reload from journal
+    h2, err := newHintedHandoff(path, schd, NewStats())
+    if err != nil {
+        t.Fatal("reopen handoff failed", err)
+    }
+    if h2.Len() != 2 {
+        t.Errorf("expect 2 hints after reload but %d", h2.Len())
+    }
+    hs := h2.hints["localhost:11911"]
+    if len(hs) != 2 || hs[0].key != "key" || hs[1].op != "delete" {
+        t.Errorf("unexpected hints after reload: %v", hs)
+    }
+    if h2.findHost(hs[0]) != host {
+        t.Error("should find host by key")
+    }
+}
+
+func TestHandoffCoalesceAndLimit(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "handoff")
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "handoff.journal")
+    old := HandoffMaxHints
+    HandoffMaxHints = 3
+    defer func() { HandoffMaxHints = old }()
+
+    schd := NewModScheduler([]string{"localhost:11911"}, "md5")
+    stats := NewStats()
+    h, err := newHintedHandoff(path, schd, stats)
+    if err != nil {
+        t.Fatal("open handoff failed", err)
+    }
+    host := schd.GetHostsByKey("key")[0]
+    for i := 0; i < 10; i++ {
+        h.Add(host, "key", "set")
+    }
+    h.Add(host, "key", "delete")
+    if h.Len() != 2 {
+        t.Errorf("expect 2 hints after coalescing but %d", h.Len())
+    }
+
+    for _, key := range []string{"a", "b", "c"} {
+        h.Add(host, key, "set")
+    }
+    if h.Len() != 3 {
+        t.Errorf("expect 3 hints within the limit but %d", h.Len())
+    }
+    hs := h.hints["localhost:11911"]
+    if len(hs) != 3 || hs[0].key != "a" || hs[2].key != "c" {
+        t.Errorf("the oldest hints should be dropped: %v", hs)
+    }
+    if n := stats.Counters()["handoff_dropped"]; n != 2 {
+        t.Errorf("expect 2 dropped but %d", n)
+    }
+    // a dropped hint can be queued again
+    h.Add(host, "key", "set")
+    if hs := h.hints["localhost:11911"]; len(hs) != 3 || hs[2].key != "key" {
+        t.Errorf("unexpected hints: %v", hs)
+    }
+
+    h2, err := newHintedHandoff(path, schd, NewStats())
+    if err != nil {
+        t.Fatal("reopen handoff failed", err)
+    }
+    if h2.Len() != 3 {
+        t.Errorf("expect 3 hints after reload but %d", h2.Len())
+    }
+}
+
+func TestHandoffFailedReplayCoalesces(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "handoff")
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "handoff.journal")
+
+    // the host is up, but replaying fails on its broken meta
+    store := NewMapStore()
+    store.Set("?key", &Item{Body: []byte("broken")}, false)
+    s := NewServer(mapDistStore{store})
+    if err := s.Listen("localhost:11321"); err != nil {
+        t.Fatal(err)
+    }
+    go s.Serve()
+    defer s.Shutdown()
+
+    schd := NewModScheduler([]string{"localhost:11321"}, "md5")
+    stats := NewStats()
+    h, err := newHintedHandoff(path, schd, stats)
+    if err != nil {
+        t.Fatal("open handoff failed", err)
+    }
+    host := schd.GetHostsByKey("key")[0]
+    h.Add(host, "key", "set")
+    h.replay()
+    if n := stats.Counters()["handoff_failed"]; n != 1 {
+        t.Fatalf("expect the replay failed but %d", n)
+    }
+    h.Add(host, "key", "set")
+    if h.Len() != 1 {
+        t.Errorf("expect 1 hint after a failed replay but %d", h.Len())
+    }
+    if n := stats.Counters()["handoff_coalesced"]; n != 1 {
+        t.Errorf("expect 1 coalesced but %d", n)
+    }
+}
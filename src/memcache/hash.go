@@ -1,7 +1,9 @@
 package memcache
 
 import (
+    "bytes"
     "crypto/md5"
+    "fmt"
     "hash/crc32"
     "hash/fnv"
 )
@@ -46,3 +48,56 @@ var hashMethods = map[string]HashMethod{
     "crc32":  crc32hash,
     "md5":    md5hash,
 }
+
+// the hash of beansdb servers, `@` listings of buckets are by it
+const DefaultHashName = "fnv1a1"
+
+// KeyTransform changes the key before hashing, so related keys can be
+// routed to the same bucket
+type KeyTransform func(key []byte) []byte
+
+// StripPrefix hashes the key without the prefix
+func StripPrefix(prefix string) KeyTransform {
+    p := []byte(prefix)
+    return func(key []byte) []byte {
+        return bytes.TrimPrefix(key, p)
+    }
+}
+
+// HashTag hashes only the part of the key in the tag, like "{}" for
+// "user{42}:name", if there is a non-empty one
+func HashTag(tag string) (KeyTransform, error) {
+    if len(tag) != 2 || tag[0] == tag[1] {
+        return nil, fmt.Errorf("hash tag should be two different chars like {}, got %q", tag)
+    }
+    begin, end := tag[0], tag[1]
+    return func(key []byte) []byte {
+        i := bytes.IndexByte(key, begin)
+        if i < 0 {
+            return key
+        }
+        j := bytes.IndexByte(key[i+1:], end)
+        if j <= 0 {
+            return key
+        }
+        return key[i+1 : i+1+j]
+    }, nil
+}
+
+// NewHashMethod returns the hash of the name, applied to the key after
+// the transforms in order
+func NewHashMethod(name string, transforms ...KeyTransform) (HashMethod, error) {
+    h, ok := hashMethods[name]
+    if !ok {
+        return nil, fmt.Errorf("unknown hash method %q", name)
+    }
+    if len(transforms) == 0 {
+        return h, nil
+    }
+    return func(key []byte) uint32 {
+        for _, t := range transforms {
+            key = t(key)
+        }
+        return h(key)
+    }, nil
+}
@@ -35,3 +35,35 @@ func Test(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyTransform(t *testing.T) {
+	tag, err := HashTag("{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHashMethod("fnv1a", StripPrefix("app:"), tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, hashed := range map[string]string{
+		"app:user{42}:name": "42",
+		"user{42}:age":      "42",
+		"app:hello":         "hello",
+		"user{}:x":          "user{}:x",
+		"user{42:x":         "user{42:x",
+		"{a}{b}":            "a",
+	} {
+		if h([]byte(key)) != fnv1a([]byte(hashed)) {
+			t.Errorf("%s should be hashed as %s", key, hashed)
+		}
+	}
+
+	if _, err := NewHashMethod("sha1"); err == nil {
+		t.Error("unknown hash method")
+	}
+	for _, s := range []string{"", "{", "{{", "{}}"} {
+		if _, err := HashTag(s); err == nil {
+			t.Errorf("invalid hash tag %q", s)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * hedged reads: send the get to the next replica if the first one is slow
+ */
+
+package memcache
+
+import (
+    "sort"
+    "sync"
+    "time"
+)
+
+var HedgePercentile = 0.95 // hedge after this percentile of get latency
+var HedgeBudget = 0.05     // at most this ratio of extra requests
+var HedgeSamples = 1000    // latencies kept to calculate the percentile
+
+const hedgeMinSamples = 100
+const hedgeMaxTokens = 10.0
+
+type hedger struct {
+    sync.Mutex
+    samples  []time.Duration
+    pos      int
+    observed int
+    delay    time.Duration
+    tokens   float64
+}
+
+func newHedger() *hedger {
+    h := new(hedger)
+    h.samples = make([]time.Duration, HedgeSamples)
+    h.delay = ReadTimeout
+    return h
+}
+
+func (h *hedger) Observe(d time.Duration) {
+    h.Lock()
+    defer h.Unlock()
+    h.samples[h.pos] = d
+    h.pos = (h.pos + 1) % len(h.samples)
+    h.observed++
+    // recalculate the delay once in a while
+    if h.observed >= hedgeMinSamples && h.observed%hedgeMinSamples == 0 {
+        n := min(h.observed, len(h.samples))
+        sorted := make([]time.Duration, n)
+        copy(sorted, h.samples[:n])
+        sort.Sort(durationSlice(sorted))
+        h.delay = sorted[int(float64(n-1)*hedgePercentile())]
+    }
+}
+
+// Delay is ReadTimeout until enough latencies are observed
+func (h *hedger) Delay() time.Duration {
+    h.Lock()
+    defer h.Unlock()
+    return h.delay
+}
+
+// Earn is called for every get, which earns part of a hedge
+func (h *hedger) Earn() {
+    h.Lock()
+    defer h.Unlock()
+    h.tokens += hedgeBudget()
+    if h.tokens > hedgeMaxTokens {
+        h.tokens = hedgeMaxTokens
+    }
+}
+
+// Allow takes a hedge from the budget
+func (h *hedger) Allow() bool {
+    h.Lock()
+    defer h.Unlock()
+    if h.tokens < 1 {
+        return false
+    }
+    h.tokens -= 1
+    return true
+}
+
+type durationSlice []time.Duration
+
+func (l durationSlice) Len() int {
+    return len(l)
+}
+
+func (l durationSlice) Less(i, j int) bool {
+    return l[i] < l[j]
+}
+
+func (l durationSlice) Swap(i, j int) {
+    l[i], l[j] = l[j], l[i]
+}
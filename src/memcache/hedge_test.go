@@ -0,0 +1,33 @@
+package memcache
+
+import (
+    "testing"
+    "time"
+)
+
+func TestHedgeDelay(t *testing.T) {
+    h := newHedger()
+    if h.Delay() != ReadTimeout {
+        t.Errorf("delay should be ReadTimeout before observed enough")
+    }
+    for i := 1; i <= 100; i++ {
+        h.Observe(time.Duration(i) * time.Millisecond)
+    }
+    if d := h.Delay(); d != 95*time.Millisecond {
+        t.Errorf("expect delay 95ms but %s", d)
+    }
+}
+
+func TestHedgeBudget(t *testing.T) {
+    h := newHedger()
+    hedges := 0
+    for i := 0; i < 1000; i++ {
+        h.Earn()
+        if h.Allow() {
+            hedges++
+        }
+    }
+    if hedges != 50 {
+        t.Errorf("expect 50 hedges in 1000 gets but %d", hedges)
+    }
+}
@@ -7,6 +7,7 @@ import (
     "net"
     "strconv"
     "strings"
+    "sync"
     "time"
 )
 
@@ -17,14 +18,24 @@ var WriteTimeout time.Duration = time.Millisecond * 2000
 
 type Host struct {
     Addr     string
+    Zone     string
     nextDial time.Time
     conns    chan net.Conn
     offset   int
+
+    // used when PipelineConns > 0
+    pipeLock sync.Mutex
+    pipes    []*pipeConn
+    pipeNext int
+    batcher  *getBatcher
+
+    metrics hostMetrics
 }
 
 func NewHost(addr string) *Host {
     host := &Host{Addr: addr}
     host.conns = make(chan net.Conn, MaxFreeConns)
+    host.batcher = newGetBatcher(host)
     return host
 }
 
@@ -39,8 +50,9 @@ func (host *Host) Close() {
     ch := host.conns
     host.conns = nil
     close(ch)
+    host.closePipes()
 
-    for c, closed := <-ch; closed; {
+    for c := range ch {
         c.Close()
     }
 }
@@ -63,6 +75,11 @@ func (host *Host) createConn() (net.Conn, error) {
     return conn, nil
 }
 
+// Reachable is false while waiting to retry after a failed dial
+func (host *Host) Reachable() bool {
+    return host.conns != nil && !host.nextDial.After(time.Now())
+}
+
 func (host *Host) getConn() (c net.Conn, err error) {
     if host.conns == nil {
         return nil, errors.New("host closed")
@@ -87,7 +104,20 @@ func (host *Host) releaseConn(conn net.Conn) {
     }
 }
 
+// the status of a noreply request once it is written, the server answers
+// nothing, so the callers decide what it means for the command
+const noReplyStatus = "NOREPLY"
+
 func (host *Host) execute(req *Request) (resp *Response, err error) {
+    start := time.Now()
+    defer func() {
+        host.metrics.observe(time.Since(start), err)
+    }()
+
+    if pipelineConns() > 0 {
+        return host.executePipelined(req)
+    }
+
     var conn net.Conn
     conn, err = host.getConn()
     if err != nil {
@@ -104,7 +134,7 @@ func (host *Host) execute(req *Request) (resp *Response, err error) {
     resp = new(Response)
     if req.NoReply {
         host.releaseConn(conn)
-        resp.status = "STORED"
+        resp.status = noReplyStatus
         return
     }
 
@@ -158,6 +188,41 @@ func (host *Host) Get(key string) (*Item, error) {
     return item, nil
 }
 
+// metadata of a key in beansdb, returned by `?key`
+type Meta struct {
+    Version   int
+    Hash      int
+    Flag      int
+    Size      int
+    Timestamp int
+}
+
+// body of `?key` is "version hash flag size timestamp chunk_id pos"
+func parseMeta(body []byte) (*Meta, error) {
+    parts := strings.Fields(string(body))
+    if len(parts) < 5 {
+        return nil, errors.New("invalid meta: " + string(body))
+    }
+    vs := make([]int, 5)
+    for i := range vs {
+        v, err := strconv.Atoi(parts[i])
+        if err != nil {
+            return nil, errors.New("invalid meta: " + string(body))
+        }
+        vs[i] = v
+    }
+    return &Meta{Version: vs[0], Hash: vs[1], Flag: vs[2], Size: vs[3], Timestamp: vs[4]}, nil
+}
+
+// GetMeta returns nil without error if the key does not exist in host
+func (host *Host) GetMeta(key string) (*Meta, error) {
+    item, err := host.Get("?" + key)
+    if err != nil || item == nil {
+        return nil, err
+    }
+    return parseMeta(item.Body)
+}
+
 func (host *Host) GetMulti(keys []string) (map[string]*Item, error) {
     req := &Request{Cmd: "get", Keys: keys}
     resp, err := host.execute(req)
@@ -170,7 +235,7 @@ func (host *Host) GetMulti(keys []string) (map[string]*Item, error) {
 func (host *Host) store(cmd string, key string, item *Item, noreply bool) (bool, error) {
     req := &Request{Cmd: cmd, Keys: []string{key}, Item: item, NoReply: noreply}
     resp, err := host.executeWithTimeout(req, WriteTimeout)
-    return err == nil && resp.status == "STORED", err
+    return err == nil && (resp.status == "STORED" || noreply && resp.status == noReplyStatus), err
 }
 
 func (host *Host) Set(key string, item *Item, noreply bool) (bool, error) {
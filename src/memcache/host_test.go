@@ -5,7 +5,8 @@ import (
 )
 
 func TestHost(t *testing.T) {
-	host := NewHost("localhost")
+	defer startTestServer(t, "localhost:11290").Shutdown()
+	host := NewHost("localhost:11290")
 	testStore(t, host)
 	st, err := host.Stat(nil)
 	if err != nil {
@@ -0,0 +1,84 @@
+/*
+ * where does a key live and what does each replica hold
+ */
+
+package memcache
+
+import "time"
+
+type ReplicaState struct {
+    Addr    string
+    Primary bool
+    Score   float64
+    Meta    *Meta // nil if missing
+    Error   string
+    Winner  bool // holds the latest version
+    Stale   bool // disagrees with the winner
+}
+
+type KeyReport struct {
+    Key        string
+    Bucket     int
+    Replicas   []*ReplicaState
+    Consistent bool
+}
+
+func (c *ManualScheduler) BucketOf(key string) int {
+    return getBucketByKey(c.hashMethod, c.bucketWidth, key)
+}
+
+// Score of host in the bucket, higher is preferred
+func (c *ManualScheduler) Score(host *Host, bucket int) float64 {
+    c.scoreLock.Lock()
+    defer c.scoreLock.Unlock()
+    return -c.scores[bucket][host.offset].cost(time.Now())
+}
+
+// InspectKey asks every replica of key for its metadata
+func (c *ManualScheduler) InspectKey(key string) *KeyReport {
+    r := &KeyReport{Key: key, Bucket: c.BucketOf(key)}
+    var metas []*Meta
+    var failed []bool
+    for i, host := range c.GetHostsByKey(key) {
+        // bucket with less than N hosts
+        if host == nil {
+            continue
+        }
+        rs := &ReplicaState{Addr: host.Addr, Primary: i < c.N, Score: c.Score(host, r.Bucket)}
+        m, err := host.GetMeta(key)
+        if err != nil {
+            rs.Error = err.Error()
+        }
+        rs.Meta = m
+        metas = append(metas, m)
+        failed = append(failed, err != nil)
+        r.Replicas = append(r.Replicas, rs)
+    }
+
+    winner, stale := pickWinner(metas, failed)
+    if winner < 0 {
+        r.Consistent = true
+        return r
+    }
+    r.Replicas[winner].Winner = true
+    for _, i := range stale {
+        // backups do not hold the key usually
+        if r.Replicas[i].Primary || metas[i] != nil {
+            r.Replicas[i].Stale = true
+        }
+    }
+    // same version with different content
+    w := metas[winner]
+    for i, m := range metas {
+        if m != nil && m.Version == w.Version && m.Hash != w.Hash {
+            r.Replicas[i].Stale = true
+        }
+    }
+    r.Consistent = true
+    for _, rs := range r.Replicas {
+        if rs.Stale {
+            r.Consistent = false
+        }
+    }
+    return r
+}
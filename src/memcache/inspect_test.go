@@ -0,0 +1,37 @@
+package memcache
+
+import (
+    "io/ioutil"
+    "log"
+    "testing"
+)
+
+func TestInspectKey(t *testing.T) {
+    if ErrorLog == nil {
+        ErrorLog = log.New(ioutil.Discard, "", 0)
+    }
+    config := map[string][]string{
+        "127.0.0.1:1": []string{"0", "1"},
+        "127.0.0.1:2": []string{"0", "1"},
+        "127.0.0.1:3": []string{"-0", "-1"},
+    }
+    sch := NewManualScheduler(config, 2, 2)
+    for _, key := range []string{"a", "key", "@1", "?key"} {
+        if b := sch.BucketOf(key); b != getBucketByKey(fnv1a1, 1, key) {
+            t.Errorf("bucket of %s: %d", key, b)
+        }
+    }
+
+    r := sch.InspectKey("key")
+    if r.Key != "key" || len(r.Replicas) != 3 {
+        t.Fatal("bad report", r)
+    }
+    for i, rs := range r.Replicas {
+        if rs.Primary != (i < 2) || rs.Error == "" || rs.Meta != nil || rs.Stale {
+            t.Error("bad replica", i, rs)
+        }
+    }
+    if !r.Consistent {
+        t.Error("no replica answered, should be consistent")
+    }
+}
@@ -0,0 +1,200 @@
+/*
+ * ketama: the continuum of libketama, every server has 160 points (scaled
+ * by its weight) hashed by md5 of "addr-k", a key goes to the first point
+ * not less than its md5, and its replicas to the next distinct servers.
+ */
+
+package memcache
+
+import (
+    "crypto/md5"
+    "fmt"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+type ketamaPoint struct {
+    point uint32
+    host  int
+}
+
+type ketamaPoints []ketamaPoint
+
+func (l ketamaPoints) Len() int {
+    return len(l)
+}
+
+func (l ketamaPoints) Less(i, j int) bool {
+    if l[i].point != l[j].point {
+        return l[i].point < l[j].point
+    }
+    return l[i].host < l[j].host
+}
+
+func (l ketamaPoints) Swap(i, j int) {
+    l[i], l[j] = l[j], l[i]
+}
+
+// route requests by the continuum of libketama, with N replicas
+type KetamaScheduler struct {
+    N          int
+    hosts      []*Host
+    weights    []int
+    points     ketamaPoints
+    successors [][]int // distinct hosts from each point
+    groups     []int   // points with the same successors are in a group
+    ngroups    int
+    hashMethod HashMethod
+    closeOnce  sync.Once
+    emptyScheduler
+}
+
+// the strings are "weight=W" (1 by default) and "zone=name"
+func NewKetamaScheduler(config map[string][]string, n int) *KetamaScheduler {
+    c := new(KetamaScheduler)
+    addrs := make([]string, 0, len(config))
+    for addr := range config {
+        addrs = append(addrs, addr)
+    }
+    sort.Strings(addrs)
+    c.hosts = make([]*Host, len(addrs))
+    c.weights = make([]int, len(addrs))
+    total := 0
+    for i, addr := range addrs {
+        host := NewHost(addr)
+        host.offset = i
+        c.hosts[i] = host
+        c.weights[i] = 1
+        for _, token := range config[addr] {
+            switch {
+            case strings.HasPrefix(token, "zone="):
+                host.Zone = token[len("zone="):]
+            case strings.HasPrefix(token, "weight="):
+                w, e := strconv.Atoi(token[len("weight="):])
+                if e != nil || w < 1 {
+                    ErrorLog.Printf("invalid %s of %s, skipped", token, addr)
+                    continue
+                }
+                c.weights[i] = w
+            default:
+                ErrorLog.Printf("invalid %s of %s, skipped", token, addr)
+            }
+        }
+        total += c.weights[i]
+    }
+    c.N = min(n, len(c.hosts))
+    c.hashMethod = md5hash
+
+    // the same as ketama_create_continuum, pct is a float there
+    for i, host := range c.hosts {
+        pct := float32(c.weights[i]) / float32(total)
+        ks := int(math.Floor(float64(pct) * 40 * float64(len(c.hosts))))
+        for k := 0; k < ks; k++ {
+            d := md5.Sum([]byte(fmt.Sprintf("%s-%d", host.Addr, k)))
+            for h := 0; h < 4; h++ {
+                p := uint32(d[3+h*4])<<24 | uint32(d[2+h*4])<<16 | uint32(d[1+h*4])<<8 | uint32(d[h*4])
+                c.points = append(c.points, ketamaPoint{p, i})
+            }
+        }
+    }
+    sort.Sort(c.points)
+
+    c.successors = make([][]int, len(c.points))
+    c.groups = make([]int, len(c.points))
+    ids := make(map[string]int)
+    for i := range c.points {
+        var hs []int
+        for j := 0; j < len(c.points) && len(hs) < c.N; j++ {
+            h := c.points[(i+j)%len(c.points)].host
+            found := false
+            for _, o := range hs {
+                found = found || o == h
+            }
+            if !found {
+                hs = append(hs, h)
+            }
+        }
+        c.successors[i] = hs
+        sig := fmt.Sprint(hs)
+        id, ok := ids[sig]
+        if !ok {
+            id = len(ids)
+            ids[sig] = id
+        }
+        c.groups[i] = id
+    }
+    c.ngroups = len(ids)
+    return c
+}
+
+// SetHashMethod changes the hash of keys, md5 as libketama by default
+func (c *KetamaScheduler) SetHashMethod(h HashMethod) {
+    c.hashMethod = h
+}
+
+// the first point not less than the hash of key
+func (c *KetamaScheduler) pointOf(key string) int {
+    h := c.hashMethod([]byte(key))
+    i := sort.Search(len(c.points), func(k int) bool { return c.points[k].point >= h })
+    if i == len(c.points) {
+        i = 0
+    }
+    return i
+}
+
+func (c *KetamaScheduler) GetHostsByKey(key string) []*Host {
+    if len(c.points) == 0 {
+        return nil
+    }
+    hs := c.successors[c.pointOf(key)]
+    hosts := make([]*Host, len(hs))
+    for i, h := range hs {
+        hosts[i] = c.hosts[h]
+    }
+    return hosts
+}
+
+// keys with the same hosts are in a group
+func (c *KetamaScheduler) DivideKeysByBucket(keys []string) [][]string {
+    rs := make([][]string, c.ngroups)
+    if len(c.points) == 0 {
+        return rs
+    }
+    for _, key := range keys {
+        g := c.groups[c.pointOf(key)]
+        rs[g] = append(rs[g], key)
+    }
+    return rs
+}
+
+func (c *KetamaScheduler) Hosts() []*Host {
+    return c.hosts
+}
+
+// the share of the continuum of each host
+func (c *KetamaScheduler) Stats() map[string][]float64 {
+    r := make(map[string][]float64, len(c.hosts))
+    for _, h := range c.hosts {
+        r[h.Addr] = []float64{0}
+    }
+    for i, p := range c.points {
+        prev := c.points[(i+len(c.points)-1)%len(c.points)].point
+        r[c.hosts[p.host].Addr][0] += float64(p.point-prev) / (1 << 32)
+    }
+    return r
+}
+
+// Close closes the hosts after the requests on them are finished
+func (c *KetamaScheduler) Close() {
+    c.closeOnce.Do(func() {
+        time.AfterFunc(ReadTimeout+WriteTimeout, func() {
+            for _, host := range c.hosts {
+                host.Close()
+            }
+        })
+    })
+}
@@ -0,0 +1,103 @@
+package memcache
+
+import (
+    "fmt"
+    "math"
+    "testing"
+)
+
+func ketamaConfig(weights ...int) map[string][]string {
+    config := make(map[string][]string)
+    for i, w := range weights {
+        config[fmt.Sprintf("10.0.0.%d:11211", i+1)] = []string{fmt.Sprintf("weight=%d", w)}
+    }
+    return config
+}
+
+func TestKetamaContinuum(t *testing.T) {
+    c := NewKetamaScheduler(ketamaConfig(1, 1, 2), 2)
+    defer c.Close()
+    // 160 points for the average weight, scaled by the weights
+    if len(c.points) != 120+120+240 {
+        t.Errorf("%d points", len(c.points))
+    }
+    for i := 1; i < len(c.points); i++ {
+        if c.points[i].point < c.points[i-1].point {
+            t.Fatal("points are not sorted")
+        }
+    }
+    // a key goes to the first point not less than its md5
+    key := "hello"
+    h := md5hash([]byte(key))
+    first := c.points[0]
+    for _, p := range c.points {
+        if p.point >= h {
+            first = p
+            break
+        }
+    }
+    if hosts := c.GetHostsByKey(key); hosts[0] != c.hosts[first.host] {
+        t.Error("primary of key", hosts[0].Addr)
+    }
+
+    shares := c.Stats()
+    if s := shares["10.0.0.3:11211"][0]; math.Abs(s-0.5) > 0.1 {
+        t.Error("share of the heavy host", s)
+    }
+}
+
+func TestKetamaReplicas(t *testing.T) {
+    c := NewKetamaScheduler(ketamaConfig(1, 1, 1, 1), 3)
+    defer c.Close()
+    keys := make([]string, 1000)
+    for i := range keys {
+        keys[i] = fmt.Sprintf("key%d", i)
+        hosts := c.GetHostsByKey(keys[i])
+        if len(hosts) != 3 || hosts[0] == hosts[1] || hosts[1] == hosts[2] || hosts[0] == hosts[2] {
+            t.Fatal("hosts of", keys[i], hosts)
+        }
+    }
+
+    // the keys in a group have the same hosts
+    n := 0
+    for _, ks := range c.DivideKeysByBucket(keys) {
+        n += len(ks)
+        for _, k := range ks {
+            if fmt.Sprint(c.GetHostsByKey(k)) != fmt.Sprint(c.GetHostsByKey(ks[0])) {
+                t.Errorf("%s and %s are in a group", k, ks[0])
+            }
+        }
+    }
+    if n != len(keys) {
+        t.Error("divided keys", n)
+    }
+
+    // N is not more than the hosts
+    small := NewKetamaScheduler(ketamaConfig(1), 3)
+    defer small.Close()
+    if hosts := small.GetHostsByKey("key"); len(hosts) != 1 {
+        t.Error("hosts", hosts)
+    }
+}
+
+// adding a host only moves the keys to it
+func TestKetamaAddHost(t *testing.T) {
+    old := NewKetamaScheduler(ketamaConfig(1, 1, 1, 1), 1)
+    defer old.Close()
+    c := NewKetamaScheduler(ketamaConfig(1, 1, 1, 1, 1), 1)
+    defer c.Close()
+    moved := 0
+    for i := 0; i < 1000; i++ {
+        key := fmt.Sprintf("key%d", i)
+        a, b := old.GetHostsByKey(key)[0].Addr, c.GetHostsByKey(key)[0].Addr
+        if a != b {
+            moved++
+            if b != "10.0.0.5:11211" {
+                t.Errorf("%s moved from %s to %s", key, a, b)
+            }
+        }
+    }
+    if moved < 100 || moved > 300 {
+        t.Error("moved keys", moved)
+    }
+}
@@ -0,0 +1,507 @@
+/*
+ * layouts of ManualScheduler: buckets are spread over nodes by their weights,
+ * the replicas of a bucket span zones, and the plan to move buckets when
+ * nodes are added or removed moves as few of them as possible.
+ */
+
+package memcache
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+type Node struct {
+    Addr   string
+    Weight float64
+    Zone   string
+}
+
+// ParseNode parses "addr[,weight=W][,zone=Z]", the fields may also be
+// separated by spaces
+func ParseNode(s string) (node Node, err error) {
+    fields := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+    if len(fields) == 0 {
+        return node, fmt.Errorf("empty node")
+    }
+    node.Addr = fields[0]
+    node.Weight = 1
+    for _, f := range fields[1:] {
+        switch {
+        case strings.HasPrefix(f, "weight="):
+            node.Weight, err = strconv.ParseFloat(f[len("weight="):], 64)
+            if err != nil || node.Weight <= 0 {
+                return node, fmt.Errorf("invalid weight of %s: %s", node.Addr, f)
+            }
+        case strings.HasPrefix(f, "zone="):
+            node.Zone = f[len("zone="):]
+        default:
+            return node, fmt.Errorf("unknown field of %s: %s", node.Addr, f)
+        }
+    }
+    return node, nil
+}
+
+type Layout struct {
+    Buckets   int
+    Nodes     []Node     // sorted by address
+    Primaries [][]string // addresses of nodes serving each bucket
+    Backups   [][]string
+}
+
+func newLayout(nodes []Node, buckets int) *Layout {
+    l := &Layout{Buckets: buckets}
+    l.Primaries = make([][]string, buckets)
+    l.Backups = make([][]string, buckets)
+    for _, node := range nodes {
+        l.addNode(node)
+    }
+    return l
+}
+
+func (l *Layout) addNode(node Node) {
+    if _, ok := l.Node(node.Addr); ok {
+        return
+    }
+    l.Nodes = append(l.Nodes, node)
+    sort.Sort(nodesByAddr(l.Nodes))
+}
+
+func (l *Layout) Node(addr string) (Node, bool) {
+    for _, node := range l.Nodes {
+        if node.Addr == addr {
+            return node, true
+        }
+    }
+    return Node{}, false
+}
+
+func (l *Layout) clone() *Layout {
+    c := newLayout(l.Nodes, l.Buckets)
+    for b := 0; b < l.Buckets; b++ {
+        c.Primaries[b] = append([]string{}, l.Primaries[b]...)
+        c.Backups[b] = append([]string{}, l.Backups[b]...)
+    }
+    return c
+}
+
+// ParseLayout reads the servers of the config, like "host:7900 0 1 -2 zone=a"
+func ParseLayout(servers []string, buckets int) (*Layout, error) {
+    l := newLayout(nil, buckets)
+    for _, server := range servers {
+        fields := strings.Fields(server)
+        if len(fields) == 0 {
+            continue
+        }
+        node := Node{Addr: fields[0], Weight: 1}
+        for _, f := range fields[1:] {
+            if strings.HasPrefix(f, "zone=") {
+                node.Zone = f[len("zone="):]
+                continue
+            }
+            b, err := strconv.ParseInt(strings.TrimPrefix(f, "-"), 16, 32)
+            if err != nil || b < 0 || int(b) >= buckets {
+                return nil, fmt.Errorf("invalid bucket %s of %s", f, node.Addr)
+            }
+            if strings.HasPrefix(f, "-") {
+                l.Backups[b] = appendNew(l.Backups[b], node.Addr)
+            } else {
+                l.Primaries[b] = appendNew(l.Primaries[b], node.Addr)
+            }
+        }
+        l.addNode(node)
+    }
+    return l, nil
+}
+
+// Servers formats the layout as the servers of the config
+func (l *Layout) Servers() []string {
+    servers := make([]string, len(l.Nodes))
+    for i, node := range l.Nodes {
+        fields := []string{node.Addr}
+        for b := 0; b < l.Buckets; b++ {
+            if contains(l.Primaries[b], node.Addr) {
+                fields = append(fields, fmt.Sprintf("%X", b))
+            }
+        }
+        for b := 0; b < l.Buckets; b++ {
+            if contains(l.Backups[b], node.Addr) && !contains(l.Primaries[b], node.Addr) {
+                fields = append(fields, fmt.Sprintf("-%X", b))
+            }
+        }
+        if node.Zone != "" {
+            fields = append(fields, "zone="+node.Zone)
+        }
+        servers[i] = strings.Join(fields, " ")
+    }
+    return servers
+}
+
+// primaries of each node
+func (l *Layout) counts() map[string]int {
+    counts := make(map[string]int, len(l.Nodes))
+    for _, holders := range l.Primaries {
+        for _, addr := range holders {
+            counts[addr]++
+        }
+    }
+    return counts
+}
+
+// quotas of primaries, proportional to the weights by the Sainte-Lague
+// method, a node serves a bucket at most once
+func quotas(nodes []Node, total, buckets int) map[string]int {
+    q := make(map[string]int, len(nodes))
+    for ; total > 0; total-- {
+        best := -1
+        var bestPriority float64
+        for i, node := range nodes {
+            if q[node.Addr] >= buckets {
+                continue
+            }
+            priority := node.Weight / float64(2*q[node.Addr]+1)
+            if best < 0 || priority > bestPriority {
+                best, bestPriority = i, priority
+            }
+        }
+        if best < 0 {
+            break
+        }
+        q[nodes[best].Addr]++
+    }
+    return q
+}
+
+// pick the node to serve a bucket besides the holders: nodes under their
+// quotas first, then those bringing a new zone to the bucket
+func pick(nodes []Node, holders []string, zones map[string]string, q, counts map[string]int) string {
+    used := make(map[string]bool)
+    for _, addr := range holders {
+        used[zones[addr]] = true
+    }
+    best := -1
+    var bestKey [4]int
+    for i, node := range nodes {
+        if contains(holders, node.Addr) {
+            continue
+        }
+        rest := q[node.Addr] - counts[node.Addr]
+        newZone := node.Zone != "" && !used[node.Zone]
+        key := [4]int{btoi(rest > 0 && newZone), btoi(rest > 0), btoi(newZone), rest}
+        if best < 0 || greater(key, bestKey) {
+            best, bestKey = i, key
+        }
+    }
+    if best < 0 {
+        return ""
+    }
+    return nodes[best].Addr
+}
+
+// GenerateLayout places N replicas of each bucket on the nodes
+func GenerateLayout(nodes []Node, buckets, n int) (*Layout, error) {
+    if err := checkNodes(nodes, buckets, n); err != nil {
+        return nil, err
+    }
+    l := newLayout(nodes, buckets)
+    q := quotas(l.Nodes, buckets*n, buckets)
+    zones := zonesOf(l.Nodes)
+    counts := make(map[string]int)
+    for b := 0; b < buckets; b++ {
+        for k := 0; k < n; k++ {
+            addr := pick(l.Nodes, l.Primaries[b], zones, q, counts)
+            l.Primaries[b] = append(l.Primaries[b], addr)
+            counts[addr]++
+        }
+    }
+    return l, nil
+}
+
+func checkNodes(nodes []Node, buckets, n int) error {
+    if buckets <= 0 || buckets&(buckets-1) != 0 {
+        return fmt.Errorf("buckets should be a power of 2, got %d", buckets)
+    }
+    if n <= 0 || n > len(nodes) {
+        return fmt.Errorf("n should be between 1 and %d nodes, got %d", len(nodes), n)
+    }
+    seen := make(map[string]bool)
+    for _, node := range nodes {
+        if seen[node.Addr] {
+            return fmt.Errorf("node %s is listed more than once", node.Addr)
+        }
+        seen[node.Addr] = true
+    }
+    return nil
+}
+
+// a copy of the bucket, From is empty if no replica is left
+type Move struct {
+    Bucket int
+    From   string
+    To     string
+}
+
+func (m Move) String() string {
+    if m.From == "" {
+        return fmt.Sprintf("bucket %X: no replica left, %s starts empty", m.Bucket, m.To)
+    }
+    return fmt.Sprintf("bucket %X: %s -> %s", m.Bucket, m.From, m.To)
+}
+
+type Step struct {
+    Name   string
+    Layout *Layout
+}
+
+type Plan struct {
+    Moves []Move
+    Steps []Step
+}
+
+// PlanLayout moves the buckets of the old layout onto the nodes, which are
+// the nodes after some are added or removed. the steps are the configs to
+// deploy in order: the destinations are added as backups and the buckets
+// are copied to them, then they are promoted and the sources become
+// backups, at last the sources are dropped.
+//
+// backups get a write only when a primary fails it, so the writes made
+// during the copy are missed by the destinations. after the second step,
+// copy the buckets again or run anti-entropy before dropping the sources,
+// or migrate them by /admin/migrate, which mirrors the writes.
+func PlanLayout(old *Layout, nodes []Node, n int) (*Plan, error) {
+    if err := checkNodes(nodes, old.Buckets, n); err != nil {
+        return nil, err
+    }
+    final := newLayout(nodes, old.Buckets)
+    // nodes which are not removed keep their zones
+    for i, node := range final.Nodes {
+        if o, ok := old.Node(node.Addr); ok && node.Zone == "" {
+            final.Nodes[i].Zone = o.Zone
+        }
+    }
+    q := quotas(final.Nodes, old.Buckets*n, old.Buckets)
+    zones := zonesOf(final.Nodes)
+    var moves []Move
+
+    // keep the replicas on the remaining nodes, and fill the holes
+    for b := 0; b < old.Buckets; b++ {
+        var removed []string
+        for _, addr := range old.Primaries[b] {
+            if _, ok := final.Node(addr); ok && len(final.Primaries[b]) < n {
+                final.Primaries[b] = append(final.Primaries[b], addr)
+            } else {
+                removed = append(removed, addr)
+            }
+        }
+        counts := final.counts()
+        for len(final.Primaries[b]) < n {
+            from := ""
+            if len(removed) > 0 {
+                from, removed = removed[0], removed[1:]
+            } else if len(old.Primaries[b]) > 0 {
+                from = old.Primaries[b][0]
+            }
+            to := pick(final.Nodes, final.Primaries[b], zones, q, counts)
+            final.Primaries[b] = append(final.Primaries[b], to)
+            counts[to]++
+            moves = append(moves, Move{b, from, to})
+        }
+    }
+
+    // move buckets from the nodes above their quotas to those below
+    counts := final.counts()
+    for {
+        moved := false
+        for _, over := range final.Nodes {
+            if counts[over.Addr] <= q[over.Addr] {
+                continue
+            }
+            if b, to, ok := rebalanceOne(final, over.Addr, moves, zones, q, counts); ok {
+                final.Primaries[b] = replace(final.Primaries[b], over.Addr, to)
+                counts[over.Addr]--
+                counts[to]++
+                moves = addMove(moves, Move{b, over.Addr, to})
+                moved = true
+            }
+        }
+        if !moved {
+            break
+        }
+    }
+
+    sort.Stable(movesByBucket(moves))
+    return &Plan{Moves: moves, Steps: planSteps(old, final, moves)}, nil
+}
+
+// a bucket of the node to move to another one below its quota, buckets
+// the node is copying to are preferred, and zones of the bucket are kept
+func rebalanceOne(l *Layout, addr string, moves []Move, zones map[string]string,
+    q, counts map[string]int) (int, string, bool) {
+    var buckets []int
+    for _, m := range moves {
+        if m.To == addr {
+            buckets = append(buckets, m.Bucket)
+        }
+    }
+    for b := 0; b < l.Buckets; b++ {
+        buckets = append(buckets, b)
+    }
+    for _, b := range buckets {
+        if !contains(l.Primaries[b], addr) {
+            continue
+        }
+        others := replace(l.Primaries[b], addr, "")
+        to := pick(l.Nodes, l.Primaries[b], zones, q, counts)
+        if to == "" || counts[to] >= q[to] {
+            continue
+        }
+        if countZones(append(others, to), zones) < countZones(l.Primaries[b], zones) {
+            continue
+        }
+        return b, to, true
+    }
+    return 0, "", false
+}
+
+// a move to a node which is itself moved is merged
+func addMove(moves []Move, m Move) []Move {
+    for i, old := range moves {
+        if old.Bucket == m.Bucket && old.To == m.From {
+            moves[i].To = m.To
+            return moves
+        }
+    }
+    return append(moves, m)
+}
+
+func planSteps(old, final *Layout, moves []Move) []Step {
+    copying := old.clone()
+    for _, node := range final.Nodes {
+        copying.addNode(node)
+    }
+    for _, m := range moves {
+        copying.Backups[m.Bucket] = appendNew(copying.Backups[m.Bucket], m.To)
+    }
+
+    switching := copying.clone()
+    for b := 0; b < old.Buckets; b++ {
+        switching.Primaries[b] = append([]string{}, final.Primaries[b]...)
+        switching.Backups[b] = append([]string{}, old.Backups[b]...)
+    }
+    for _, m := range moves {
+        if m.From != "" {
+            switching.Backups[m.Bucket] = appendNew(switching.Backups[m.Bucket], m.From)
+        }
+    }
+
+    done := final.clone()
+    for b := 0; b < old.Buckets; b++ {
+        for _, addr := range old.Backups[b] {
+            if _, ok := done.Node(addr); ok && !contains(done.Primaries[b], addr) {
+                done.Backups[b] = appendNew(done.Backups[b], addr)
+            }
+        }
+    }
+
+    return []Step{
+        {"add the destinations as backups, then copy the buckets to them " +
+            "(backups get no writes unless a primary fails)", copying},
+        {"promote the destinations, the sources become backups, then copy the " +
+            "buckets again or run anti-entropy to catch up the writes made during the copy", switching},
+        {"drop the sources", done},
+    }
+}
+
+func zonesOf(nodes []Node) map[string]string {
+    zones := make(map[string]string, len(nodes))
+    for _, node := range nodes {
+        zones[node.Addr] = node.Zone
+    }
+    return zones
+}
+
+func countZones(addrs []string, zones map[string]string) int {
+    seen := make(map[string]bool)
+    for _, addr := range addrs {
+        if addr != "" {
+            seen[zones[addr]] = true
+        }
+    }
+    return len(seen)
+}
+
+func contains(l []string, s string) bool {
+    for _, v := range l {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+func appendNew(l []string, s string) []string {
+    if contains(l, s) {
+        return l
+    }
+    return append(l, s)
+}
+
+// replace the item, or remove it if to is empty
+func replace(l []string, from, to string) []string {
+    r := make([]string, 0, len(l))
+    for _, v := range l {
+        if v == from {
+            v = to
+        }
+        if v != "" {
+            r = append(r, v)
+        }
+    }
+    return r
+}
+
+func btoi(b bool) int {
+    if b {
+        return 1
+    }
+    return 0
+}
+
+func greater(a, b [4]int) bool {
+    for i := range a {
+        if a[i] != b[i] {
+            return a[i] > b[i]
+        }
+    }
+    return false
+}
+
+type nodesByAddr []Node
+
+func (l nodesByAddr) Len() int {
+    return len(l)
+}
+
+func (l nodesByAddr) Less(i, j int) bool {
+    return l[i].Addr < l[j].Addr
+}
+
+func (l nodesByAddr) Swap(i, j int) {
+    l[i], l[j] = l[j], l[i]
+}
+
+type movesByBucket []Move
+
+func (l movesByBucket) Len() int {
+    return len(l)
+}
+
+func (l movesByBucket) Less(i, j int) bool {
+    return l[i].Bucket < l[j].Bucket
+}
+
+func (l movesByBucket) Swap(i, j int) {
+    l[i], l[j] = l[j], l[i]
+}
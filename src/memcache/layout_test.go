@@ -0,0 +1,207 @@
+package memcache
+
+import (
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+)
+
+func testNodes(t *testing.T, specs ...string) []Node {
+    nodes := make([]Node, len(specs))
+    for i, s := range specs {
+        node, err := ParseNode(s)
+        if err != nil {
+            t.Fatal(err)
+        }
+        nodes[i] = node
+    }
+    return nodes
+}
+
+// every bucket has n distinct primaries, spanning zones if there are more
+func checkLayout(t *testing.T, l *Layout, n int) {
+    zones := zonesOf(l.Nodes)
+    all := countZones(func() (addrs []string) {
+        for _, node := range l.Nodes {
+            addrs = append(addrs, node.Addr)
+        }
+        return
+    }(), zones)
+    for b, holders := range l.Primaries {
+        if len(holders) != n {
+            t.Errorf("bucket %X: %d primaries, expected %d", b, len(holders), n)
+        }
+        if len(replace(holders, "", "")) != len(holders) || countZones(holders, zones) < min(all, n) {
+            t.Errorf("bucket %X: primaries %v", b, holders)
+        }
+        seen := make(map[string]bool)
+        for _, addr := range holders {
+            if seen[addr] {
+                t.Errorf("bucket %X: %s twice", b, addr)
+            }
+            seen[addr] = true
+        }
+    }
+}
+
+func TestParseNode(t *testing.T) {
+    node, err := ParseNode("host:7900,weight=2 zone=a")
+    if err != nil || node != (Node{"host:7900", 2, "a"}) {
+        t.Error("parse node", node, err)
+    }
+    for _, s := range []string{"", "host:7900,weight=0", "host:7900,weight=x", "host:7900,rack=a"} {
+        if _, err := ParseNode(s); err == nil {
+            t.Errorf("invalid node accepted: %q", s)
+        }
+    }
+}
+
+func TestGenerateLayout(t *testing.T) {
+    nodes := testNodes(t, "h1:7900,zone=a", "h2:7900,zone=a", "h3:7900,zone=b", "h4:7900,zone=b,weight=2")
+    l, err := GenerateLayout(nodes, 16, 3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkLayout(t, l, 3)
+    counts := l.counts()
+    expected := map[string]int{"h1:7900": 11, "h2:7900": 11, "h3:7900": 10, "h4:7900": 16}
+    if !reflect.DeepEqual(counts, expected) {
+        t.Error("counts", counts)
+    }
+
+    // the servers are read back
+    servers := l.Servers()
+    if servers[3] != "h4:7900 0 1 2 3 4 5 6 7 8 9 A B C D E F zone=b" {
+        t.Error("servers", servers)
+    }
+    parsed, err := ParseLayout(servers, 16)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(parsed.Servers(), servers) {
+        t.Error("parsed", parsed.Servers())
+    }
+
+    if _, err := GenerateLayout(nodes, 12, 3); err == nil {
+        t.Error("buckets is not a power of 2")
+    }
+    if _, err := GenerateLayout(nodes, 16, 5); err == nil {
+        t.Error("n is more than nodes")
+    }
+}
+
+func TestPlanLayout(t *testing.T) {
+    nodes := testNodes(t, "h1:7900", "h2:7900", "h3:7900")
+    old, _ := GenerateLayout(nodes, 8, 2)
+    old.Backups[0] = []string{"h3:7900"}
+
+    // add a node, only the buckets above the quotas are moved
+    p, err := PlanLayout(old, append(nodes, testNodes(t, "h4:7900")...), 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(p.Moves) != 4 {
+        t.Error("moves", p.Moves)
+    }
+    final := p.Steps[2].Layout
+    checkLayout(t, final, 2)
+    for addr, c := range final.counts() {
+        if c != 4 {
+            t.Errorf("%s has %d buckets", addr, c)
+        }
+    }
+    for _, m := range p.Moves {
+        copying, switching := p.Steps[0].Layout, p.Steps[1].Layout
+        if !contains(copying.Primaries[m.Bucket], m.From) || !contains(copying.Backups[m.Bucket], m.To) {
+            t.Errorf("copying %v: %v", m, copying.Servers())
+        }
+        if !contains(switching.Primaries[m.Bucket], m.To) || !contains(switching.Backups[m.Bucket], m.From) {
+            t.Errorf("switching %v: %v", m, switching.Servers())
+        }
+        if contains(final.Backups[m.Bucket], m.From) {
+            t.Errorf("final %v: %v", m, final.Servers())
+        }
+    }
+    if !contains(final.Backups[0], "h3:7900") {
+        t.Error("backups are kept", final.Backups[0])
+    }
+
+    // remove a node, only its buckets are moved
+    p, err = PlanLayout(old, nodes[:2], 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    removed := old.counts()["h3:7900"]
+    if len(p.Moves) != removed {
+        t.Errorf("%d moves for %d buckets: %v", len(p.Moves), removed, p.Moves)
+    }
+    for _, m := range p.Moves {
+        if m.From != "h3:7900" {
+            t.Error("move", m)
+        }
+    }
+    final = p.Steps[2].Layout
+    checkLayout(t, final, 2)
+    if _, ok := final.Node("h3:7900"); ok || len(final.Backups[0]) != 0 {
+        t.Error("removed node is left", final.Servers())
+    }
+}
+
+// the destinations of the copying step are backups, which get no writes
+// while the primaries are up
+func TestPlanCopyingWrites(t *testing.T) {
+    if ErrorLog == nil {
+        ErrorLog = log.New(ioutil.Discard, "", 0)
+    }
+    nodes := testNodes(t, "h1:7900", "h2:7900", "h3:7900")
+    old, _ := GenerateLayout(nodes, 16, 2)
+    p, err := PlanLayout(old, append(nodes, testNodes(t, "h4:7900")...), 2)
+    if err != nil || len(p.Moves) == 0 {
+        t.Fatal("plan", p, err)
+    }
+    config := make(map[string][]string)
+    for _, server := range p.Steps[0].Layout.Servers() {
+        fields := strings.Fields(server)
+        config[fields[0]] = fields[1:]
+    }
+    schd := NewManualScheduler(config, 16, 2)
+    defer schd.Close()
+    c := NewClient(schd, 2, 2, 1)
+
+    m := p.Moves[0]
+    key := ""
+    for i := 0; key == ""; i++ {
+        if k := fmt.Sprintf("key%d", i); getBucketByKey(schd.hashMethod, schd.bucketWidth, k) == m.Bucket {
+            key = k
+        }
+    }
+    write := func(up func(*Host) bool) map[string]bool {
+        var lock sync.Mutex
+        written := make(map[string]bool)
+        done := make(chan bool)
+        c.write(c.topology(), key, "set", func() { close(done) }, func(host *Host) (bool, error) {
+            lock.Lock()
+            defer lock.Unlock()
+            written[host.Addr] = true
+            if !up(host) {
+                return false, errors.New("down")
+            }
+            return true, nil
+        })
+        <-done
+        return written
+    }
+
+    if written := write(func(*Host) bool { return true }); written[m.To] || !written[m.From] {
+        t.Errorf("writes of bucket %X go to %v, not the destination %s", m.Bucket, written, m.To)
+    }
+    // only a failed primary falls back to the destination
+    if written := write(func(h *Host) bool { return h.Addr != m.From }); !written[m.To] {
+        t.Errorf("writes of bucket %X with %s down go to %v", m.Bucket, m.From, written)
+    }
+}
@@ -10,9 +10,10 @@ import (
 var AccessLogPath string
 var ErrorLogPath string
 var AccessLog *log.Logger = nil
-var ErrorLog *log.Logger = nil
+// errors go to stderr until the error log is opened
+var ErrorLog *log.Logger = openLogWithFd(os.Stderr)
 var AccessFd *os.File = nil
-var ErrorFd *os.File = nil
+var ErrorFd *os.File = os.Stderr
 var lock *sync.Mutex = new(sync.Mutex)
 
 func openLogWithFd(fd *os.File) *log.Logger {
@@ -68,6 +69,9 @@ func OpenErrorLog(error_log_path string) (success bool, err error) {
             success = true
             error_log = (*log.Logger)(atomic.SwapPointer((*unsafe.Pointer)(unsafe.Pointer(&ErrorLog)), unsafe.Pointer(error_log)))
             error_file = (*os.File)(atomic.SwapPointer((*unsafe.Pointer)(unsafe.Pointer(&ErrorFd)), unsafe.Pointer(error_file)))
+            if error_file == os.Stderr {
+                return
+            }
             if e = error_file.Close(); e != nil {
                 log.Println("close the old errorlog fd failure with, ", e)
             }
@@ -0,0 +1,252 @@
+/*
+ * memcached meta commands: mg, ms, md, ma and mn
+ *
+ * besides the standard flags, mg returns two beansdb specific ones:
+ *   V: return the version of the value in the primary replica as V<version>
+ *   H: return the replica which served the value as H<host:port>
+ */
+
+package memcache
+
+import (
+    "bufio"
+    "errors"
+    "strconv"
+    "strings"
+)
+
+// value of flag f, like "123" for "O123"
+func metaFlag(flags []string, f byte) (string, bool) {
+    for _, flag := range flags {
+        if len(flag) > 0 && flag[0] == f {
+            return flag[1:], true
+        }
+    }
+    return "", false
+}
+
+func (req *Request) readMeta(parts []string, b *bufio.Reader) (e error) {
+    if req.Cmd == "mn" {
+        return nil
+    }
+    if len(parts) < 2 {
+        return errors.New("invalid cmd")
+    }
+    req.Keys = parts[1:2]
+    req.Flags = parts[2:]
+    if req.Cmd != "ms" {
+        return nil
+    }
+
+    if len(parts) < 3 {
+        return errors.New("invalid cmd")
+    }
+    req.Flags = parts[3:]
+    length, e := strconv.Atoi(parts[2])
+    if e != nil {
+        return e
+    }
+    if length > MaxBodyLength {
+        return errors.New("body too large")
+    }
+    req.Item = &Item{}
+    if v, ok := metaFlag(req.Flags, 'F'); ok {
+        if req.Item.Flag, e = strconv.Atoi(v); e != nil {
+            return e
+        }
+    }
+    if v, ok := metaFlag(req.Flags, 'T'); ok {
+        if req.Item.Exptime, e = strconv.Atoi(v); e != nil {
+            return e
+        }
+    }
+    if v, ok := metaFlag(req.Flags, 'C'); ok {
+        if req.Item.Cas, e = strconv.Atoi(v); e != nil {
+            return e
+        }
+    }
+    return req.Item.readBody(b, length)
+}
+
+// flags returned as they are in the request
+func (req *Request) metaReturnFlags(ss []string) []string {
+    if v, ok := metaFlag(req.Flags, 'O'); ok {
+        ss = append(ss, "O"+v)
+    }
+    if _, ok := metaFlag(req.Flags, 'k'); ok {
+        ss = append(ss, "k"+req.Keys[0])
+    }
+    return ss
+}
+
+func (req *Request) processMeta(store DistributeStorage, stat *Stats) (resp *Response, targets []string, err error) {
+    resp = new(Response)
+    _, resp.quiet = metaFlag(req.Flags, 'q')
+    if req.Cmd == "mn" {
+        resp.status = "MN"
+        return
+    }
+
+    key := req.Keys[0]
+    if len(key) > MaxKeyLength {
+        resp.status = "CLIENT_ERROR"
+        resp.msg = "key too long"
+        return
+    }
+
+    var ret []string
+    switch req.Cmd {
+    case "mg":
+        _, withCas := metaFlag(req.Flags, 'c')
+        _, withVer := metaFlag(req.Flags, 'V')
+        var item *Item
+        stat.cmd_get++
+        if withCas || withVer {
+            item, targets, err = store.Gets(key)
+        } else {
+            item, targets, err = store.Get(key)
+        }
+        if err != nil {
+            resp.status = "SERVER_ERROR"
+            resp.msg = err.Error()
+            return
+        }
+        if item == nil {
+            stat.get_misses++
+            resp.status = "EN"
+            return
+        }
+        stat.get_hits++
+        stat.bytes_written += int64(len(item.Body))
+
+        resp.status = "HD"
+        if _, ok := metaFlag(req.Flags, 'v'); ok {
+            resp.status = "VA"
+            resp.items = map[string]*Item{key: item}
+        }
+        for _, flag := range req.Flags {
+            switch flag {
+            case "c":
+                ret = append(ret, "c"+strconv.Itoa(item.Cas))
+            case "f":
+                ret = append(ret, "f"+strconv.Itoa(item.Flag))
+            case "s":
+                ret = append(ret, "s"+strconv.Itoa(len(item.Body)))
+            case "t":
+                ret = append(ret, "t-1") // unknown in beansdb
+            case "V":
+                ret = append(ret, "V"+strconv.Itoa(item.Cas>>16))
+            case "H":
+                if len(targets) > 0 {
+                    ret = append(ret, "H"+targets[0])
+                }
+            }
+        }
+
+    case "ms":
+        stat.cmd_set++
+        stat.bytes_read += int64(len(req.Item.Body))
+        mode, _ := metaFlag(req.Flags, 'M')
+        var suc bool
+        if _, ok := metaFlag(req.Flags, 'C'); ok {
+            resp.status, targets, err = store.Cas(key, req.Item, false)
+        } else {
+            switch strings.ToUpper(mode) {
+            case "", "S":
+                suc, targets, err = store.Set(key, req.Item, false)
+            case "E", "R":
+                // the stores have no add or replace
+                resp.status = "CLIENT_ERROR"
+                resp.msg = "unsupported mode for ms"
+                return
+            case "A":
+                suc, targets, err = store.Append(key, req.Item.Body)
+            default:
+                resp.status = "CLIENT_ERROR"
+                resp.msg = "invalid mode for ms"
+                return
+            }
+            resp.status = "NS"
+            if suc {
+                resp.status = "STORED"
+            }
+        }
+        if err != nil {
+            resp.status = "SERVER_ERROR"
+            resp.msg = err.Error()
+            return
+        }
+        switch resp.status {
+        case "STORED":
+            resp.status = "HD"
+        case "NOT_STORED":
+            resp.status = "NS"
+        case "EXISTS":
+            resp.status = "EX"
+        case "NOT_FOUND":
+            resp.status = "NF"
+        }
+
+    case "md":
+        stat.cmd_delete++
+        var suc bool
+        suc, targets, err = store.Delete(key)
+        if err != nil {
+            resp.status = "SERVER_ERROR"
+            resp.msg = err.Error()
+            return
+        }
+        resp.status = "NF"
+        if suc {
+            resp.status = "HD"
+        }
+
+    case "ma":
+        stat.cmd_set++
+        delta := 1
+        if v, ok := metaFlag(req.Flags, 'D'); ok {
+            if delta, err = strconv.Atoi(v); err != nil {
+                resp.status = "CLIENT_ERROR"
+                resp.msg = "invalid delta"
+                err = nil
+                return
+            }
+        }
+        if mode, _ := metaFlag(req.Flags, 'M'); mode == "D" || mode == "d" || mode == "-" {
+            delta = -delta
+        }
+        var result int
+        result, targets, err = store.Incr(key, delta)
+        if err != nil {
+            resp.status = "SERVER_ERROR"
+            resp.msg = err.Error()
+            return
+        }
+        if !incrFound(store, key, result) {
+            // auto create with the initial value
+            if _, ok := metaFlag(req.Flags, 'N'); !ok {
+                resp.status = "NF"
+                return
+            }
+            init, _ := metaFlag(req.Flags, 'J')
+            if init == "" {
+                init = "0"
+            }
+            var suc bool
+            suc, targets, err = store.Set(key, &Item{Body: []byte(init)}, false)
+            if err != nil || !suc {
+                resp.status = "NS"
+                return
+            }
+            result, _ = strconv.Atoi(init)
+        }
+        resp.status = "HD"
+        if _, ok := metaFlag(req.Flags, 'v'); ok {
+            resp.status = "VA"
+            resp.items = map[string]*Item{key: &Item{Body: []byte(strconv.Itoa(result))}}
+        }
+    }
+
+    resp.msg = strings.Join(req.metaReturnFlags(ret), " ")
+    return
+}
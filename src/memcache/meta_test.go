@@ -0,0 +1,59 @@
+package memcache
+
+import (
+    "bufio"
+    "bytes"
+    "testing"
+)
+
+type metaTest struct {
+    cmd    string
+    anwser string
+}
+
+var metaTests = []metaTest{
+    metaTest{"mn\r\n", "MN\r\n"},
+    metaTest{"mg abc v\r\n", "EN\r\n"},
+    metaTest{"mg abc v q\r\n", ""},
+    metaTest{"ms abc 2 F3 O12\r\nok\r\n", "HD O12\r\n"},
+    metaTest{"mg abc v f s k\r\n", "VA 2 f3 s2 kabc\r\nok\r\n"},
+    metaTest{"mg abc f t O9\r\n", "HD f3 t-1 O9\r\n"},
+    metaTest{"mg abc H\r\n", "HD Hmap\r\n"},
+    metaTest{"ms ap 2\r\nok\r\n", "HD\r\n"},
+    metaTest{"ms ap 2 MA\r\n!!\r\n", "HD\r\n"},
+    metaTest{"mg ap v\r\n", "VA 4\r\nok!!\r\n"},
+    metaTest{"ms abc 1 MP\r\n!\r\n", "CLIENT_ERROR invalid mode for ms\r\n"},
+    metaTest{"ms abc 1 ME\r\n!\r\n", "CLIENT_ERROR unsupported mode for ms\r\n"},
+    metaTest{"ms abc 1 MR\r\n!\r\n", "CLIENT_ERROR unsupported mode for ms\r\n"},
+    metaTest{"ms n 1\r\n5\r\n", "HD\r\n"},
+    metaTest{"ma n D3 v\r\n", "VA 1\r\n8\r\n"},
+    metaTest{"ma nn\r\n", "NF\r\n"},
+    metaTest{"ma nn N0 J10 v\r\n", "VA 2\r\n10\r\n"},
+    metaTest{"ma nn MD D10 N0 J5 v\r\n", "VA 1\r\n0\r\n"},
+    metaTest{"md abc q\r\n", ""},
+    metaTest{"md abc\r\n", "NF\r\n"},
+    metaTest{"mg abc\r\n", "EN\r\n"},
+}
+
+func TestMetaCommands(t *testing.T) {
+    store := mapDistStore{NewMapStore()}
+    stats := NewStats()
+
+    for i, test := range metaTests {
+        req := new(Request)
+        e := req.Read(bufio.NewReader(bytes.NewBufferString(test.cmd)))
+        var resp *Response
+        if e != nil {
+            resp = &Response{status: "CLIENT_ERROR", msg: e.Error()}
+        } else {
+            resp, _, _ = req.Process(store, stats)
+        }
+        wr := new(bytes.Buffer)
+        if resp != nil {
+            resp.Write(wr)
+        }
+        if ans := wr.String(); test.anwser != ans {
+            t.Errorf("test %d: expect %q but got %q", i, test.anwser, ans)
+        }
+    }
+}
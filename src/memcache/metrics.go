@@ -0,0 +1,58 @@
+/*
+ * latency and errors of requests to a backend host
+ */
+
+package memcache
+
+import (
+    "sync"
+    "time"
+)
+
+// upper bounds of the latency histogram buckets
+var LatencyBuckets = []time.Duration{
+    time.Millisecond, time.Millisecond * 2, time.Millisecond * 5,
+    time.Millisecond * 10, time.Millisecond * 20, time.Millisecond * 50,
+    time.Millisecond * 100, time.Millisecond * 200, time.Millisecond * 500,
+    time.Second, time.Second * 2,
+}
+
+type HostMetrics struct {
+    Latency  []uint64 // count in each of LatencyBuckets, the last one for larger
+    Sum      time.Duration
+    Requests uint64
+    Errors   uint64
+}
+
+type hostMetrics struct {
+    sync.Mutex
+    HostMetrics
+}
+
+func (m *hostMetrics) observe(d time.Duration, err error) {
+    m.Lock()
+    defer m.Unlock()
+    if m.Latency == nil {
+        m.Latency = make([]uint64, len(LatencyBuckets)+1)
+    }
+    i := 0
+    for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+        i++
+    }
+    m.Latency[i]++
+    m.Sum += d
+    m.Requests++
+    if err != nil {
+        m.Errors++
+    }
+}
+
+// Metrics returns a copy of the metrics of requests to host
+func (host *Host) Metrics() HostMetrics {
+    host.metrics.Lock()
+    defer host.metrics.Unlock()
+    m := host.metrics.HostMetrics
+    m.Latency = make([]uint64, len(LatencyBuckets)+1)
+    copy(m.Latency, host.metrics.Latency)
+    return m
+}
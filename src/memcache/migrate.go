@@ -0,0 +1,487 @@
+/*
+ * online migration of a bucket: the destination is added as a backup of the
+ * bucket which gets the writes, the keys are copied from the source by the
+ * `@` listings and `?key`, then the replicas are compared by the hash trees
+ * until they are the same. at last the destination is promoted and the
+ * source becomes a backup. the state is saved after each directory, so an
+ * interrupted migration goes on from there.
+ */
+
+package memcache
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+var MigrationThrottle = time.Millisecond * 10 // sleep between copies
+var MigrationVerifyPasses = 3                 // compare the replicas at most
+
+const (
+    MigrationPending   = "pending"
+    MigrationCopying   = "copying"
+    MigrationVerifying = "verifying"
+    MigrationDone      = "done"
+    MigrationFailed    = "failed"
+    MigrationCanceled  = "canceled"
+)
+
+var errMigrationCanceled = errors.New("canceled")
+
+type Migration struct {
+    ID      int
+    Bucket  int
+    From    string
+    To      string
+    State   string
+    Cursor  string // the last directory copied
+    Total   int    // keys of the bucket in the source when started
+    Checked int    // keys compared
+    Copied  int    // keys copied or deleted
+    Passes  int    // passes of verification
+    Error   string
+    Created time.Time
+    Updated time.Time
+}
+
+func (mg *Migration) Active() bool {
+    return mg.State == MigrationPending || mg.State == MigrationCopying || mg.State == MigrationVerifying
+}
+
+// Progress in percent
+func (mg *Migration) Progress() float64 {
+    if mg.State == MigrationDone {
+        return 100
+    }
+    if mg.Total == 0 {
+        return 0
+    }
+    return 100 * float64(min(mg.Checked, mg.Total)) / float64(mg.Total)
+}
+
+type Migrator struct {
+    sync.Mutex
+    base       *Layout
+    migrations []*Migration
+    path       string
+    apply      func() // install the scheduler of the changed layout
+    wake       chan bool
+}
+
+// NewMigrator loads the migrations saved in the file, the layout of the
+// config is changed by them
+func NewMigrator(base *Layout, path string, apply func()) (*Migrator, error) {
+    m := &Migrator{base: base, path: path, apply: apply, wake: make(chan bool, 1)}
+    if path == "" {
+        return m, nil
+    }
+    content, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return m, nil
+    } else if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(content, &m.migrations); err != nil {
+        return nil, fmt.Errorf("load migrations from %s failed: %s", path, err)
+    }
+    return m, nil
+}
+
+// SetBase is called when the config is reloaded
+func (m *Migrator) SetBase(base *Layout) {
+    m.Lock()
+    defer m.Unlock()
+    m.base = base
+}
+
+// Layout returns the layout of the config with the migrations, and the
+// backups of buckets which get the writes
+func (m *Migrator) Layout() (*Layout, map[int][]string) {
+    m.Lock()
+    defer m.Unlock()
+    return m.layout()
+}
+
+func (m *Migrator) layout() (*Layout, map[int][]string) {
+    l := m.base.clone()
+    mirrors := make(map[int][]string)
+    for _, mg := range m.migrations {
+        b := mg.Bucket
+        if b >= l.Buckets {
+            continue
+        }
+        switch mg.State {
+        case MigrationCopying, MigrationVerifying:
+            l.addNode(Node{Addr: mg.To, Weight: 1})
+            l.Backups[b] = appendNew(l.Backups[b], mg.To)
+            mirrors[b] = appendNew(mirrors[b], mg.To)
+        case MigrationDone:
+            l.addNode(Node{Addr: mg.To, Weight: 1})
+            l.Primaries[b] = appendNew(replace(l.Primaries[b], mg.From, ""), mg.To)
+            l.Backups[b] = appendNew(replace(l.Backups[b], mg.To, ""), mg.From)
+        }
+    }
+    return l, mirrors
+}
+
+func (m *Migrator) Migrations() []*Migration {
+    m.Lock()
+    defer m.Unlock()
+    r := make([]*Migration, len(m.migrations))
+    for i, mg := range m.migrations {
+        c := *mg
+        r[i] = &c
+    }
+    return r
+}
+
+// Start queues the migration of the bucket
+func (m *Migrator) Start(bucket int, from, to string) (*Migration, error) {
+    m.Lock()
+    defer m.Unlock()
+    l, _ := m.layout()
+    if bucket < 0 || bucket >= l.Buckets {
+        return nil, fmt.Errorf("invalid bucket %X", bucket)
+    }
+    if !contains(l.Primaries[bucket], from) {
+        return nil, fmt.Errorf("%s is not a primary of bucket %X", from, bucket)
+    }
+    if contains(l.Primaries[bucket], to) {
+        return nil, fmt.Errorf("%s is already a primary of bucket %X", to, bucket)
+    }
+    if _, _, err := net.SplitHostPort(to); err != nil {
+        return nil, err
+    }
+    if _, err := bucketPrefix(bucket, l.Buckets); err != nil {
+        return nil, err
+    }
+    id := 1
+    for _, mg := range m.migrations {
+        if mg.Bucket == bucket && mg.Active() {
+            return nil, fmt.Errorf("bucket %X is migrating by #%d", bucket, mg.ID)
+        }
+        if mg.ID >= id {
+            id = mg.ID + 1
+        }
+    }
+    now := time.Now()
+    mg := &Migration{ID: id, Bucket: bucket, From: from, To: to, State: MigrationPending,
+        Created: now, Updated: now}
+    m.migrations = append(m.migrations, mg)
+    m.save()
+    m.notify()
+    c := *mg
+    return &c, nil
+}
+
+func (m *Migrator) find(id int) *Migration {
+    for _, mg := range m.migrations {
+        if mg.ID == id {
+            return mg
+        }
+    }
+    return nil
+}
+
+// Cancel stops the migration, the destination is not a backup any more
+func (m *Migrator) Cancel(id int) error {
+    m.Lock()
+    mg := m.find(id)
+    if mg == nil || !mg.Active() {
+        m.Unlock()
+        return fmt.Errorf("no active migration #%d", id)
+    }
+    mg.State = MigrationCanceled
+    mg.Updated = time.Now()
+    m.save()
+    m.Unlock()
+    m.apply()
+    return nil
+}
+
+// Retry goes on with a failed or canceled migration from its cursor
+func (m *Migrator) Retry(id int) error {
+    m.Lock()
+    defer m.Unlock()
+    mg := m.find(id)
+    if mg == nil || (mg.State != MigrationFailed && mg.State != MigrationCanceled) {
+        return fmt.Errorf("no failed or canceled migration #%d", id)
+    }
+    for _, o := range m.migrations {
+        if o.Bucket == mg.Bucket && o.Active() {
+            return fmt.Errorf("bucket %X is migrating by #%d", mg.Bucket, o.ID)
+        }
+    }
+    mg.State = MigrationPending
+    mg.Error = ""
+    mg.Updated = time.Now()
+    m.save()
+    m.notify()
+    return nil
+}
+
+// Clear drops the finished migrations, call it after the config has the
+// layout of them
+func (m *Migrator) Clear() {
+    m.Lock()
+    var active []*Migration
+    for _, mg := range m.migrations {
+        if mg.Active() {
+            active = append(active, mg)
+        }
+    }
+    m.migrations = active
+    m.save()
+    m.Unlock()
+    m.apply()
+}
+
+func (m *Migrator) notify() {
+    select {
+    case m.wake <- true:
+    default:
+    }
+}
+
+// save the migrations, with the lock held
+func (m *Migrator) save() {
+    if m.path == "" {
+        return
+    }
+    content, err := json.MarshalIndent(m.migrations, "", "  ")
+    if err == nil {
+        tmp := m.path + ".tmp"
+        if err = ioutil.WriteFile(tmp, content, 0644); err == nil {
+            err = os.Rename(tmp, m.path)
+        }
+    }
+    if err != nil {
+        ErrorLog.Print("save migrations failed: ", err)
+    }
+}
+
+func (m *Migrator) update(mg *Migration, f func()) {
+    m.Lock()
+    defer m.Unlock()
+    f()
+    mg.Updated = time.Now()
+    m.save()
+}
+
+func (m *Migrator) state(mg *Migration) string {
+    m.Lock()
+    defer m.Unlock()
+    return mg.State
+}
+
+func (m *Migrator) canceled(mg *Migration) bool {
+    return m.state(mg) == MigrationCanceled
+}
+
+// Run migrates the buckets one by one, the interrupted ones go on first
+func (m *Migrator) Run() {
+    for {
+        m.Lock()
+        var next *Migration
+        for _, mg := range m.migrations {
+            if mg.State == MigrationCopying || mg.State == MigrationVerifying {
+                next = mg
+                break
+            }
+            if mg.State == MigrationPending && next == nil {
+                next = mg
+            }
+        }
+        m.Unlock()
+        if next == nil {
+            <-m.wake
+            continue
+        }
+        m.migrate(next)
+    }
+}
+
+func (m *Migrator) migrate(mg *Migration) {
+    m.Lock()
+    buckets := m.base.Buckets
+    m.Unlock()
+    prefix, _ := bucketPrefix(mg.Bucket, buckets)
+    src, dst := NewHost(mg.From), NewHost(mg.To)
+    defer src.Close()
+    defer dst.Close()
+
+    err := m.copy(mg, src, dst, prefix)
+    if err == nil {
+        err = m.verify(mg, src, dst, prefix)
+    }
+    if err == errMigrationCanceled {
+        return
+    }
+    m.update(mg, func() {
+        if mg.State == MigrationCanceled {
+            return
+        }
+        if err != nil {
+            mg.State = MigrationFailed
+            mg.Error = err.Error()
+        } else {
+            mg.State = MigrationDone
+        }
+    })
+    if err != nil {
+        ErrorLog.Printf("migrate bucket %X from %s to %s failed: %s", mg.Bucket, mg.From, mg.To, err)
+    }
+    m.apply()
+}
+
+// copy the keys of the source which are different in the destination,
+// the directories not after the cursor were copied
+func (m *Migrator) copy(mg *Migration, src, dst *Host, prefix string) error {
+    if m.state(mg) == MigrationPending {
+        es, err := src.list(prefix)
+        if err != nil {
+            return err
+        }
+        total := 0
+        for _, e := range es {
+            if e.isDir {
+                total += e.count
+            } else {
+                total++
+            }
+        }
+        m.update(mg, func() {
+            if mg.State == MigrationPending {
+                mg.State = MigrationCopying
+                mg.Total = total
+            }
+        })
+        // the destination gets the writes before copying
+        m.apply()
+    }
+    switch m.state(mg) {
+    case MigrationCanceled:
+        return errMigrationCanceled
+    case MigrationVerifying:
+        return nil
+    }
+    if err := m.copyDir(mg, src, dst, prefix); err != nil {
+        return err
+    }
+    m.update(mg, func() {
+        if mg.State == MigrationCopying {
+            mg.State = MigrationVerifying
+        }
+    })
+    return nil
+}
+
+func (m *Migrator) copyDir(mg *Migration, src, dst *Host, prefix string) error {
+    if m.canceled(mg) {
+        return errMigrationCanceled
+    }
+    time.Sleep(migrationThrottle())
+    es, err := src.list(prefix)
+    if err != nil {
+        return fmt.Errorf("list @%s in %s failed: %s", prefix, src.Addr, err)
+    }
+    hasRecords := false
+    var dirs []string
+    for _, e := range es {
+        if e.isDir {
+            dirs = append(dirs, prefix+e.name)
+        } else {
+            hasRecords = true
+        }
+    }
+    cursor := mg.Cursor
+    if !hasRecords {
+        sort.Strings(dirs)
+        for _, dir := range dirs {
+            if cursor != "" && dir < cursor && !strings.HasPrefix(cursor, dir) {
+                continue
+            }
+            if err := m.copyDir(mg, src, dst, dir); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    if cursor != "" && prefix <= cursor {
+        return nil
+    }
+
+    var listings int
+    srcRecords := make(map[string]*listEntry)
+    if err := collectRecords(src, prefix, es, srcRecords, &listings); err != nil {
+        return err
+    }
+    des, err := dst.list(prefix)
+    if err != nil {
+        return fmt.Errorf("list @%s in %s failed: %s", prefix, dst.Addr, err)
+    }
+    dstRecords := make(map[string]*listEntry)
+    if err := collectRecords(dst, prefix, des, dstRecords, &listings); err != nil {
+        return err
+    }
+
+    keys := make([]string, 0, len(srcRecords))
+    for key := range srcRecords {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    copied := 0
+    for _, key := range keys {
+        s, d := srcRecords[key], dstRecords[key]
+        if d != nil && s.hash == d.hash && s.version == d.version {
+            continue
+        }
+        if m.canceled(mg) {
+            return errMigrationCanceled
+        }
+        time.Sleep(migrationThrottle())
+        n, err := repairKey(key, []*Host{src, dst})
+        if err != nil {
+            return fmt.Errorf("copy %s failed: %s", key, err)
+        }
+        copied += n
+    }
+    m.update(mg, func() {
+        mg.Checked += len(keys)
+        mg.Copied += copied
+        mg.Cursor = prefix
+    })
+    return nil
+}
+
+// compare the hash trees of the replicas, repair the differences until
+// they are the same
+func (m *Migrator) verify(mg *Migration, src, dst *Host, prefix string) error {
+    ae := new(AntiEntropy)
+    for pass := 1; pass <= MigrationVerifyPasses; pass++ {
+        if m.canceled(mg) {
+            return errMigrationCanceled
+        }
+        r := &AntiEntropyReport{}
+        ae.compare(r, mg.Bucket, prefix, []*Host{src, dst})
+        if len(r.Errors) > 0 {
+            return errors.New(r.Errors[0])
+        }
+        m.update(mg, func() {
+            mg.Passes = pass
+            mg.Copied += r.Repaired
+        })
+        if r.Diffs == 0 {
+            return nil
+        }
+    }
+    return fmt.Errorf("replicas still differ after %d passes", MigrationVerifyPasses)
+}
@@ -0,0 +1,183 @@
+package memcache
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+)
+
+func testMigrator(t *testing.T, path string) *Migrator {
+    base, err := ParseLayout([]string{"h1:7900 0 1", "h2:7900 0 1", "h3:7900 -0 -1"}, 16)
+    if err != nil {
+        t.Fatal(err)
+    }
+    m, err := NewMigrator(base, path, func() {})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return m
+}
+
+func TestMigratorStart(t *testing.T) {
+    m := testMigrator(t, "")
+    if _, err := m.Start(0, "h1:7900", "h4:7900"); err != nil {
+        t.Fatal(err)
+    }
+    for _, c := range []struct {
+        bucket   int
+        from, to string
+    }{
+        {16, "h1:7900", "h4:7900"}, // no such bucket
+        {1, "h3:7900", "h4:7900"}, // not a primary
+        {1, "h1:7900", "h2:7900"}, // already a primary
+        {1, "h1:7900", "h4"},      // no port
+        {0, "h2:7900", "h3:7900"}, // migrating
+    } {
+        if _, err := m.Start(c.bucket, c.from, c.to); err == nil {
+            t.Errorf("migration accepted: %v", c)
+        }
+    }
+}
+
+func TestMigratorLayout(t *testing.T) {
+    m := testMigrator(t, "")
+    mg, _ := m.Start(0, "h1:7900", "h4:7900")
+
+    // pending migrations do not change the layout
+    l, mirrors := m.Layout()
+    if _, ok := l.Node("h4:7900"); ok || len(mirrors) != 0 {
+        t.Error("pending", l.Servers(), mirrors)
+    }
+
+    m.migrations[0].State = MigrationCopying
+    l, mirrors = m.Layout()
+    if !contains(l.Backups[0], "h4:7900") || !contains(l.Primaries[0], "h1:7900") ||
+        len(mirrors[0]) != 1 || mirrors[0][0] != "h4:7900" {
+        t.Error("copying", l.Servers(), mirrors)
+    }
+
+    m.migrations[0].State = MigrationDone
+    l, mirrors = m.Layout()
+    if !contains(l.Primaries[0], "h4:7900") || contains(l.Primaries[0], "h1:7900") ||
+        !contains(l.Backups[0], "h1:7900") || len(mirrors) != 0 {
+        t.Error("done", l.Servers(), mirrors)
+    }
+
+    // the config with the layout is the same
+    base, _ := ParseLayout(l.Servers(), 16)
+    m.SetBase(base)
+    l2, _ := m.Layout()
+    if len(l2.Primaries[0]) != 2 || len(l2.Backups[0]) != 2 {
+        t.Error("applied twice", l2.Servers())
+    }
+
+    if err := m.Cancel(mg.ID); err == nil {
+        t.Error("canceled a finished migration")
+    }
+    m.Clear()
+    if len(m.Migrations()) != 0 {
+        t.Error("clear", m.Migrations())
+    }
+}
+
+func TestMigratorSave(t *testing.T) {
+    dir, err := ioutil.TempDir("", "migrations")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "migrations.json")
+
+    m := testMigrator(t, path)
+    mg, _ := m.Start(1, "h2:7900", "h4:7900")
+    if err := m.Cancel(mg.ID); err != nil {
+        t.Fatal(err)
+    }
+    if err := m.Retry(mg.ID); err != nil {
+        t.Fatal(err)
+    }
+    m.update(m.migrations[0], func() { m.migrations[0].Cursor = "1a" })
+
+    loaded := testMigrator(t, path)
+    ms := loaded.Migrations()
+    if len(ms) != 1 || ms[0].Bucket != 1 || ms[0].State != MigrationPending || ms[0].Cursor != "1a" {
+        t.Errorf("loaded %+v", ms)
+    }
+}
+
+func TestManualSchedulerMirror(t *testing.T) {
+    config := map[string][]string{
+        "h1:7900": []string{"0", "1"},
+        "h2:7900": []string{"0", "1"},
+        "h3:7900": []string{"-0", "-1"},
+    }
+    sch := NewManualScheduler(config, 16, 2)
+    defer sch.Close()
+    if err := sch.SetMirror(0, "h1:7900"); err == nil {
+        t.Error("a primary is not a mirror")
+    }
+    if err := sch.SetMirror(0, "h3:7900"); err != nil {
+        t.Fatal(err)
+    }
+    mirrored := 0
+    for i := 0; i < 1000; i++ {
+        key := fmt.Sprintf("key%d", i)
+        mirrors := sch.GetMirrorsByKey(key)
+        if len(mirrors) > 0 {
+            mirrored++
+            if mirrors[0].Addr != "h3:7900" || getBucketByKey(sch.hashMethod, sch.bucketWidth, key) != 0 {
+                t.Errorf("mirrors of %s: %v", key, mirrors)
+            }
+        }
+    }
+    if mirrored == 0 {
+        t.Error("no key is mirrored")
+    }
+}
+
+func TestWriteMirrors(t *testing.T) {
+    config := map[string][]string{
+        "h1:7900": []string{"0"},
+        "h2:7900": []string{"0"},
+        "h3:7900": []string{"-0"},
+    }
+    sch := NewManualScheduler(config, 1, 2)
+    defer sch.Close()
+    if err := sch.SetMirror(0, "h3:7900"); err != nil {
+        t.Fatal(err)
+    }
+    c := NewClient(sch, 2, 2, 1)
+
+    var written []string
+    var lock sync.Mutex
+    write := func(mirrorUp bool) int {
+        written = nil
+        calls := make(chan bool, 3)
+        suc, _ := c.write(c.topology(), "key", "set", func() {}, func(host *Host) (bool, error) {
+            lock.Lock()
+            written = append(written, host.Addr)
+            lock.Unlock()
+            calls <- true
+            return host.Addr != "h3:7900" || mirrorUp, nil
+        })
+        // the rest are written after W acks
+        for i := 0; i < 3; i++ {
+            select {
+            case <-calls:
+            case <-time.After(time.Second):
+            }
+        }
+        return suc
+    }
+    if suc := write(true); suc != 2 || len(written) != 3 {
+        t.Error("write to mirror", suc, written)
+    }
+    // the mirror is not counted
+    if suc := write(false); suc != 2 {
+        t.Error("mirror failed", suc, written)
+    }
+}
@@ -0,0 +1,283 @@
+/*
+ * pipelined backend connections: many requests in flight in one connection,
+ * whose responses are matched in order. concurrent single key gets to the
+ * same host are batched into one multi-get. a connection failed or timed out
+ * fails all the requests in it, and is dialed again by the next request, so
+ * the order is never shifted.
+ */
+
+package memcache
+
+import (
+    "bufio"
+    "errors"
+    "net"
+    "sync"
+    "time"
+)
+
+var PipelineConns = 0        // pipelined connections per host, 0 to disable
+var PipelineMaxPending = 1024 // requests in flight per connection
+
+type pipeCall struct {
+    req  *Request
+    resp *Response
+    err  error
+    sent time.Time
+    done chan bool
+}
+
+type pipeConn struct {
+    host    *Host
+    conn    net.Conn
+    queue   chan *pipeCall // to be written
+    pending chan *pipeCall // written, waiting for response
+    closed  chan bool
+    once    sync.Once
+    err     error
+}
+
+func newPipeConn(host *Host, conn net.Conn) *pipeConn {
+    p := &pipeConn{host: host, conn: conn}
+    p.queue = make(chan *pipeCall, PipelineMaxPending)
+    p.pending = make(chan *pipeCall, PipelineMaxPending)
+    p.closed = make(chan bool)
+    go p.writeLoop()
+    go p.readLoop()
+    return p
+}
+
+func (p *pipeConn) fail(err error) {
+    p.once.Do(func() {
+        p.err = err
+        p.conn.Close()
+        close(p.closed)
+    })
+}
+
+func (p *pipeConn) isClosed() bool {
+    select {
+    case <-p.closed:
+        return true
+    default:
+    }
+    return false
+}
+
+func (p *pipeConn) writeLoop() {
+    wbuf := bufio.NewWriter(p.conn)
+    for {
+        var c *pipeCall
+        select {
+        case c = <-p.queue:
+        case <-p.closed:
+            return
+        }
+        // the request may be flushed when the buffer is full
+        p.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+        if err := c.req.Write(wbuf); err != nil {
+            ErrorLog.Print(p.host.Addr, " write request failed:", err)
+            p.fail(err)
+            return
+        }
+        if c.req.NoReply {
+            c.resp = &Response{status: noReplyStatus}
+            c.done <- true
+        } else {
+            c.sent = time.Now()
+            select {
+            case p.pending <- c:
+            case <-p.closed:
+                return
+            }
+        }
+        // flush when no more requests to write
+        if len(p.queue) == 0 {
+            p.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+            if err := wbuf.Flush(); err != nil {
+                ErrorLog.Print(p.host.Addr, " write request failed:", err)
+                p.fail(err)
+                return
+            }
+        }
+    }
+}
+
+func (p *pipeConn) readLoop() {
+    rbuf := bufio.NewReader(p.conn)
+    for {
+        var c *pipeCall
+        select {
+        case c = <-p.pending:
+        case <-p.closed:
+            return
+        }
+        // every request is answered within ReadTimeout after it is written
+        p.conn.SetReadDeadline(c.sent.Add(ReadTimeout))
+        resp := new(Response)
+        if err := resp.Read(rbuf); err != nil {
+            ErrorLog.Print(p.host.Addr, " read response failed:", err)
+            p.fail(err)
+            return
+        }
+        if err := c.req.Check(resp); err != nil {
+            ErrorLog.Print(p.host.Addr, " unexpected response", c.req, resp, err)
+            p.fail(err)
+            return
+        }
+        c.resp = resp
+        c.done <- true
+    }
+}
+
+func (p *pipeConn) call(req *Request) (*Response, error) {
+    c := &pipeCall{req: req, done: make(chan bool, 1)}
+    select {
+    case p.queue <- c:
+    case <-p.closed:
+        return nil, p.err
+    }
+    select {
+    case <-c.done:
+        return c.resp, c.err
+    case <-p.closed:
+    }
+    // it may be done just before closed
+    select {
+    case <-c.done:
+        return c.resp, c.err
+    default:
+    }
+    return nil, p.err
+}
+
+func (host *Host) getPipe() (p *pipeConn, err error) {
+    host.pipeLock.Lock()
+    defer host.pipeLock.Unlock()
+    if host.conns == nil {
+        return nil, errors.New("host closed")
+    }
+    if host.pipes == nil {
+        n := pipelineConns()
+        if n <= 0 {
+            n = 1 // turned off by a reload meanwhile
+        }
+        host.pipes = make([]*pipeConn, n)
+    }
+    i := host.pipeNext % len(host.pipes)
+    host.pipeNext++
+    p = host.pipes[i]
+    if p == nil || p.isClosed() {
+        var conn net.Conn
+        if conn, err = host.createConn(); err != nil {
+            return nil, err
+        }
+        p = newPipeConn(host, conn)
+        host.pipes[i] = p
+    }
+    return
+}
+
+func (host *Host) closePipes() {
+    host.pipeLock.Lock()
+    defer host.pipeLock.Unlock()
+    for _, p := range host.pipes {
+        if p != nil {
+            p.fail(errors.New("host closed"))
+        }
+    }
+    host.pipes = nil
+}
+
+func (host *Host) executePipelined(req *Request) (*Response, error) {
+    if req.Cmd == "get" && len(req.Keys) == 1 && batchable(req.Keys[0]) {
+        return host.batcher.get(req.Keys[0])
+    }
+    p, err := host.getPipe()
+    if err != nil {
+        return nil, err
+    }
+    return p.call(req)
+}
+
+// keys of beansdb internal commands are not batched
+func batchable(key string) bool {
+    return len(key) > 0 && key[0] != '@' && key[0] != '?'
+}
+
+type batchResult struct {
+    item *Item
+    err  error
+}
+
+// gets waiting while a multi-get is in flight are sent in the next one
+type getBatcher struct {
+    sync.Mutex
+    host    *Host
+    waiters map[string][]chan *batchResult
+    running bool
+}
+
+func newGetBatcher(host *Host) *getBatcher {
+    return &getBatcher{host: host, waiters: make(map[string][]chan *batchResult)}
+}
+
+func (b *getBatcher) get(key string) (*Response, error) {
+    ch := make(chan *batchResult, 1)
+    b.Lock()
+    b.waiters[key] = append(b.waiters[key], ch)
+    if !b.running {
+        b.running = true
+        go b.loop()
+    }
+    b.Unlock()
+
+    r := <-ch
+    if r.err != nil {
+        return nil, r.err
+    }
+    resp := &Response{status: "END", items: make(map[string]*Item, 1)}
+    if r.item != nil {
+        resp.items[key] = r.item
+    }
+    return resp, nil
+}
+
+func (b *getBatcher) loop() {
+    for {
+        b.Lock()
+        if len(b.waiters) == 0 {
+            b.running = false
+            b.Unlock()
+            return
+        }
+        waiters := b.waiters
+        b.waiters = make(map[string][]chan *batchResult)
+        b.Unlock()
+
+        keys := make([]string, 0, len(waiters))
+        for key := range waiters {
+            keys = append(keys, key)
+        }
+        var resp *Response
+        p, err := b.host.getPipe()
+        if err == nil {
+            resp, err = p.call(&Request{Cmd: "get", Keys: keys})
+        }
+        for key, chs := range waiters {
+            var item *Item
+            if err == nil {
+                item = resp.items[key]
+            }
+            for i, ch := range chs {
+                // every waiter frees its own item
+                if i > 0 && item != nil {
+                    ch <- &batchResult{&Item{Flag: item.Flag, Exptime: item.Exptime, Cas: item.Cas,
+                        Body: append([]byte(nil), item.Body...)}, err}
+                } else {
+                    ch <- &batchResult{item, err}
+                }
+            }
+        }
+    }
+}
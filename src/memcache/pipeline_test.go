@@ -0,0 +1,136 @@
+package memcache
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestPipelinedHost(t *testing.T) {
+    s := NewServer(mapDistStore{NewMapStore()})
+    addr := "127.0.0.1:11299"
+    if err := s.Listen(addr); err != nil {
+        t.Fatal(err)
+    }
+    go s.Serve()
+    defer s.Shutdown()
+
+    old := PipelineConns
+    PipelineConns = 2
+    defer func() { PipelineConns = old }()
+
+    host := NewHost(addr)
+    defer host.Close()
+
+    if ok, err := host.Set("noreply", &Item{Body: []byte("nr")}, true); !ok || err != nil {
+        t.Fatal("set noreply failed", ok, err)
+    }
+    var wg sync.WaitGroup
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            key := fmt.Sprintf("key%d", i%10)
+            value := fmt.Sprintf("value%d", i%10)
+            if ok, err := host.Set(key, &Item{Body: []byte(value)}, false); !ok || err != nil {
+                t.Error("set failed", key, ok, err)
+                return
+            }
+            item, err := host.Get(key)
+            if err != nil || item == nil || string(item.Body) != value {
+                t.Error("get failed", key, item, err)
+            }
+        }(i)
+    }
+    wg.Wait()
+
+    // responses of noreply requests are not waited for
+    resp, err := host.execute(&Request{Cmd: "delete", Keys: []string{"key9"}, NoReply: true})
+    if err != nil || resp.status != noReplyStatus {
+        t.Error("delete noreply", resp, err)
+    }
+    time.Sleep(time.Millisecond * 10)
+    if item, err := host.Get("key9"); err != nil || item != nil {
+        t.Error("get deleted key", item, err)
+    }
+    if item, err := host.Get("noreply"); err != nil || item == nil || string(item.Body) != "nr" {
+        t.Error("get noreply key failed", item, err)
+    }
+    if item, err := host.Get("missing"); err != nil || item != nil {
+        t.Error("get missing key", item, err)
+    }
+    items, err := host.GetMulti([]string{"key1", "key2", "missing"})
+    if err != nil || len(items) != 2 || string(items["key2"].Body) != "value2" {
+        t.Error("get multi failed", items, err)
+    }
+}
+
+func TestPipelineTimeout(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:11298")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    go func() {
+        // the first connection never answers, the next ones miss every key
+        for i := 0; ; i++ {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func(conn net.Conn, hang bool) {
+                defer conn.Close()
+                r := bufio.NewReader(conn)
+                for {
+                    if _, err := r.ReadString('\n'); err != nil {
+                        return
+                    }
+                    if !hang {
+                        conn.Write([]byte("END\r\n"))
+                    }
+                }
+            }(conn, i == 0)
+        }
+    }()
+
+    oldConns, oldTimeout := PipelineConns, ReadTimeout
+    PipelineConns, ReadTimeout = 1, time.Millisecond*50
+    defer func() { PipelineConns, ReadTimeout = oldConns, oldTimeout }()
+    host := NewHost("127.0.0.1:11298")
+    defer host.Close()
+
+    p, err := host.getPipe()
+    if err != nil {
+        t.Fatal("dial failed", err)
+    }
+    var wg sync.WaitGroup
+    for i := 0; i < 3; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            done := make(chan error, 1)
+            go func() {
+                _, err := p.call(&Request{Cmd: "get", Keys: []string{"key"}})
+                done <- err
+            }()
+            select {
+            case err := <-done:
+                if err == nil {
+                    t.Error("request to a hung connection should fail")
+                }
+            case <-time.After(time.Second):
+                t.Error("request to a hung connection blocked")
+            }
+        }()
+    }
+    wg.Wait()
+    if !p.isClosed() {
+        t.Error("the hung connection should be closed")
+    }
+    if item, err := host.Get("key"); item != nil || err != nil {
+        t.Error("the connection should be dialed again", item, err)
+    }
+}
@@ -30,6 +30,46 @@ type Item struct {
     alloc   *byte
 }
 
+// detach takes the ownership of the body allocated by cmem,
+// the returned func frees it
+func (it *Item) detach() func() {
+    alloc, size := it.alloc, uintptr(cap(it.Body))
+    if alloc == nil {
+        return func() {}
+    }
+    it.alloc = nil
+    runtime.SetFinalizer(it, nil)
+    return func() {
+        cmem.Free(alloc, size)
+    }
+}
+
+// read the body of length and the tailing \r\n
+func (it *Item) readBody(b *bufio.Reader, length int) (e error) {
+    // FIXME
+    if length > AllocLimit {
+        it.alloc = cmem.Alloc(uintptr(length))
+        it.Body = (*[1 << 30]byte)(unsafe.Pointer(it.alloc))[:length]
+        (*reflect.SliceHeader)(unsafe.Pointer(&it.Body)).Cap = length
+        runtime.SetFinalizer(it, func(item *Item) {
+            if item.alloc != nil {
+                //log.Print("free by finalizer: ", cap(item.Body))
+                cmem.Free(item.alloc, uintptr(cap(item.Body)))
+                item.Body = nil
+                item.alloc = nil
+            }
+        })
+    } else {
+        it.Body = make([]byte, length)
+    }
+    if _, e = io.ReadFull(b, it.Body); e != nil {
+        return e
+    }
+    b.ReadByte() // \r
+    b.ReadByte() // \n
+    return nil
+}
+
 func (it *Item) String() (s string) {
     return fmt.Sprintf("Item(Flag:%d, Exptime:%d, Length:%d, Cas:%d, Body:%v",
         it.Flag, it.Exptime, len(it.Body), it.Cas, it.Body)
@@ -40,6 +80,7 @@ type Request struct {
     Keys    []string // keys
     Item    *Item
     NoReply bool
+    Flags   []string // flags of meta commands
 }
 
 func (req *Request) String() (s string) {
@@ -49,12 +90,13 @@ func (req *Request) String() (s string) {
 
 func (req *Request) Clear() {
     req.NoReply = false
+    req.Flags = nil
     if req.Item != nil && req.Item.alloc != nil {
         cmem.Free(req.Item.alloc, uintptr(cap(req.Item.Body)))
         req.Item.Body = nil
         req.Item.alloc = nil
-        req.Item = nil
     }
+    req.Item = nil
 }
 
 func WriteFull(w io.Writer, buf []byte) error {
@@ -174,27 +216,9 @@ func (req *Request) Read(b *bufio.Reader) (e error) {
             req.NoReply = len(parts) > 5 && parts[5] == "noreply"
         }
 
-        // FIXME
-        if length > AllocLimit {
-            item.alloc = cmem.Alloc(uintptr(length))
-            item.Body = (*[1 << 30]byte)(unsafe.Pointer(item.alloc))[:length]
-            (*reflect.SliceHeader)(unsafe.Pointer(&item.Body)).Cap = length
-            runtime.SetFinalizer(item, func(item *Item) {
-                if item.alloc != nil {
-                    //log.Print("free by finalizer: ", cap(item.Body))
-                    cmem.Free(item.alloc, uintptr(cap(item.Body)))
-                    item.Body = nil
-                    item.alloc = nil
-                }
-            })
-        } else {
-            item.Body = make([]byte, length)
-        }
-        if _, e = io.ReadFull(b, item.Body); e != nil {
+        if e = item.readBody(b, length); e != nil {
             return e
         }
-        b.ReadByte() // \r
-        b.ReadByte() // \n
 
     case "delete":
         if len(parts) < 2 || len(parts) > 4 {
@@ -214,6 +238,9 @@ func (req *Request) Read(b *bufio.Reader) (e error) {
     case "stats":
         req.Keys = parts[1:]
 
+    case "mg", "ms", "md", "ma", "mn":
+        return req.readMeta(parts, b)
+
     case "quit", "version", "flush_all":
     case "verbosity":
         if len(parts) >= 2 {
@@ -233,6 +260,7 @@ type Response struct {
     msg     string
     cas     bool
     noreply bool
+    quiet   bool // meta commands, only reply errors
     items   map[string]*Item
 }
 
@@ -349,8 +377,24 @@ func (resp *Response) Write(w io.Writer) error {
     if resp.noreply {
         return nil
     }
+    if resp.quiet && contain([]string{"HD", "EN", "NF"}, resp.status) {
+        return nil
+    }
 
     switch resp.status {
+    case "VA":
+        for _, item := range resp.items {
+            fmt.Fprintf(w, "VA %d", len(item.Body))
+            if resp.msg != "" {
+                io.WriteString(w, " "+resp.msg)
+            }
+            io.WriteString(w, "\r\n")
+            if e := WriteFull(w, item.Body); e != nil {
+                return e
+            }
+            WriteFull(w, []byte("\r\n"))
+        }
+
     case "VALUE":
         for key, item := range resp.items {
             if resp.cas {
@@ -401,6 +445,15 @@ func writeLine(w io.Writer, s string) {
     io.WriteString(w, "\r\n")
 }
 
+// the stores return 0 of incr for missing keys, tell them from a result of 0
+func incrFound(store DistributeStorage, key string, result int) bool {
+    if result != 0 {
+        return result > 0
+    }
+    item, _, err := store.Get(key)
+    return err == nil && item != nil
+}
+
 func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Response, targets []string, err error) {
     resp = new(Response)
     resp.noreply = req.NoReply
@@ -419,7 +472,29 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
 
         resp.status = "VALUE"
         resp.cas = req.Cmd == "gets"
-        if len(req.Keys) > 1 {
+        if resp.cas {
+            // tokens are checked by keys one by one
+            resp.items = make(map[string]*Item, len(req.Keys))
+            for _, key := range req.Keys {
+                var item *Item
+                var hosts []string
+                item, hosts, err = store.Gets(key)
+                if err != nil {
+                    resp.status = "SERVER_ERROR"
+                    resp.msg = err.Error()
+                    return
+                }
+                stat.cmd_get++
+                targets = append(targets, hosts...)
+                if item == nil {
+                    stat.get_misses++
+                } else {
+                    resp.items[key] = item
+                    stat.get_hits++
+                    stat.bytes_written += int64(len(item.Body))
+                }
+            }
+        } else if len(req.Keys) > 1 {
             resp.items, targets, err = store.GetMulti(req.Keys)
             if err != nil {
                 resp.status = "SERVER_ERROR"
@@ -454,7 +529,21 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
             }
         }
 
-    case "set", "add", "replace", "cas":
+    case "cas":
+        key := req.Keys[0]
+        var status string
+        status, targets, err = store.Cas(key, req.Item, req.NoReply)
+        if err != nil {
+            resp.status = "SERVER_ERROR"
+            resp.msg = err.Error()
+            break
+        }
+
+        stat.cmd_set++
+        stat.bytes_read += int64(len(req.Item.Body))
+        resp.status = status
+
+    case "set", "add", "replace":
         key := req.Keys[0]
         var suc bool
         suc, targets, err = store.Set(key, req.Item, req.NoReply)
@@ -509,7 +598,7 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
             break
         }
 
-        if result > 0 {
+        if incrFound(store, key, result) {
             resp.status = "INCR"
             resp.msg = strconv.Itoa(result)
         } else {
@@ -534,6 +623,11 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
 
     case "stats":
         st := stat.Stats()
+        if sr, ok := store.(StatsReporter); ok {
+            for k, v := range sr.Stats() {
+                st[k] = v
+            }
+        }
         n := int64(store.Len())
         st["curr_items"] = n
         st["total_items"] = n
@@ -556,6 +650,9 @@ func (req *Request) Process(store DistributeStorage, stat *Stats) (resp *Respons
         }
         resp.msg = strings.Join(ss, "")
 
+    case "mg", "ms", "md", "ma", "mn":
+        return req.processMeta(store, stat)
+
     case "version":
         resp.status = "VERSION"
         resp.msg = VERSION
@@ -603,7 +700,7 @@ func (req *Request) Check(resp *Response) error {
             return errors.New("unexpected status: " + resp.status)
         }
 
-    case "set", "add", "replace", "append", "prepend":
+    case "set", "add", "replace", "cas", "append", "prepend":
         if !contain([]string{"STORED", "NOT_STORED", "EXISTS", "NOT_FOUND"},
             resp.status) {
             return errors.New("unexpected status: " + resp.status)
@@ -32,7 +32,7 @@ var reqTests = []reqTest{
 	},
 	reqTest{
 		"set abc a 3 2 noreply\r\nok\r\n",
-		"CLIENT_ERROR strconv.ParseInt: parsing \"a\": invalid syntax\r\n",
+		"CLIENT_ERROR strconv.Atoi: parsing \"a\": invalid syntax\r\n",
 	},
 	reqTest{
 		"set abc 3 3 3 2 noreply\r\nok\r\n",
@@ -40,7 +40,7 @@ var reqTests = []reqTest{
 	},
 	reqTest{
 		"set abc a 3 2 noreply\r\nok\r\n",
-		"CLIENT_ERROR strconv.ParseInt: parsing \"a\": invalid syntax\r\n",
+		"CLIENT_ERROR strconv.Atoi: parsing \"a\": invalid syntax\r\n",
 	},
 	reqTest{
 		"set abc 3 3 10\r\nok\r\n",
@@ -148,7 +148,7 @@ func TestRequest(t *testing.T) {
 		if e != nil {
 			resp = &Response{status: "CLIENT_ERROR", msg: e.Error()}
 		} else {
-			resp = req.Process(store, stats)
+			resp, _, _ = req.Process(mapDistStore{store}, stats)
 		}
 
 		r := make([]byte, 0)
@@ -6,20 +6,28 @@ import (
 	//    "os"
 )
 
+// a server in front of a client of two servers, as the proxy
 func testProxy(t *testing.T, auto bool) {
 	//AccessLog = log.New(os.Stdout, nil, "", log.Ldate|log.Ltime)
-	s1, _ := StartServer("localhost:11297")
+	s1 := startTestServer(t, "localhost:11297")
 	defer s1.Shutdown()
-	s2, _ := StartServer("localhost:11296")
+	s2 := startTestServer(t, "localhost:11296")
 	defer s2.Shutdown()
 
-	config := map[string][]int{
-		"localhost:11296": []int{0},
-		"localhost:11297": []int{0},
+	var sch Scheduler
+	if auto {
+		sch = NewAutoScheduler([]string{"localhost:11296", "localhost:11297"}, 1)
+	} else {
+		sch = NewManualScheduler(map[string][]string{
+			"localhost:11296": []string{"0"},
+			"localhost:11297": []string{"0"},
+		}, 1, 2)
 	}
 	addr := "localhost:11295"
-	p := NewProxy(config, auto)
-	p.Listen(addr)
+	p := NewServer(NewClient(sch, 2, 1, 1))
+	if err := p.Listen(addr); err != nil {
+		t.Fatal("listen failed", err)
+	}
 	defer p.Shutdown()
 	go func() {
 		p.Serve()
@@ -27,6 +35,7 @@ func testProxy(t *testing.T, auto bool) {
 	time.Sleep(1e8)
 
 	client := NewHost(addr)
+	defer client.Close()
 	testStore(t, client)
 }
 
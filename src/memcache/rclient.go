@@ -6,49 +6,50 @@ package memcache
 
 import (
     "errors"
-    "math"
     "sync"
     "time"
+    "unsafe"
 )
 
 type RClient struct {
-    scheduler Scheduler
-    N, W, R   int
+    topo unsafe.Pointer // *topology
 }
 
 func NewRClient(sch Scheduler, N, W, R int) (c *RClient) {
     c = new(RClient)
-    c.scheduler = sch
-    c.N = N
-    c.W = W
-    c.R = R
+    swapTopology(&c.topo, sch, N, W, R, nil)
     return c
 }
 
+func (c *RClient) topology() *topology {
+    return loadTopology(&c.topo)
+}
+
+// Reload swaps in the new scheduler and N/W/R, returns the old scheduler
+func (c *RClient) Reload(sch Scheduler, N, W, R int) Scheduler {
+    return swapTopology(&c.topo, sch, N, W, R, nil).scheduler
+}
+
 func (c *RClient) Get(key string) (r *Item, targets []string, err error) {
-    hosts := c.scheduler.GetHostsByKey(key)
+    topo := c.topology()
+    hosts := topo.scheduler.GetHostsByKey(key)
     cnt := 0
     for _, host := range hosts {
         st := time.Now()
         r, err = host.Get(key)
+        topo.scheduler.Feedback(host, key, time.Since(st), err)
         if err == nil {
             cnt++
             if r != nil {
-                t := float64(time.Now().Sub(st)) / 1e9
-                c.scheduler.Feedback(host, key, 1 - float64(math.Sqrt(t)*t))
                 // got the right rval
                 targets = []string{host.Addr}
                 err = nil
                 //return r, nil
                 return
             }
-        } else if err.Error() != "wait for retry" {
-            c.scheduler.Feedback(host, key, -5)
-        } else {
-            c.scheduler.Feedback(host, key, -2)
         }
 
-        if cnt >= c.R {
+        if cnt >= topo.R {
             // because hosts are sorted
             err = nil
         }
@@ -57,25 +58,24 @@ func (c *RClient) Get(key string) (r *Item, targets []string, err error) {
     return
 }
 
-func (c *RClient) getMulti(keys []string) (rs map[string]*Item, targets []string, err error) {
+func (c *RClient) Gets(key string) (*Item, []string, error) {
+    return getsFrom(c.topology().scheduler.GetHostsByKey(key), key)
+}
+
+func (c *RClient) getMulti(topo *topology, keys []string) (rs map[string]*Item, targets []string, err error) {
     need := len(keys)
     rs = make(map[string]*Item, need)
-    hosts := c.scheduler.GetHostsByKey(keys[0])
+    hosts := topo.scheduler.GetHostsByKey(keys[0])
     suc := 0
     for _, host := range hosts {
         st := time.Now()
         r, er := host.GetMulti(keys)
+        topo.scheduler.Feedback(host, keys[0], time.Since(st), er)
         if er == nil {
             suc += 1
             if r != nil {
                 targets = append(targets, host.Addr)
-                t := float64(time.Now().Sub(st)) / 1e9
-                c.scheduler.Feedback(host, keys[0], 1 - float64(math.Sqrt(t)*t))
             }
-        } else if er.Error() != "wait for retry" { // failed
-            c.scheduler.Feedback(host, keys[0], -5)
-        } else {
-            c.scheduler.Feedback(host, keys[0], -2)
         }
         err = er
         if er != nil {
@@ -101,7 +101,7 @@ func (c *RClient) getMulti(keys []string) (rs map[string]*Item, targets []string
             break // repeated keys
         }
     }
-    if suc > c.R {
+    if suc > topo.R {
         err = nil
     }
     return
@@ -112,12 +112,13 @@ func (c *RClient) GetMulti(keys []string) (rs map[string]*Item, targets []string
     var lock sync.Mutex
     rs = make(map[string]*Item, len(keys))
 
-    gs := c.scheduler.DivideKeysByBucket(keys)
+    topo := c.topology()
+    gs := topo.scheduler.DivideKeysByBucket(keys)
     reply := make(chan bool, len(gs))
     for _, ks := range gs {
         if len(ks) > 0 {
             go func(keys []string) {
-                r, t, e := c.getMulti(keys)
+                r, t, e := c.getMulti(topo, keys)
                 if e != nil {
                     err = e
                 } else {
@@ -147,6 +148,11 @@ func (c *RClient) Set(key string, item *Item, noreply bool) (ok bool, targets []
     return
 }
 
+func (c *RClient) Cas(key string, item *Item, noreply bool) (status string, targets []string, err error) {
+    err = errors.New("Access Denied for ReadOnly")
+    return
+}
+
 func (c *RClient) Append(key string, value []byte) (ok bool, targets []string, final_err error) {
     ok = false
     final_err = errors.New("Access Denied for ReadOnly")
@@ -0,0 +1,89 @@
+/*
+ * rendezvous: the hosts of a bucket are the N with the highest weighted
+ * scores of hash(host, bucket), so adding or removing a host only moves
+ * the buckets it wins or loses, and nobody keeps the lists by hand.
+ */
+
+package memcache
+
+import (
+    "crypto/md5"
+    "encoding/binary"
+    "fmt"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// route requests by weighted rendezvous hashing of buckets, which are
+// served as a ManualScheduler, with its feedback and stats
+type RendezvousScheduler struct {
+    *ManualScheduler
+}
+
+// the score of host for the bucket, -w/ln(u) with u uniform in (0, 1)
+func rendezvousScore(addr string, bucket int, weight float64) float64 {
+    d := md5.Sum([]byte(fmt.Sprintf("%s-%d", addr, bucket)))
+    u := (float64(binary.BigEndian.Uint64(d[:8])>>11) + 0.5) / (1 << 53)
+    return -weight / math.Log(u)
+}
+
+// the strings are "weight=W" (1 by default) and "zone=name"
+func NewRendezvousScheduler(config map[string][]string, bs, n int) *RendezvousScheduler {
+    weights := make(map[string]float64, len(config))
+    manual := make(map[string][]string, len(config))
+    for addr, tokens := range config {
+        weights[addr] = 1
+        manual[addr] = nil
+        for _, token := range tokens {
+            switch {
+            case strings.HasPrefix(token, "zone="):
+                manual[addr] = append(manual[addr], token)
+            case strings.HasPrefix(token, "weight="):
+                w, e := strconv.Atoi(token[len("weight="):])
+                if e != nil || w < 1 {
+                    ErrorLog.Printf("invalid %s of %s, skipped", token, addr)
+                    continue
+                }
+                weights[addr] = float64(w)
+            default:
+                ErrorLog.Printf("invalid %s of %s, skipped", token, addr)
+            }
+        }
+    }
+    for addr, buckets := range RendezvousBuckets(weights, bs, n) {
+        manual[addr] = append(manual[addr], buckets...)
+    }
+    return &RendezvousScheduler{NewManualScheduler(manual, bs, min(n, len(config)))}
+}
+
+// RendezvousBuckets returns the buckets, in hex, which the hosts of the
+// weights serve as the N primaries
+func RendezvousBuckets(weights map[string]float64, bs, n int) map[string][]string {
+    addrs := make([]string, 0, len(weights))
+    for addr := range weights {
+        addrs = append(addrs, addr)
+    }
+    sort.Strings(addrs)
+
+    n = min(n, len(addrs))
+    buckets := make(map[string][]string, len(addrs))
+    scores := make(map[string]float64, len(addrs))
+    for b := 0; b < bs; b++ {
+        for _, addr := range addrs {
+            scores[addr] = rendezvousScore(addr, b, weights[addr])
+        }
+        sort.Slice(addrs, func(i, j int) bool {
+            si, sj := scores[addrs[i]], scores[addrs[j]]
+            if si != sj {
+                return si > sj
+            }
+            return addrs[i] < addrs[j]
+        })
+        for _, addr := range addrs[:n] {
+            buckets[addr] = append(buckets[addr], fmt.Sprintf("%X", b))
+        }
+    }
+    return buckets
+}
@@ -0,0 +1,187 @@
+/*
+ * read repair: write the newest value back to stale replicas
+ */
+
+package memcache
+
+import (
+    "errors"
+    "time"
+)
+
+var ReadRepairRate = 100          // max repairs per second
+var ReadRepairQueueSize = 1024    // pending repairs, drop new ones when full
+var ReadRepairChance = 0.01       // check replicas even if the first one hit
+
+type repairTask struct {
+    key   string
+    hosts []*Host
+}
+
+type readRepairer struct {
+    queue chan *repairTask
+    stats *Stats
+    stop  chan bool
+}
+
+func newReadRepairer(stats *Stats) *readRepairer {
+    r := new(readRepairer)
+    r.queue = make(chan *repairTask, ReadRepairQueueSize)
+    r.stats = stats
+    r.stop = make(chan bool)
+    go r.run()
+    return r
+}
+
+// Stop quits the repairer, the pending tasks are dropped
+func (r *readRepairer) Stop() {
+    close(r.stop)
+}
+
+// Submit never blocks the caller, the task is dropped if too many are pending
+func (r *readRepairer) Submit(key string, hosts []*Host) {
+    if len(key) == 0 || key[0] == '?' || key[0] == '@' {
+        return
+    }
+    select {
+    case r.queue <- &repairTask{key: key, hosts: hosts}:
+        r.stats.UpdateStat("read_repair_queued", 1)
+    default:
+        r.stats.UpdateStat("read_repair_dropped", 1)
+    }
+}
+
+func (r *readRepairer) run() {
+    ticker := time.NewTicker(time.Second / time.Duration(ReadRepairRate))
+    defer ticker.Stop()
+    for {
+        var task *repairTask
+        select {
+        case task = <-r.queue:
+        case <-r.stop:
+            return
+        }
+        select {
+        case <-ticker.C:
+        case <-r.stop:
+            return
+        }
+        n, err := repairKey(task.key, task.hosts)
+        if err != nil {
+            ErrorLog.Printf("read repair %s failed: %s", task.key, err)
+            r.stats.UpdateStat("read_repair_failed", 1)
+        }
+        r.stats.UpdateStat("read_repair_done", int64(n))
+    }
+}
+
+func absInt(x int) int {
+    if x < 0 {
+        return -x
+    }
+    return x
+}
+
+// pick the newest replica by version, a negative version means deleted.
+// a replica is stale if it misses the key or has an older version,
+// replicas marked as failed are ignored.
+func pickWinner(metas []*Meta, failed []bool) (winner int, stale []int) {
+    winner = -1
+    for i, m := range metas {
+        if failed[i] || m == nil {
+            continue
+        }
+        if winner < 0 || absInt(m.Version) > absInt(metas[winner].Version) {
+            winner = i
+        }
+    }
+    if winner < 0 {
+        return
+    }
+    wv := metas[winner].Version
+    for i, m := range metas {
+        if failed[i] || i == winner {
+            continue
+        }
+        if m == nil {
+            // missing is the same as deleted
+            if wv > 0 {
+                stale = append(stale, i)
+            }
+        } else if absInt(m.Version) < absInt(wv) && (m.Version > 0 || wv > 0) {
+            stale = append(stale, i)
+        }
+    }
+    return
+}
+
+func sameMeta(a, b *Meta) bool {
+    if a == nil || b == nil {
+        return a == b
+    }
+    return a.Version == b.Version && a.Hash == b.Hash
+}
+
+// a client write may have landed in the replica since its meta was read,
+// it is skipped then rather than overwritten by an older value
+func metaMoved(host *Host, key string, old *Meta) (bool, error) {
+    m, err := host.GetMeta(key)
+    if err != nil {
+        return false, err
+    }
+    return !sameMeta(m, old), nil
+}
+
+// repairKey returns the number of replicas which had been repaired, those
+// changed during the repair are left to the next one
+func repairKey(key string, hosts []*Host) (repaired int, err error) {
+    metas := make([]*Meta, len(hosts))
+    failed := make([]bool, len(hosts))
+    for i, host := range hosts {
+        metas[i], err = host.GetMeta(key)
+        failed[i] = err != nil
+    }
+    err = nil
+    winner, stale := pickWinner(metas, failed)
+    if len(stale) == 0 {
+        return
+    }
+
+    if metas[winner].Version < 0 {
+        for _, i := range stale {
+            if moved, e := metaMoved(hosts[i], key, metas[i]); moved || e != nil {
+                err = e
+                continue
+            }
+            if ok, e := hosts[i].Delete(key); ok {
+                repaired++
+            } else if e != nil {
+                err = e
+            }
+        }
+        return
+    }
+
+    item, e := hosts[winner].Get(key)
+    if e != nil {
+        return 0, e
+    }
+    if item == nil {
+        return 0, errors.New("value missing in " + hosts[winner].Addr)
+    }
+    // beansdb takes the exptime of a set as the version, so the stale
+    // replica gets the version of the winner rather than bumping its own
+    item.Exptime = metas[winner].Version
+    for _, i := range stale {
+        if moved, e := metaMoved(hosts[i], key, metas[i]); moved || e != nil {
+            err = e
+            continue
+        }
+        if ok, e := hosts[i].Set(key, item, false); ok {
+            repaired++
+        } else if e != nil {
+            err = e
+        }
+    }
+    return
+}
@@ -0,0 +1,175 @@
+package memcache
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "testing"
+)
+
+func TestParseMeta(t *testing.T) {
+    m, err := parseMeta([]byte("3 4321 2 5 1380000000 1 1024"))
+    if err != nil {
+        t.Fatal("parse meta failed", err)
+    }
+    if m.Version != 3 || m.Hash != 4321 || m.Flag != 2 || m.Size != 5 || m.Timestamp != 1380000000 {
+        t.Errorf("unexpected meta: %v", m)
+    }
+    if _, err := parseMeta([]byte("3 4321")); err == nil {
+        t.Error("short meta should fail")
+    }
+    if _, err := parseMeta([]byte("a b c d e")); err == nil {
+        t.Error("invalid meta should fail")
+    }
+}
+
+type winnerCase struct {
+    versions []int // 0 means missing
+    failed   []bool
+    winner   int
+    stale    []int
+}
+
+var winnerTests = []winnerCase{
+    winnerCase{[]int{1, 1, 1}, []bool{false, false, false}, 0, nil},
+    winnerCase{[]int{0, 2, 1}, []bool{false, false, false}, 1, []int{0, 2}},
+    winnerCase{[]int{0, 2, 1}, []bool{false, false, true}, 1, []int{0}},
+    winnerCase{[]int{-3, 2, 0}, []bool{false, false, false}, 0, []int{1}},
+    winnerCase{[]int{-3, -2, 0}, []bool{false, false, false}, 0, nil},
+    winnerCase{[]int{0, 0, 0}, []bool{false, false, false}, -1, nil},
+}
+
+func TestPickWinner(t *testing.T) {
+    for i, c := range winnerTests {
+        metas := make([]*Meta, len(c.versions))
+        for j, v := range c.versions {
+            if v != 0 {
+                metas[j] = &Meta{Version: v}
+            }
+        }
+        winner, stale := pickWinner(metas, c.failed)
+        if winner != c.winner {
+            t.Errorf("case #%d: expect winner %d but %d", i, c.winner, winner)
+        }
+        if len(stale) != len(c.stale) {
+            t.Errorf("case #%d: expect stale %v but %v", i, c.stale, stale)
+            continue
+        }
+        for j := range stale {
+            if stale[j] != c.stale[j] {
+                t.Errorf("case #%d: expect stale %v but %v", i, c.stale, stale)
+            }
+        }
+    }
+}
+
+// a beansdb-like store with versions, serving the meta by `?key`
+type metaStore struct {
+    mapDistStore
+    lock     sync.Mutex
+    versions map[string]int
+    onGet    func(key string) // called before a value is read
+}
+
+func newMetaStore() *metaStore {
+    return &metaStore{mapDistStore: mapDistStore{NewMapStore()}, versions: make(map[string]int)}
+}
+
+func (s *metaStore) Get(key string) (*Item, []string, error) {
+    if strings.HasPrefix(key, "?") {
+        item, _, err := s.mapDistStore.Get(key[1:])
+        if item == nil || err != nil {
+            return nil, nil, err
+        }
+        s.lock.Lock()
+        ver := s.versions[key[1:]]
+        s.lock.Unlock()
+        hash := 0
+        for _, c := range item.Body {
+            hash = hash*31 + int(c)
+        }
+        body := fmt.Sprintf("%d %d %d %d 0", ver, hash&0xffff, item.Flag, len(item.Body))
+        return &Item{Body: []byte(body)}, []string{"meta"}, nil
+    }
+    if s.onGet != nil {
+        s.onGet(key)
+    }
+    return s.mapDistStore.Get(key)
+}
+
+// like beansdb, a positive exptime is taken as the version of the value
+func (s *metaStore) Set(key string, item *Item, noreply bool) (bool, []string, error) {
+    s.lock.Lock()
+    if item.Exptime > 0 {
+        s.versions[key] = item.Exptime
+    } else {
+        s.versions[key]++
+    }
+    s.lock.Unlock()
+    return s.mapDistStore.Set(key, item, noreply)
+}
+
+func startMetaStore(t *testing.T, addr string) (*metaStore, func()) {
+    store := newMetaStore()
+    s := NewServer(store)
+    if err := s.Listen(addr); err != nil {
+        t.Fatal(err)
+    }
+    go s.Serve()
+    return store, s.Shutdown
+}
+
+func TestRepairKeySkipsMovedReplica(t *testing.T) {
+    a, stopA := startMetaStore(t, "127.0.0.1:11311")
+    defer stopA()
+    b, stopB := startMetaStore(t, "127.0.0.1:11312")
+    defer stopB()
+    hosts := []*Host{NewHost("127.0.0.1:11311"), NewHost("127.0.0.1:11312")}
+    defer hosts[0].Close()
+    defer hosts[1].Close()
+
+    reset := func() {
+        a.Set("k", &Item{Body: []byte("new"), Exptime: 5}, false)
+        b.Set("k", &Item{Body: []byte("old")}, false)
+    }
+    reset()
+    if n, err := repairKey("k", hosts); n != 1 || err != nil {
+        t.Fatal("repair", n, err)
+    }
+    if item, _, _ := b.mapDistStore.Get("k"); string(item.Body) != "new" {
+        t.Error("not repaired", string(item.Body))
+    }
+    if a.versions["k"] != 5 || b.versions["k"] != 5 {
+        t.Error("versions do not converge", a.versions["k"], b.versions["k"])
+    }
+    if n, err := repairKey("k", hosts); n != 0 || err != nil {
+        t.Error("repair again", n, err)
+    }
+
+    // a client writes to b while the winner is read
+    a.versions, b.versions = make(map[string]int), make(map[string]int)
+    reset()
+    a.onGet = func(key string) {
+        b.Set(key, &Item{Body: []byte("client")}, false)
+    }
+    if n, err := repairKey("k", hosts); n != 0 || err != nil {
+        t.Error("repair of moved replica", n, err)
+    }
+    if item, _, _ := b.mapDistStore.Get("k"); string(item.Body) != "client" {
+        t.Error("the client write is overwritten", string(item.Body))
+    }
+}
+
+func TestReloadStopsReadRepairer(t *testing.T) {
+    c := NewClient(NewManualScheduler(map[string][]string{"localhost:11599": {"0"}}, 1, 1), 1, 1, 1)
+    old := c.topology()
+    c.Reload(NewManualScheduler(map[string][]string{"localhost:11598": {"0"}}, 1, 1), 1, 1, 1)
+    select {
+    case <-old.repairer.stop:
+    default:
+        t.Error("the repairer of the old topology is running")
+    }
+    if c.topology().repairer == old.repairer {
+        t.Error("the repairer is not replaced")
+    }
+}
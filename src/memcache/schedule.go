@@ -7,21 +7,27 @@ import (
     "sort"
     "strconv"
     "strings"
+    "sync"
     "time"
-    "math/rand"
 )
 
 // Scheduler: route request to nodes
 type Scheduler interface {
-    Feedback(host *Host, key string, adjust float64) // feedback for auto routing
+    Feedback(host *Host, key string, latency time.Duration, err error) // feedback for auto routing
     GetHostsByKey(key string) []*Host                               // route a key to hosts
     DivideKeysByBucket(keys []string) [][]string                    // route some keys to group of hosts
     Stats() map[string][]float64                                    // internal status
 }
 
+// Mirrorer is implemented by schedulers with migrating buckets, the
+// destinations get the writes of the buckets besides the N hosts
+type Mirrorer interface {
+    GetMirrorsByKey(key string) []*Host
+}
+
 type emptyScheduler struct{}
 
-func (c emptyScheduler) Feedback(host *Host, key string, adjust float64) {}
+func (c emptyScheduler) Feedback(host *Host, key string, latency time.Duration, err error) {}
 
 func (c emptyScheduler) Stats() map[string][]float64 { return nil }
 
@@ -150,25 +156,31 @@ type ManualScheduler struct {
     N          int
     hosts      []*Host
     buckets    [][]int
+    primaries  [][]int // buckets by the addresses of hosts, never reordered
     backups    [][]int
+    mirrors    [][]int
     bucketWidth int
-    stats      [][]float64
+    scores     [][]hostScore
+    scoreLock  sync.Mutex
     hashMethod HashMethod
     feedChan   chan *Feedback
+    stop       chan bool
+    closeOnce  sync.Once
 }
 
-// the string is a Hex int string, if it start with -, it means serve the bucket as a backup
+// LocalZone is the zone of the proxy, hosts in it are preferred for reads,
+// and writes wait for an ack outside of it when W > 1
+var LocalZone string
+
+// the string is a Hex int string, if it start with -, it means serve the bucket as a backup,
+// and "zone=name" sets the zone of the host
 func NewManualScheduler(config map[string][]string, bs, n int) *ManualScheduler {
-    defer func() {
-        if r := recover(); r != nil {
-            ErrorLog.Fatalln("NewManualScheduler panic, maybe node's supporting bucket more than buckets number")
-        }
-    }()
     c := new(ManualScheduler)
     c.hosts = make([]*Host, len(config))
     c.buckets = make([][]int, bs)
     c.backups = make([][]int, bs)
-    c.stats = make([][]float64, bs)
+    c.mirrors = make([][]int, bs)
+    c.scores = make([][]hostScore, bs)
     c.N = n
 
     no := 0
@@ -177,41 +189,62 @@ func NewManualScheduler(config map[string][]string, bs, n int) *ManualScheduler
         host.offset = no
         c.hosts[no] = host
         for _, bucket_str := range serve_to {
-            if strings.HasPrefix(bucket_str, "-") {
-                if bucket, e := strconv.ParseInt(bucket_str[1:], 16, 16); e == nil {
-                    //c.buckets[bucket] = append(c.buckets[bucket], no)
-                    c.backups[bucket] = append(c.backups[bucket], no)
-
-                } else {
-                    ErrorLog.Println("Parse serving bucket config failed, it was not digital")
-                }
+            if strings.HasPrefix(bucket_str, "zone=") {
+                host.Zone = bucket_str[len("zone="):]
+                continue
+            }
+            backup := strings.HasPrefix(bucket_str, "-")
+            bucket, e := strconv.ParseInt(strings.TrimPrefix(bucket_str, "-"), 16, 32)
+            if e != nil || bucket < 0 || int(bucket) >= bs {
+                ErrorLog.Printf("invalid bucket %s of %s, skipped", bucket_str, addr)
+                continue
+            }
+            if backup {
+                c.backups[bucket] = append(c.backups[bucket], no)
             } else {
-                if bucket, e := strconv.ParseInt(bucket_str, 16, 16); e == nil {
-                    c.buckets[bucket] = append(c.buckets[bucket], no)
-                } else {
-                    ErrorLog.Println("Parse serving bucket config failed, it was not digital")
-                }
+                c.buckets[bucket] = append(c.buckets[bucket], no)
             }
         }
         no++
     }
-    // set c.stats according to c.buckets
+    c.primaries = make([][]int, bs)
     for b := 0; b < bs; b++ {
-        c.stats[b] = make([]float64, len(c.hosts))
+        c.scores[b] = make([]hostScore, len(c.hosts))
+        c.primaries[b] = append([]int(nil), c.buckets[b]...)
+        sort.Sort(byAddr{c.primaries[b], c.hosts})
     }
-    c.hashMethod = fnv1a1
+    c.hashMethod = hashMethods[DefaultHashName]
     c.bucketWidth = calBitWidth(bs)
+    c.feedChan = make(chan *Feedback, 256)
+    c.stop = make(chan bool)
 
     go c.procFeedback()
     go func() {
         for {
-            c.try_reward()
-            time.Sleep(5 * 1e9)
+            c.probe()
+            select {
+            case <-time.After(5 * 1e9):
+            case <-c.stop:
+                return
+            }
         }
     }()
     return c
 }
 
+// Close stops the goroutines, hosts are closed after the requests on them
+// are finished
+func (c *ManualScheduler) Close() {
+    c.closeOnce.Do(func() {
+        close(c.stop)
+        time.AfterFunc(ReadTimeout+WriteTimeout, func() {
+            for _, host := range c.hosts {
+                host.Close()
+            }
+        })
+    })
+}
+
 func fastdivideKeysByBucket(hash_func HashMethod, bs int, bw int, keys []string) [][]string {
     rs := make([][]string, bs)
     //bw := calBitWidth(bs)
@@ -223,108 +256,106 @@ func fastdivideKeysByBucket(hash_func HashMethod, bs int, bw int, keys []string)
 }
 
 
-/*
-func (c *ManualScheduler) dump_scores() {
+// probe the primaries which are not healthy, their scores are updated in
+// the buckets they are not healthy in
+func (c *ManualScheduler) probe() {
+    now := time.Now()
+    unhealthy := make(map[int][]int)
+    c.scoreLock.Lock()
     for i, bucket := range c.buckets {
-        scores := make([]string, len(bucket))
-        stats := c.stats[i]
-        for j, n := range bucket {
-            addr := c.hosts[n].Addr
-            scores[j] = fmt.Sprintf("%s:%f", addr[:strings.Index(addr, ":")], stats[n])
+        for _, h := range bucket {
+            if c.scores[i][h].stateAt(now) != HostHealthy {
+                unhealthy[h] = append(unhealthy[h], i)
+            }
         }
-        ErrorLog.Printf( "Bucket %X Score: %v", i, scores)
     }
-}
-*/
+    c.scoreLock.Unlock()
 
-func (c *ManualScheduler) try_reward() {
-    //c.dump_scores()
-    for i, bucket := range c.buckets {
-        // random raward 2nd, 3rd node
-        second_node := bucket[1]
-        if _, err := c.hosts[second_node].Get("@"); err == nil {
-            var second_reward float64 = 0.0
-            second_stat := c.stats[i][second_node]
-            if second_stat < 0 {
-                second_reward = 0 - second_stat
-            } else {
-                second_reward = float64(rand.Intn(10))
-            }
-            c.feedChan <- &Feedback {hostIndex: second_node, bucketIndex: i, adjust: second_reward}
-        } else {
-            ErrorLog.Printf("beansdb server : %s in Bucket %X's second node Down while try_reward, the err = %s", c.hosts[second_node].Addr, i, err)
+    for h, buckets := range unhealthy {
+        st := time.Now()
+        _, err := c.hosts[h].Get("@")
+        latency := time.Since(st)
+        if err != nil {
+            ErrorLog.Printf("beansdb server : %s in Buckets %X is down while probing, the err = %s", c.hosts[h].Addr, buckets, err)
         }
-
-        if c.N > 2 {
-            third_node := bucket[2]
-            if _, err := c.hosts[third_node].Get("@"); err == nil {
-                var third_reward float64 = 0.0
-                third_stat := c.stats[i][third_node]
-                if third_stat < 0 {
-                    third_reward = 0 - third_stat
-                } else {
-                    third_reward = float64(rand.Intn(16))
-                }
-                c.feedChan <- &Feedback {hostIndex: third_node, bucketIndex: i, adjust: third_reward}
-            } else {
-                ErrorLog.Printf("beansdb server : %s in Bucket %X's third node Down while try_reward, the err = %s", c.hosts[third_node].Addr, i, err)
-            }
+        for _, i := range buckets {
+            c.feed(&Feedback{hostIndex: h, bucketIndex: i, latency: latency, err: err})
         }
     }
 }
 
 func (c *ManualScheduler) procFeedback() {
-    c.feedChan = make(chan *Feedback, 256)
     for {
-        fb := <-c.feedChan
-        c.feedback(fb.hostIndex, fb.bucketIndex, fb.adjust)
+        select {
+        case fb := <-c.feedChan:
+            c.feedback(fb.hostIndex, fb.bucketIndex, fb.latency, fb.err)
+        case <-c.stop:
+            return
+        }
     }
 }
 
-func (c *ManualScheduler) feedback(i, bucket_index int, adjust float64) {
+// feedback is dropped after closed
+func (c *ManualScheduler) feed(fb *Feedback) {
+    select {
+    case c.feedChan <- fb:
+    case <-c.stop:
+    }
+}
 
-    stats := c.stats[bucket_index]
-    old := stats[i]
-    stats[i] += adjust
+// update the score of the host, and move it among the primaries of the
+// bucket by the scores
+func (c *ManualScheduler) feedback(i, bucket_index int, latency time.Duration, err error) {
+    c.scoreLock.Lock()
+    defer c.scoreLock.Unlock()
+    now := time.Now()
+    scores := c.scores[bucket_index]
+    scores[i].observe(latency, err != nil, now)
 
-    // try to reduce the bucket's stats
-    if stats[i] > 100 {
-        for index := 0; index < len(stats); index++ {
-            stats[index] = stats[index] / 2
-        }
-    }
-    bucket := make([]int, c.N)
+    bucket := make([]int, len(c.buckets[bucket_index]))
     copy(bucket, c.buckets[bucket_index])
-
     k := 0
     // find the position
-    for k = 0; k < c.N; k++ {
+    for k = 0; k < len(bucket); k++ {
         if bucket[k] == i {
             break
         }
     }
-
-    if stats[i]-old > 0 {
-        for k > 0 && stats[bucket[k]] > stats[bucket[k-1]] {
-            swap(bucket, k, k-1)
-            k--
-        }
-    } else {
-        for k < c.N -1 && stats[bucket[k]] < stats[bucket[k+1]] {
-            swap(bucket, k, k+1)
-            k++
-        }
+    if k == len(bucket) {
+        return
+    }
+    moved := false
+    for k > 0 && better(&scores[bucket[k]], &scores[bucket[k-1]], now) {
+        swap(bucket, k, k-1)
+        k--
+        moved = true
+    }
+    for !moved && k < len(bucket)-1 && better(&scores[bucket[k+1]], &scores[bucket[k]], now) {
+        swap(bucket, k, k+1)
+        k++
     }
     // set it to origin
     c.buckets[bucket_index] = bucket
 }
 
+// the primaries of the bucket in the order of scores, feedback replaces
+// the slice instead of changing it
+func (c *ManualScheduler) bucketOrder(bucket int) []int {
+    c.scoreLock.Lock()
+    defer c.scoreLock.Unlock()
+    return c.buckets[bucket]
+}
+
 func (c *ManualScheduler) GetHostsByKey(key string) (hosts []*Host) {
     i := getBucketByKey(c.hashMethod, c.bucketWidth, key)
+    order := c.bucketOrder(i)
     hosts = make([]*Host, c.N + len(c.backups[i]))
-    for j, offset := range c.buckets[i] {
+    for j, offset := range order {
         hosts[j] = c.hosts[offset]
     }
+    if zone := localZone(); zone != "" {
+        c.preferLocal(hosts[:len(order)], i, zone)
+    }
     // set the backup nodes in pos after N - 1
     for j, offset := range c.backups[i] {
         hosts[c.N + j] = c.hosts[offset]
@@ -332,23 +363,131 @@ func (c *ManualScheduler) GetHostsByKey(key string) (hosts []*Host) {
     return
 }
 
+// move the primaries in the local zone ahead, keeping the order of scores,
+// those not healthy are not moved
+func (c *ManualScheduler) preferLocal(hosts []*Host, bucket int, zone string) {
+    local := make([]*Host, 0, len(hosts))
+    var others []*Host
+    for _, h := range hosts {
+        if h.Zone == zone && c.state(h, bucket) == HostHealthy {
+            local = append(local, h)
+        } else {
+            others = append(others, h)
+        }
+    }
+    copy(hosts, append(local, others...))
+}
+
+// SetMirror makes a backup of the bucket get the writes, before the
+// scheduler is used
+func (c *ManualScheduler) SetMirror(bucket int, addr string) error {
+    if bucket < 0 || bucket >= len(c.buckets) {
+        return fmt.Errorf("invalid bucket %X", bucket)
+    }
+    for _, offset := range c.backups[bucket] {
+        if c.hosts[offset].Addr == addr {
+            c.mirrors[bucket] = append(c.mirrors[bucket], offset)
+            return nil
+        }
+    }
+    return fmt.Errorf("%s is not a backup of bucket %X", addr, bucket)
+}
+
+func (c *ManualScheduler) GetMirrorsByKey(key string) []*Host {
+    i := getBucketByKey(c.hashMethod, c.bucketWidth, key)
+    if len(c.mirrors[i]) == 0 {
+        return nil
+    }
+    hosts := make([]*Host, len(c.mirrors[i]))
+    for j, offset := range c.mirrors[i] {
+        hosts[j] = c.hosts[offset]
+    }
+    return hosts
+}
+
+// SetHashMethod changes how keys are routed to buckets, call it before
+// the scheduler is used
+func (c *ManualScheduler) SetHashMethod(h HashMethod) {
+    c.hashMethod = h
+}
+
 func (c *ManualScheduler) DivideKeysByBucket(keys []string) [][]string {
     return fastdivideKeysByBucket(c.hashMethod, len(c.buckets), c.bucketWidth, keys)
 }
 
-func (c *ManualScheduler) Feedback(host *Host, key string, adjust float64) {
+func (c *ManualScheduler) BucketCount() int {
+    return len(c.buckets)
+}
+
+func (c *ManualScheduler) Hosts() []*Host {
+    return c.hosts
+}
+
+// hosts serving the bucket as primary, in the order of scores
+func (c *ManualScheduler) GetHostsByBucket(bucket int) []*Host {
+    order := c.bucketOrder(bucket)
+    hosts := make([]*Host, len(order))
+    for j, offset := range order {
+        hosts[j] = c.hosts[offset]
+    }
+    return hosts
+}
+
+type byAddr struct {
+    offsets []int
+    hosts   []*Host
+}
+
+func (s byAddr) Len() int           { return len(s.offsets) }
+func (s byAddr) Less(i, j int) bool { return s.hosts[s.offsets[i]].Addr < s.hosts[s.offsets[j]].Addr }
+func (s byAddr) Swap(i, j int)      { s.offsets[i], s.offsets[j] = s.offsets[j], s.offsets[i] }
+
+// GetPrimariesByKey returns the primaries of the key in a fixed order, the
+// same in all proxies of the config, whatever the scores and zones are
+func (c *ManualScheduler) GetPrimariesByKey(key string) []*Host {
+    order := c.primaries[getBucketByKey(c.hashMethod, c.bucketWidth, key)]
+    hosts := make([]*Host, len(order))
+    for j, offset := range order {
+        hosts[j] = c.hosts[offset]
+    }
+    return hosts
+}
+
+func (c *ManualScheduler) Feedback(host *Host, key string, latency time.Duration, err error) {
     index := getBucketByKey(c.hashMethod, c.bucketWidth, key)
-    c.feedChan <- &Feedback{hostIndex: host.offset, bucketIndex: index, adjust: adjust}
+    c.feed(&Feedback{hostIndex: host.offset, bucketIndex: index, latency: latency, err: err})
 }
 
+func (c *ManualScheduler) state(host *Host, bucket int) int {
+    c.scoreLock.Lock()
+    defer c.scoreLock.Unlock()
+    return c.scores[bucket][host.offset].stateAt(time.Now())
+}
+
+// Stats are the scores of hosts in buckets they serve, 0 for others
 func (c *ManualScheduler) Stats() map[string][]float64 {
     r := make(map[string][]float64, len(c.hosts))
+    for addr, scores := range c.HostScores() {
+        r[addr] = make([]float64, len(scores))
+        for i, s := range scores {
+            r[addr][i] = s.Score
+        }
+    }
+    return r
+}
+
+// HostScores of hosts in buckets they serve as primaries
+func (c *ManualScheduler) HostScores() map[string][]HostScore {
+    r := make(map[string][]HostScore, len(c.hosts))
     for _, h := range c.hosts {
-        r[h.Addr] = make([]float64, len(c.buckets))
+        r[h.Addr] = make([]HostScore, len(c.buckets))
     }
-    for i, st := range c.stats {
-        for j, w := range st {
-            r[c.hosts[j].Addr][i] = w
+    now := time.Now()
+    c.scoreLock.Lock()
+    defer c.scoreLock.Unlock()
+    for i, bucket := range c.buckets {
+        for _, j := range bucket {
+            r[c.hosts[j].Addr][i] = c.scores[i][j].export(now)
         }
     }
     return r
@@ -358,6 +497,8 @@ type Feedback struct {
     hostIndex   int
     bucketIndex int
     adjust      float64
+    latency     time.Duration
+    err         error
 }
 
 // route requests by auto discoved infomation, used in beansdb
@@ -389,8 +530,8 @@ func NewAutoScheduler(config []string, bs int) *AutoScheduler {
             c.stats[j][i] = 0
         }
     }
-    c.hashMethod = fnv1a1
-    c.bucketWidth = calBitWidth(c.n)
+    c.hashMethod = hashMethods[DefaultHashName]
+    c.bucketWidth = calBitWidth(bs)
     go c.procFeedback()
 
     c.check()
@@ -446,6 +587,12 @@ func divideKeysByBucket(hash_func HashMethod, bs int, keys []string) [][]string
 }
 
 
+// SetHashMethod changes how keys are routed to buckets, call it before
+// the scheduler is used
+func (c *AutoScheduler) SetHashMethod(h HashMethod) {
+    c.hashMethod = h
+}
+
 func (c *AutoScheduler) DivideKeysByBucket(keys []string) [][]string {
     return divideKeysByBucket(c.hashMethod, len(c.buckets), keys)
 }
@@ -491,7 +638,16 @@ func (c *AutoScheduler) procFeedback() {
     }
 }
 
-func (c *AutoScheduler) Feedback(host *Host, key string, adjust float64) {
+func (c *AutoScheduler) Feedback(host *Host, key string, latency time.Duration, err error) {
+    adjust := -5.0
+    if err == nil {
+        t := latency.Seconds()
+        adjust = 1 - math.Sqrt(t)*t
+    }
+    c.feedAdjust(host, key, adjust)
+}
+
+func (c *AutoScheduler) feedAdjust(host *Host, key string, adjust float64) {
     index := getBucketByKey(c.hashMethod, c.bucketWidth, key)
     i := c.hostIndex(host)
     if i < 0 {
@@ -561,7 +717,7 @@ func (c *AutoScheduler) listHost(host *Host, dir string) {
         vv := bytes.SplitN(line, []byte(" "), 3)
         cnt, _ := strconv.ParseFloat(string(vv[2]), 64)
         adjust := float64(math.Sqrt(cnt))
-        c.Feedback(host, dir+string(vv[0]), adjust)
+        c.feedAdjust(host, dir+string(vv[0]), adjust)
     }
 }
 
@@ -1,6 +1,10 @@
 package memcache
 
-import "testing"
+import (
+	"errors"
+	"testing"
+	"time"
+)
 
 type testCase struct {
 	key   string
@@ -35,24 +39,37 @@ func testScheduler(t *testing.T, schd Scheduler, cases []testCase, in_order bool
 	}
 }
 
-var mhosts = map[string][]int{
-	"host1": {0, 1},
-	"host2": {2, 3},
-	"host3": {1, 3},
+// keys of `@` are in the bucket of the hex after it
+var mhosts = map[string][]string{
+	"host1:7900": {"0", "1"},
+	"host2:7900": {"0", "2", "3"},
+	"host3:7900": {"1", "2", "3"},
 }
 
 var mtests = []testCase{
-	testCase{"1key1", []string{"host2", "host3"}},
-	testCase{"2key2", []string{"host1"}},
-	testCase{"3key3", []string{"host1"}},
-	testCase{"4key4", []string{"host1", "host3"}},
+	testCase{"@3key1", []string{"host2:7900", "host3:7900"}},
+	testCase{"@0key2", []string{"host1:7900", "host2:7900"}},
+	testCase{"@1key3", []string{"host1:7900", "host3:7900"}},
+	testCase{"@2key4", []string{"host2:7900", "host3:7900"}},
 }
 
 func TestManualScheduler(t *testing.T) {
-	schd := NewManualScheduler(mhosts)
+	schd := NewManualScheduler(mhosts, 16, 2)
+	defer schd.Close()
 	testScheduler(t, schd, mtests, false)
 }
 
+func TestManualSchedulerInvalidBuckets(t *testing.T) {
+	schd := NewManualScheduler(map[string][]string{"host1:7900": {"0", "-1", "2", "x", "-20"}}, 2, 1)
+	defer schd.Close()
+	if len(schd.buckets[0]) != 1 || len(schd.buckets[1]) != 0 {
+		t.Error("primaries", schd.buckets)
+	}
+	if len(schd.backups[0]) != 0 || len(schd.backups[1]) != 1 {
+		t.Error("backups", schd.backups)
+	}
+}
+
 func TestAutoScheduler(t *testing.T) {
 }
 
@@ -143,3 +160,107 @@ func TestConsistantHashScheduler(t *testing.T) {
 	schd := NewConsistantHashScheduler(chthosts, "md5")
 	testScheduler(t, schd, chtests, true)
 }
+
+func TestManualSchedulerHashMethod(t *testing.T) {
+	schd := NewManualScheduler(map[string][]string{"host1:7900": {"0", "1", "2", "3"}}, 16, 1)
+	defer schd.Close()
+	tag, _ := HashTag("{}")
+	h, _ := NewHashMethod("fnv1a", tag)
+	schd.SetHashMethod(h)
+	if b := schd.BucketOf("k{hello}"); b != getBucketByKey(fnv1a, 4, "hello") {
+		t.Error("bucket of tagged key", b)
+	}
+	// related keys are in one bucket for multi-gets
+	keys := []string{"a{1}", "b{1}", "c{1}", "d{1}"}
+	for _, ks := range schd.DivideKeysByBucket(keys) {
+		if len(ks) != 0 && len(ks) != len(keys) {
+			t.Error("keys divided", ks)
+		}
+	}
+	// listings are routed by the prefix
+	if b := schd.BucketOf("@3a"); b != 3 {
+		t.Error("bucket of listing", b)
+	}
+}
+
+var rhosts = map[string][]string{
+	"host1:7900": {},
+	"host2:7900": {},
+	"host3:7900": {"weight=2"},
+}
+
+func rendezvousBuckets(schd *RendezvousScheduler) []map[string]bool {
+	r := make([]map[string]bool, schd.BucketCount())
+	for b := range r {
+		r[b] = make(map[string]bool)
+		for _, h := range schd.GetHostsByBucket(b) {
+			r[b][h.Addr] = true
+		}
+	}
+	return r
+}
+
+func TestRendezvousScheduler(t *testing.T) {
+	schd := NewRendezvousScheduler(rhosts, 256, 2)
+	defer schd.Close()
+	counts := make(map[string]int)
+	for b, hosts := range rendezvousBuckets(schd) {
+		if len(hosts) != 2 {
+			t.Errorf("bucket %X: %v", b, hosts)
+		}
+		for addr := range hosts {
+			counts[addr]++
+		}
+	}
+	// the heavy host is in more buckets
+	if counts["host3:7900"] <= counts["host1:7900"] || counts["host3:7900"] <= counts["host2:7900"] {
+		t.Error("buckets of hosts", counts)
+	}
+	st := schd.Stats()
+	if len(st) != 3 || len(st["host1:7900"]) != 256 {
+		t.Error("stats", st)
+	}
+	testScheduler(t, schd, []testCase{
+		testCase{"@0a", []string{"host1:7900", "host3:7900"}},
+		testCase{"@ff", []string{"host2:7900", "host1:7900"}},
+	}, false)
+}
+
+func TestRendezvousSchedulerAddHost(t *testing.T) {
+	old := NewRendezvousScheduler(rhosts, 256, 2)
+	defer old.Close()
+	more := map[string][]string{"host4:7900": {}}
+	for addr, tokens := range rhosts {
+		more[addr] = tokens
+	}
+	schd := NewRendezvousScheduler(more, 256, 2)
+	defer schd.Close()
+
+	before, after := rendezvousBuckets(old), rendezvousBuckets(schd)
+	moved := 0
+	for b := range after {
+		for addr := range after[b] {
+			if !before[b][addr] {
+				moved++
+				if addr != "host4:7900" {
+					t.Errorf("bucket %X moved to %s", b, addr)
+				}
+			}
+		}
+	}
+	// host4 takes about 1/5 of the replicas
+	if moved < 256*2/5/2 || moved > 256*2/5*2 {
+		t.Error("moved replicas", moved)
+	}
+}
+
+func TestRendezvousSchedulerFeedback(t *testing.T) {
+	schd := NewRendezvousScheduler(rhosts, 16, 2)
+	defer schd.Close()
+	first := schd.GetHostsByBucket(0)
+	schd.feedback(first[0].offset, 0, time.Millisecond, errors.New("timeout"))
+	hosts := schd.GetHostsByBucket(0)
+	if hosts[0] != first[1] || hosts[1] != first[0] {
+		t.Error("reordered", first, hosts)
+	}
+}
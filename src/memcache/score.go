@@ -0,0 +1,117 @@
+/*
+ * scores of hosts in buckets: EWMAs of the latency and the error rate of
+ * requests, the error rate decays without requests. a host is healthy,
+ * suspect (errors or slow) or down (mostly errors), and goes ahead of the
+ * others in a better state, or in the same state when it is cheaper by the
+ * margin, so the order does not flap.
+ */
+
+package memcache
+
+import (
+    "math"
+    "time"
+)
+
+var ScoreAlpha = 0.2                           // weight of a new sample in the EWMAs
+var ScoreHalfLife = time.Second * 10           // the error rate halves without samples
+var ScoreErrorCost = 1000.0                    // milliseconds an error costs in scores
+var ScoreSlowLatency = time.Millisecond * 100 // latency of suspect hosts
+var ScoreSuspectRate = 0.1                     // error rate of suspect hosts
+var ScoreDownRate = 0.5                        // error rate of down hosts, until below suspect
+var ScoreMargin = 0.2                          // a host goes ahead if cheaper by it
+
+const (
+    HostHealthy = iota
+    HostSuspect
+    HostDown
+)
+
+var hostStates = []string{"healthy", "suspect", "down"}
+
+// the parameters of scoring, shown in the monitor
+type ScoreParams struct {
+    Alpha       float64
+    HalfLife    time.Duration
+    ErrorCost   float64
+    SlowLatency time.Duration
+    SuspectRate float64
+    DownRate    float64
+    Margin      float64
+}
+
+func CurrentScoreParams() ScoreParams {
+    return ScoreParams{ScoreAlpha, ScoreHalfLife, ScoreErrorCost, ScoreSlowLatency,
+        ScoreSuspectRate, ScoreDownRate, ScoreMargin}
+}
+
+// HostScore of a host in a bucket, the state is empty if it does not serve it
+type HostScore struct {
+    Score     float64 // the cost in milliseconds negated, higher is preferred
+    Latency   float64 // milliseconds
+    ErrorRate float64
+    State     string
+}
+
+type hostScore struct {
+    latency float64 // seconds
+    errors  float64
+    state   int
+    updated time.Time
+}
+
+// the error rate now
+func (s *hostScore) errorRate(now time.Time) float64 {
+    if s.updated.IsZero() || ScoreHalfLife <= 0 {
+        return s.errors
+    }
+    return s.errors * math.Pow(0.5, float64(now.Sub(s.updated))/float64(ScoreHalfLife))
+}
+
+func (s *hostScore) observe(latency time.Duration, failed bool, now time.Time) {
+    s.errors = s.errorRate(now)
+    if failed {
+        s.errors += ScoreAlpha * (1 - s.errors)
+    } else {
+        s.errors -= ScoreAlpha * s.errors
+        if s.updated.IsZero() || s.latency == 0 {
+            s.latency = latency.Seconds()
+        } else {
+            s.latency += ScoreAlpha * (latency.Seconds() - s.latency)
+        }
+    }
+    s.updated = now
+    s.state = s.stateAt(now)
+}
+
+func (s *hostScore) stateAt(now time.Time) int {
+    rate := s.errorRate(now)
+    switch {
+    case rate >= ScoreDownRate:
+        return HostDown
+    case s.state == HostDown && rate >= ScoreSuspectRate:
+        return HostDown
+    case rate >= ScoreSuspectRate || s.latency >= ScoreSlowLatency.Seconds():
+        return HostSuspect
+    }
+    return HostHealthy
+}
+
+// the expected cost of a request in milliseconds
+func (s *hostScore) cost(now time.Time) float64 {
+    return s.latency*1000 + s.errorRate(now)*ScoreErrorCost
+}
+
+// better is true if a should go ahead of b
+func better(a, b *hostScore, now time.Time) bool {
+    sa, sb := a.stateAt(now), b.stateAt(now)
+    if sa != sb {
+        return sa < sb
+    }
+    return a.cost(now) < b.cost(now)*(1-ScoreMargin)
+}
+
+func (s *hostScore) export(now time.Time) HostScore {
+    return HostScore{Score: -s.cost(now), Latency: s.latency * 1000, ErrorRate: s.errorRate(now),
+        State: hostStates[s.stateAt(now)]}
+}
@@ -0,0 +1,83 @@
+package memcache
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestHostScoreStates(t *testing.T) {
+    now := time.Now()
+    var s hostScore
+    s.observe(time.Millisecond, false, now)
+    if s.stateAt(now) != HostHealthy || s.latency != 0.001 {
+        t.Fatal("healthy", s)
+    }
+    s.observe(0, true, now)
+    if s.stateAt(now) != HostSuspect {
+        t.Error("suspect after an error", s)
+    }
+    for i := 0; i < 3; i++ {
+        s.observe(0, true, now)
+    }
+    if s.stateAt(now) != HostDown {
+        t.Error("down after errors", s)
+    }
+    // the error rate decays, and the host stays down until below suspect
+    later := now.Add(ScoreHalfLife)
+    if r := s.errorRate(later); r < 0.2 || r > 0.4 {
+        t.Error("decayed", r)
+    }
+    if s.stateAt(later) != HostDown {
+        t.Error("recovered too early", s.errorRate(later))
+    }
+    if st := s.stateAt(now.Add(ScoreHalfLife * 3)); st != HostHealthy {
+        t.Error("not recovered", st)
+    }
+
+    var slow hostScore
+    slow.observe(ScoreSlowLatency*2, false, now)
+    if slow.stateAt(now) != HostSuspect {
+        t.Error("slow host", slow)
+    }
+}
+
+func TestScoreFeedback(t *testing.T) {
+    config := map[string][]string{"h1:7900": {"0"}, "h2:7900": {"0"}, "h3:7900": {"0"}}
+    schd := NewManualScheduler(config, 1, 3)
+    defer schd.Close()
+    order := func() (r []string) {
+        for _, h := range schd.GetHostsByBucket(0) {
+            r = append(r, h.Addr)
+        }
+        return
+    }
+    for _, offset := range schd.buckets[0] {
+        schd.feedback(offset, 0, 10*time.Millisecond, nil)
+    }
+    first := order()
+
+    // a little faster is not enough to go ahead
+    last := schd.buckets[0][2]
+    schd.feedback(last, 0, 9*time.Millisecond, nil)
+    if o := order(); o[2] != first[2] {
+        t.Error("moved by noise", first, o)
+    }
+    for i := 0; i < 10; i++ {
+        schd.feedback(last, 0, time.Millisecond, nil)
+    }
+    if o := order(); o[0] != first[2] {
+        t.Error("the fastest is not first", first, o)
+    }
+
+    // failed hosts go behind
+    top := schd.buckets[0][0]
+    schd.feedback(top, 0, time.Millisecond, errors.New("timeout"))
+    if o := order(); o[2] != first[2] {
+        t.Error("the suspect is not last", o)
+    }
+    scores := schd.HostScores()
+    if s := scores[first[2]][0]; s.State != "suspect" || s.ErrorRate <= 0 || s.Score >= 0 {
+        t.Error("scores", s)
+    }
+}
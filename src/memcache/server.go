@@ -40,10 +40,42 @@ func (c *ServerConn) Shutdown() {
     c.closeAfterReply = true
 }
 
+func (c *ServerConn) logAccess(req *Request, resp *Response, hosts []string, err error, dt time.Duration) {
+    key := strings.Join(req.Keys, ":")
+    size := 0
+    switch req.Cmd {
+    case "get", "gets":
+        for _, v := range resp.items {
+            size += len(v.Body)
+        }
+    case "set", "add", "replace":
+        size = len(req.Item.Body)
+    }
+    if err != nil {
+        size = -1
+    }
+    if len(hosts) == 0 {
+        hosts = append(hosts, "NoWhere")
+    }
+    var hosts_str string
+    if req.Cmd == "get" && size == 0 {
+        hosts_str = fmt.Sprintf("FAILED with %s", strings.Join(hosts, ","))
+    } else {
+        hosts_str = fmt.Sprintf("from %s", strings.Join(hosts, ","))
+    }
+    AccessLog.Printf("%s %s %s %d %s %dms", c.RemoteAddr, req.Cmd, key, size, hosts_str, dt.Nanoseconds()/1e6)
+}
+
 func (c *ServerConn) Serve(store DistributeStorage, stats *Stats) (e error) {
     rbuf := bufio.NewReader(c.rwc)
     wbuf := bufio.NewWriter(c.rwc)
 
+    if magic, err := rbuf.Peek(1); err == nil && magic[0] == binaryReqMagic {
+        e = c.serveBinary(rbuf, wbuf, store, stats)
+        c.Close()
+        return
+    }
+
     req := new(Request)
     for {
         e = req.Read(rbuf)
@@ -58,7 +90,7 @@ func (c *ServerConn) Serve(store DistributeStorage, stats *Stats) (e error) {
             break
         }
         dt := time.Since(t)
-        if dt > SlowCmdTime {
+        if dt > slowCmdTime() {
             stats.UpdateStat("slow_cmd", 1)
         }
 
@@ -69,29 +101,7 @@ func (c *ServerConn) Serve(store DistributeStorage, stats *Stats) (e error) {
         }
 
         if AccessLog != nil {
-            key := strings.Join(req.Keys, ":")
-            size := 0
-            switch req.Cmd {
-            case "get", "gets":
-                for _, v := range resp.items {
-                    size += len(v.Body)
-                }
-            case "set", "add", "replace":
-                size = len(req.Item.Body)
-            }
-            if err != nil {
-                size = -1
-            }
-            if len(hosts) == 0 {
-                hosts = append(hosts, "NoWhere")
-            }
-            var hosts_str string
-            if req.Cmd == "get" && size == 0 {
-                hosts_str = fmt.Sprintf("FAILED with %s", strings.Join(hosts, ","))
-            } else {
-                hosts_str = fmt.Sprintf("from %s", strings.Join(hosts, ","))
-            }
-            AccessLog.Printf("%s %s %s %d %s %dms", c.RemoteAddr, req.Cmd, key, size, hosts_str, dt.Nanoseconds()/1e6)
+            c.logAccess(req, resp, hosts, err, dt)
         }
 
         req.Clear()
@@ -123,6 +133,10 @@ func NewServer(store DistributeStorage) *Server {
     return s
 }
 
+func (s *Server) Stats() *Stats {
+    return s.stats
+}
+
 func (s *Server) Listen(addr string) (e error) {
     s.addr = addr
     s.l, e = net.Listen("tcp", addr)
@@ -134,10 +148,10 @@ func (s *Server) Serve() (e error) {
         return errors.New("no listener")
     }
 
-    // trap signal
+    // trap signal, SIGHUP is left to reload the config
     sch := make(chan os.Signal, 10)
     signal.Notify(sch, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT,
-        syscall.SIGHUP, syscall.SIGSTOP, syscall.SIGQUIT)
+        syscall.SIGSTOP, syscall.SIGQUIT)
     go func(ch <-chan os.Signal) {
         for {
             sig := <-ch
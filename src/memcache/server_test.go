@@ -6,19 +6,27 @@ import (
 	"time"
 )
 
+// a server of a map store, it is shut down at the end of the test
+func startTestServer(t *testing.T, addr string) *Server {
+	s := NewServer(mapDistStore{NewMapStore()})
+	if err := s.Listen(addr); err != nil {
+		t.Fatal("listen failed", addr, err)
+	}
+	go s.Serve()
+	return s
+}
+
 func TestServer(t *testing.T) {
-	s, _ := StartServer("localhost:11299")
-	time.Sleep(1e8)
-	client := NewClient(NewManualScheduler(map[string][]int{"localhost:11299": []int{0}}))
-	client.W = 1
+	s := startTestServer(t, "localhost:11293")
+	defer s.Shutdown()
+	client := NewClient(NewManualScheduler(map[string][]string{"localhost:11293": []string{"0"}}, 1, 1), 1, 1, 1)
 
-	testStore(t, client)
-	s.Shutdown()
+	testDistributeStore(t, client)
 }
 
 func TestShutdown(t *testing.T) {
-	addr := "localhost:11298"
-	s, _ := StartServer(addr)
+	addr := "localhost:11294"
+	s := startTestServer(t, addr)
 	go func() {
 		time.Sleep(1e8)
 		s.Shutdown()
@@ -4,6 +4,7 @@ import (
     "cmem"
     "os"
     "runtime"
+    "sync"
     "syscall"
     "time"
 )
@@ -17,6 +18,7 @@ type Stats struct {
     curr_connections, total_connections int64
     bytes_read, bytes_written           int64
     stat                                map[string]int64
+    lock                                sync.Mutex
 }
 
 func NewStats() *Stats {
@@ -27,6 +29,8 @@ func NewStats() *Stats {
 }
 
 func (s *Stats) UpdateStat(key string, value int64) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
     oldv, ok := s.stat[key]
     if !ok {
         oldv = 0
@@ -34,6 +38,23 @@ func (s *Stats) UpdateStat(key string, value int64) {
     s.stat[key] = oldv + value
 }
 
+// a copy of the counters updated by UpdateStat
+func (s *Stats) Counters() map[string]int64 {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    st := make(map[string]int64, len(s.stat))
+    for k, v := range s.stat {
+        st[k] = v
+    }
+    return st
+}
+
+// StatsReporter is implemented by storages which keep their own counters,
+// they are merged into the output of `stats`
+type StatsReporter interface {
+    Stats() map[string]int64
+}
+
 func mem_in_go(include_zero bool) runtime.MemProfileRecord {
     var p []runtime.MemProfileRecord
     n, ok := runtime.MemProfile(nil, include_zero)
@@ -72,7 +93,7 @@ func (s *Stats) Stats() map[string]int64 {
     st["total_connections"] = s.total_connections
     st["bytes_read"] = s.bytes_read
     st["bytes_written"] = s.bytes_written
-    for k, v := range s.stat {
+    for k, v := range s.Counters() {
         st[k] = v
     }
 
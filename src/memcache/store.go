@@ -18,8 +18,10 @@ type Storage interface {
 
 type DistributeStorage interface {
     Get(key string) (*Item, []string, error)
+    Gets(key string) (*Item, []string, error) // with cas token
     GetMulti(keys []string) (map[string]*Item, []string, error)
     Set(key string, item *Item, noreply bool) (bool, []string, error)
+    Cas(key string, item *Item, noreply bool) (string, []string, error) // STORED, EXISTS or NOT_FOUND
     Append(key string, value []byte) (bool, []string, error)
     Incr(key string, value int) (int, []string, error)
     Delete(key string) (bool, []string, error)
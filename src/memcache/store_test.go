@@ -25,7 +25,7 @@ func testDistributeStore(t *testing.T, dclient DistributeStorage) {
     } else {
         in_host := false
         for _, set_h := range hs {
-            if set_h == h {
+            if set_h == h[0] {
                 in_host = true
                 break
             }
@@ -51,7 +51,7 @@ func testDistributeStore(t *testing.T, dclient DistributeStorage) {
     } else {
         in_host := false
         for _, set_h := range hs {
-            if set_h == h {
+            if set_h == h[0] {
                 in_host = true
                 break
             }
@@ -61,11 +61,11 @@ func testDistributeStore(t *testing.T, dclient DistributeStorage) {
         }
     }
     // get_multi
-    items, hhs, _ := dclient.GetMulti([]string{"test", "test", "test2", "test3"})
+    items, hhs, _ := dclient.GetMulti([]string{key, key, key2, "test3"})
     if len(items) != 2 || len(hhs) == 0 {
 		t.Errorf("get_multi should return 2 values, but got %d", len(items))
     }
-    keys := make([]string, 102)
+    keys := make([]string, 100)
     for i := 0; i < 100; i++ {
         keys[i] = fmt.Sprintf("__t%d", i)
         dclient.Set(keys[i], &Item{Body: v}, true)
@@ -79,7 +79,7 @@ func testDistributeStore(t *testing.T, dclient DistributeStorage) {
 	if ok, hhs, _ := dclient.Set("test_large", &Item{Body: v, Flag: flag}, false);!ok || len(hhs) == 0 {
 		t.Errorf("set large value failed")
 	}
-    v2, _ = dclient.Get("test_large")
+    v2, _, _ = dclient.Get("test_large")
     if v2 == nil || !bytes.Equal(v, v2.Body) {
         t.Errorf("should return same large value")
     }
@@ -189,6 +189,24 @@ func testFailStore(t *testing.T, store Storage) {
 	}
 }
 
+func testFailDistributeStore(t *testing.T, store DistributeStorage) {
+	if _, _, err := store.Get("key"); err == nil {
+		t.Error("Get() should raise error")
+	}
+	if _, _, err := store.GetMulti([]string{"key"}); err == nil {
+		t.Error("GetMulti() should raise error")
+	}
+	if _, _, err := store.Set("key", &Item{}, false); err == nil {
+		t.Error("Set() should raise error")
+	}
+	if _, _, err := store.Append("key", nil); err == nil {
+		t.Error("Append() should raise error")
+	}
+	if _, _, err := store.Incr("key", 1); err == nil {
+		t.Error("Incr() should raise error")
+	}
+}
+
 func TestStore(t *testing.T) {
 	store := NewMapStore()
 	testStore(t, store)
@@ -0,0 +1,34 @@
+/*
+ * the scheduler and N/W/R of a client, which are swapped as a whole when
+ * the config is reloaded. a request loads it once, so it finishes on the
+ * old topology.
+ */
+
+package memcache
+
+import (
+    "sync/atomic"
+    "unsafe"
+)
+
+type topology struct {
+    scheduler Scheduler
+    N, W, R   int
+    repairer  *readRepairer // nil if the client does no read repair
+}
+
+func loadTopology(p *unsafe.Pointer) *topology {
+    return (*topology)(atomic.LoadPointer(p))
+}
+
+// swapTopology returns the old one
+func swapTopology(p *unsafe.Pointer, sch Scheduler, N, W, R int, repairer *readRepairer) *topology {
+    t := &topology{scheduler: sch, N: N, W: W, R: R, repairer: repairer}
+    return (*topology)(atomic.SwapPointer(p, unsafe.Pointer(t)))
+}
+
+// Closer is implemented by schedulers running goroutines, which are
+// stopped after being replaced
+type Closer interface {
+    Close()
+}
@@ -0,0 +1,69 @@
+/*
+ * settings which may be changed while requests are served, by the reload of
+ * the proxy. they are changed in SetTunables and read by the getters here,
+ * under the same lock.
+ */
+
+package memcache
+
+import (
+    "sync"
+    "time"
+)
+
+var tunablesLock sync.RWMutex
+
+// SetTunables runs f to change the settings, no request reads them meanwhile
+func SetTunables(f func()) {
+    tunablesLock.Lock()
+    defer tunablesLock.Unlock()
+    f()
+}
+
+func slowCmdTime() time.Duration {
+    tunablesLock.RLock()
+    defer tunablesLock.RUnlock()
+    return SlowCmdTime
+}
+
+func hedgePercentile() float64 {
+    tunablesLock.RLock()
+    defer tunablesLock.RUnlock()
+    return HedgePercentile
+}
+
+func hedgeBudget() float64 {
+    tunablesLock.RLock()
+    defer tunablesLock.RUnlock()
+    return HedgeBudget
+}
+
+func pipelineConns() int {
+    tunablesLock.RLock()
+    defer tunablesLock.RUnlock()
+    return PipelineConns
+}
+
+func localZone() string {
+    tunablesLock.RLock()
+    defer tunablesLock.RUnlock()
+    return LocalZone
+}
+
+func migrationThrottle() time.Duration {
+    tunablesLock.RLock()
+    defer tunablesLock.RUnlock()
+    return MigrationThrottle
+}
+
+func antiEntropyThrottle() time.Duration {
+    tunablesLock.RLock()
+    defer tunablesLock.RUnlock()
+    return AntiEntropyThrottle
+}
+
+func handoffMaxHints() int {
+    tunablesLock.RLock()
+    defer tunablesLock.RUnlock()
+    return HandoffMaxHints
+}
@@ -0,0 +1,95 @@
+package memcache
+
+import (
+    "io/ioutil"
+    "log"
+    "testing"
+    "time"
+)
+
+var zoneConfig = map[string][]string{
+    "a1:7900": {"0", "zone=a"},
+    "b1:7900": {"0", "zone=b"},
+    "a2:7900": {"0", "zone=a"},
+}
+
+func TestPreferLocalZone(t *testing.T) {
+    schd := NewManualScheduler(zoneConfig, 1, 3)
+    defer schd.Close()
+    // b1 has the best score
+    order := []string{"b1:7900", "a2:7900", "a1:7900"}
+    for i, addr := range order {
+        for _, h := range schd.hosts {
+            if h.Addr == addr {
+                schd.buckets[0][i] = h.offset
+            }
+        }
+    }
+
+    addrs := func() (r []string) {
+        for _, h := range schd.GetHostsByKey("key") {
+            r = append(r, h.Addr)
+        }
+        return
+    }
+    expect := func(expected ...string) {
+        got := addrs()
+        for i, addr := range expected {
+            if got[i] != addr {
+                t.Errorf("expected %v, got %v", expected, got)
+                return
+            }
+        }
+    }
+
+    defer func() { LocalZone = "" }()
+    expect("b1:7900", "a2:7900", "a1:7900")
+    LocalZone = "a"
+    expect("a2:7900", "a1:7900", "b1:7900")
+    LocalZone = "b"
+    expect("b1:7900", "a2:7900", "a1:7900")
+
+    // a local host which is not healthy is not preferred
+    LocalZone = "a"
+    for _, h := range schd.hosts {
+        if h.Addr == "a2:7900" {
+            schd.scores[0][h.offset] = hostScore{errors: 1, state: HostDown, updated: time.Now()}
+        }
+    }
+    expect("a1:7900", "b1:7900", "a2:7900")
+}
+
+func TestWriteOutsideLocalZone(t *testing.T) {
+    if ErrorLog == nil {
+        ErrorLog = log.New(ioutil.Discard, "", 0)
+    }
+    schd := NewManualScheduler(zoneConfig, 1, 3)
+    defer schd.Close()
+    c := NewClient(schd, 3, 2, 1)
+    defer func() { LocalZone = "" }()
+
+    write := func(zoneUp string) int {
+        suc, _ := c.write(c.topology(), "key", "set", func() {}, func(host *Host) (bool, error) {
+            return host.Zone == zoneUp || zoneUp == "", nil
+        })
+        return suc
+    }
+
+    LocalZone = "a"
+    if suc := write("a"); suc < 2 {
+        t.Error("acked only by the local zone", suc)
+    }
+    if n := c.Stats()["write_local_only"]; n != 1 {
+        t.Error("writes only in the local zone", n)
+    }
+    if suc := write(""); suc < 2 {
+        t.Error("write failed", suc)
+    }
+    if n := c.Stats()["write_local_only"]; n != 1 {
+        t.Error("writes outside of the local zone", n)
+    }
+    LocalZone = ""
+    if suc := write("a"); suc < 2 {
+        t.Error("zones are not required without local zone", suc)
+    }
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rules on the monitor stats, notified to webhooks and a local command
+//
+// types of rules:
+//   replicas:    a bucket has less than Threshold complete replicas
+//   unreachable: a server or proxy does not answer stats
+//   slow:        slow commands are more than Threshold percent
+//   hit:         hit rate of gets is less than Threshold percent
+
+type AlertRule struct {
+	Name      string
+	Type      string
+	Threshold float64
+}
+
+type AlertConfig struct {
+	Rules    []AlertRule
+	Webhooks []string
+	Command  string
+	Interval int // seconds between evaluations
+	History  int // resolved alerts kept
+}
+
+type Alert struct {
+	Rule    string
+	Type    string
+	Target  string
+	Message string
+	Value   float64
+	Start   time.Time
+	End     time.Time // zero while firing
+}
+
+func (a *Alert) Firing() bool {
+	return a.End.IsZero()
+}
+
+func (a *Alert) key() string {
+	return a.Rule + "/" + a.Target
+}
+
+type AlertEngine struct {
+	sync.Mutex
+	conf    AlertConfig
+	firing  map[string]*Alert
+	history []*Alert
+	notify  func(status string, a *Alert)
+	stop    chan bool
+}
+
+func NewAlertEngine(conf AlertConfig) (*AlertEngine, error) {
+	for _, r := range conf.Rules {
+		switch r.Type {
+		case "replicas", "unreachable", "slow", "hit":
+		default:
+			return nil, fmt.Errorf("unknown type of alert rule %s: %s", r.Name, r.Type)
+		}
+		if r.Name == "" {
+			return nil, fmt.Errorf("alert rule of type %s without name", r.Type)
+		}
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = 10
+	}
+	if conf.History <= 0 {
+		conf.History = 1000
+	}
+	e := &AlertEngine{conf: conf, firing: make(map[string]*Alert), stop: make(chan bool)}
+	e.notify = e.send
+	return e, nil
+}
+
+func (e *AlertEngine) Run() {
+	ticker := time.NewTicker(time.Duration(e.conf.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			servers, proxies, _ := currentStats()
+			e.Evaluate(servers, proxies, time.Now())
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// Stop ends Run, it is called once when the engine is replaced
+func (e *AlertEngine) Stop() {
+	close(e.stop)
+}
+
+// Inherit takes the history and the firing alerts of the old engine, so
+// they are not notified again after reload. alerts of removed rules are
+// resolved silently.
+func (e *AlertEngine) Inherit(old *AlertEngine) {
+	if old == nil {
+		return
+	}
+	old.Lock()
+	defer old.Unlock()
+	e.Lock()
+	defer e.Unlock()
+	rules := make(map[string]string)
+	for _, r := range e.conf.Rules {
+		rules[r.Name] = r.Type
+	}
+	e.history = append(e.history, old.history...)
+	now := time.Now()
+	for k, a := range old.firing {
+		if rules[a.Rule] == a.Type {
+			e.firing[k] = a
+		} else {
+			a.End = now
+			e.history = append(e.history, a)
+		}
+	}
+	if len(e.history) > e.conf.History {
+		e.history = e.history[len(e.history)-e.conf.History:]
+	}
+}
+
+func (e *AlertEngine) check(r AlertRule, servers, proxies []map[string]interface{}) []*Alert {
+	var found []*Alert
+	add := func(target string, value float64, format string, args ...interface{}) {
+		found = append(found, &Alert{Rule: r.Name, Type: r.Type, Target: target,
+			Value: value, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if r.Type == "replicas" {
+		_, _, buckets := currentStats()
+		replicas, most := bucketReplicas(servers, len(buckets))
+		for i, n := range replicas {
+			// empty buckets are not counted
+			if most[i] > 0 && float64(n) < r.Threshold {
+				add(fmt.Sprintf("bucket %X", i), float64(n), "bucket %X has %d complete replicas", i, n)
+			}
+		}
+		return found
+	}
+
+	all := append(append([]map[string]interface{}{}, servers...), proxies...)
+	for _, st := range all {
+		if st == nil {
+			continue
+		}
+		name := st["name"].(string)
+		_, up := st["uptime"]
+		switch r.Type {
+		case "unreachable":
+			if !up {
+				add(name, 0, "%s is unreachable", name)
+			}
+		case "slow":
+			if v := toFloat(st["curr_slow"]); up && v > r.Threshold {
+				add(name, v, "%.0f%% of commands are slow in %s", v, name)
+			}
+		case "hit":
+			if v := toFloat(st["curr_hit"]); up && toFloat(st["curr_cmd_get"]) > 0 && v < r.Threshold {
+				add(name, v, "hit rate of %s is %.0f%%", name, v)
+			}
+		}
+	}
+	return found
+}
+
+// Evaluate notifies new alerts and resolved ones, firing alerts are not notified again
+func (e *AlertEngine) Evaluate(servers, proxies []map[string]interface{}, now time.Time) {
+	e.Lock()
+	defer e.Unlock()
+	current := make(map[string]*Alert)
+	for _, r := range e.conf.Rules {
+		for _, a := range e.check(r, servers, proxies) {
+			current[a.key()] = a
+		}
+	}
+	for k, a := range current {
+		if old, ok := e.firing[k]; ok {
+			old.Value = a.Value
+			old.Message = a.Message
+			continue
+		}
+		a.Start = now
+		e.firing[k] = a
+		e.notify("firing", a)
+	}
+	for k, a := range e.firing {
+		if _, ok := current[k]; ok {
+			continue
+		}
+		a.End = now
+		delete(e.firing, k)
+		e.history = append(e.history, a)
+		if len(e.history) > e.conf.History {
+			e.history = e.history[len(e.history)-e.conf.History:]
+		}
+		e.notify("resolved", a)
+	}
+}
+
+// Alerts returns the firing alerts and the resolved ones, newest first
+func (e *AlertEngine) Alerts() (firing, resolved []*Alert) {
+	e.Lock()
+	defer e.Unlock()
+	for _, a := range e.firing {
+		c := *a
+		firing = append(firing, &c)
+	}
+	for i := len(e.history) - 1; i >= 0; i-- {
+		c := *e.history[i]
+		resolved = append(resolved, &c)
+	}
+	sort.Sort(alertsByStart(firing))
+	return
+}
+
+type alertsByStart []*Alert
+
+func (l alertsByStart) Len() int {
+	return len(l)
+}
+
+func (l alertsByStart) Less(i, j int) bool {
+	return l[i].Start.After(l[j].Start)
+}
+
+func (l alertsByStart) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+type alertMessage struct {
+	Status string
+	*Alert
+}
+
+func (e *AlertEngine) send(status string, a *Alert) {
+	log.Printf("alert %s: %s", status, a.Message)
+	body, _ := json.Marshal(alertMessage{status, a})
+	for _, hook := range e.conf.Webhooks {
+		go func(hook string) {
+			client := &http.Client{Timeout: 5 * time.Second}
+			resp, err := client.Post(hook, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Print("send alert to webhook failed: ", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Print("send alert to webhook failed: ", resp.Status)
+			}
+		}(hook)
+	}
+	if e.conf.Command != "" {
+		go func() {
+			cmd := exec.Command(e.conf.Command)
+			cmd.Env = append(os.Environ(), "ALERT_STATUS="+status, "ALERT_RULE="+a.Rule,
+				"ALERT_TYPE="+a.Type, "ALERT_TARGET="+a.Target, "ALERT_MESSAGE="+a.Message)
+			cmd.Stdin = bytes.NewReader(body)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				log.Printf("run alert command failed: %s %s", err, out)
+			}
+		}()
+	}
+}
+
+var alerts *AlertEngine
+
+func AlertsStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := make(map[string]interface{})
+	if alerts := currentAlerts(); alerts != nil {
+		data["firing"], data["resolved"] = alerts.Alerts()
+	}
+	err := tmpls.ExecuteTemplate(w, "alerts.html", data)
+	if err != nil {
+		println("render", err.Error())
+	}
+}
+
+func APIAlerts(w http.ResponseWriter, req *http.Request) {
+	alerts := currentAlerts()
+	if alerts == nil {
+		writeJSONError(w, http.StatusNotFound, "alerts are not enabled")
+		return
+	}
+	firing, resolved := alerts.Alerts()
+	writeJSON(w, map[string]interface{}{"firing": firing, "resolved": resolved})
+}
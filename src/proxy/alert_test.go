@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlertEngine(t *testing.T) {
+	conf := AlertConfig{Rules: []AlertRule{
+		{Name: "replicas", Type: "replicas", Threshold: 3},
+		{Name: "down", Type: "unreachable"},
+		{Name: "slow", Type: "slow", Threshold: 5},
+		{Name: "hit", Type: "hit", Threshold: 50},
+	}}
+	e, err := NewAlertEngine(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket_stats = make([]string, 3)
+	defer func() { bucket_stats = nil }()
+	var sent []string
+	e.notify = func(status string, a *Alert) {
+		sent = append(sent, status+" "+a.key())
+	}
+
+	up := func(name string, buckets []uint64, slow, hit uint64) map[string]interface{} {
+		return map[string]interface{}{"name": name, "uptime": uint64(1), "buckets": buckets,
+			"curr_slow": slow, "curr_hit": hit, "curr_cmd_get": float32(10)}
+	}
+	servers := []map[string]interface{}{
+		up("a", []uint64{100, 100, 0}, 0, 90),
+		up("b", []uint64{100, 50, 0}, 10, 90),
+		up("c", []uint64{99, 100, 0}, 0, 20),
+		nil,
+	}
+	now := time.Now()
+	e.Evaluate(servers, nil, now)
+	expected := map[string]bool{"firing replicas/bucket 1": true, "firing slow/b": true, "firing hit/c": true}
+	if len(sent) != len(expected) {
+		t.Fatal("bad alerts", sent)
+	}
+	for _, s := range sent {
+		if !expected[s] {
+			t.Error("unexpected alert", s)
+		}
+	}
+
+	// no duplicated notifications
+	sent = nil
+	servers[3] = map[string]interface{}{"name": "d"}
+	e.Evaluate(servers, nil, now.Add(time.Second))
+	if len(sent) != 1 || sent[0] != "firing down/d" {
+		t.Error("bad alerts", sent)
+	}
+
+	sent = nil
+	servers[1] = up("b", []uint64{100, 100, 0}, 0, 90)
+	e.Evaluate(servers, nil, now.Add(2*time.Second))
+	if len(sent) != 2 {
+		t.Error("expect 2 resolved alerts", sent)
+	}
+	firing, resolved := e.Alerts()
+	if len(firing) != 2 || len(resolved) != 2 || resolved[0].Firing() || !firing[0].Firing() {
+		t.Error("bad alerts", firing, resolved)
+	}
+	if firing[0].Target != "d" {
+		t.Error("newest alert should be first", firing[0])
+	}
+
+	if _, err := NewAlertEngine(AlertConfig{Rules: []AlertRule{{Name: "x", Type: "unknown"}}}); err == nil {
+		t.Error("unknown type should fail")
+	}
+}
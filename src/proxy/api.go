@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	. "memcache"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// JSON API of the monitor, under /api/v1/
+
+const redacted = "REDACTED"
+
+var secretName = regexp.MustCompile(`(?i)(password|passwd|secret|token|credential)`)
+
+// webhooks may carry tokens in their paths or queries, and commands in
+// their arguments
+var opaqueName = regexp.MustCompile(`(?i)(webhook|command)`)
+
+type bucketLister interface {
+	BucketCount() int
+	GetHostsByBucket(bucket int) []*Host
+}
+
+type scoreReporter interface {
+	HostScores() map[string][]HostScore
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	body, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		body, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+	w.Write(body)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	body, _ := json.Marshal(map[string]string{"error": msg})
+	w.Write(body)
+}
+
+func APIServers(w http.ResponseWriter, req *http.Request) {
+	server_stats, _, _ := currentStats()
+	writeJSON(w, server_stats)
+}
+
+func APIProxies(w http.ResponseWriter, req *http.Request) {
+	_, proxy_stats, _ := currentStats()
+	writeJSON(w, proxy_stats)
+}
+
+func APIBuckets(w http.ResponseWriter, req *http.Request) {
+	server_stats, _, bucket_stats := currentStats()
+	buckets := make([]map[string]interface{}, len(bucket_stats))
+	for i, status := range bucket_stats {
+		records := make(map[string]uint64)
+		for _, st := range server_stats {
+			if st == nil || st["buckets"] == nil {
+				continue
+			}
+			if bs := st["buckets"].([]uint64); i < len(bs) {
+				records[st["name"].(string)] = bs[i]
+			}
+		}
+		if status == "" {
+			status = "ok"
+		}
+		buckets[i] = map[string]interface{}{
+			"bucket":  fmt.Sprintf("%x", i),
+			"status":  status,
+			"records": records,
+		}
+	}
+	writeJSON(w, map[string]interface{}{
+		"total_records": atomic.LoadUint64(&total_records),
+		"uniq_records":  atomic.LoadUint64(&uniq_records),
+		"buckets":       buckets,
+	})
+}
+
+func APIScheduler(w http.ResponseWriter, req *http.Request) {
+	schd := currentScheduler()
+	if schd == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "scheduler is not ready")
+		return
+	}
+	data := map[string]interface{}{"scores": schd.Stats()}
+	if l, ok := schd.(bucketLister); ok {
+		buckets := make([][]string, l.BucketCount())
+		for i := range buckets {
+			for _, h := range l.GetHostsByBucket(i) {
+				buckets[i] = append(buckets[i], h.Addr)
+			}
+		}
+		data["buckets"] = buckets
+	}
+	if r, ok := schd.(scoreReporter); ok {
+		data["states"] = r.HostScores()
+		data["params"] = CurrentScoreParams()
+	}
+	writeJSON(w, data)
+}
+
+func APIKey(w http.ResponseWriter, req *http.Request) {
+	r, err := inspectKey(req.FormValue("key"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, r)
+}
+
+// all the names, or points of a series in the span, like ?name=host:7900/qps&span=6h
+func APISeries(w http.ResponseWriter, req *http.Request) {
+	if series == nil {
+		writeJSONError(w, http.StatusNotFound, "series is not enabled")
+		return
+	}
+	name := req.FormValue("name")
+	if name == "" {
+		writeJSON(w, series.Names())
+		return
+	}
+	span, err := parseDuration(req.FormValue("span"))
+	if err != nil {
+		span = time.Hour
+	}
+	writeJSON(w, map[string]interface{}{"name": name, "points": series.Get(name, span)})
+}
+
+func APIConfig(w http.ResponseWriter, req *http.Request) {
+	body, err := json.Marshal(currentConfig())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var conf interface{}
+	json.Unmarshal(body, &conf)
+	writeJSON(w, redact(conf))
+}
+
+// redact hides values of fields named like secrets and passwords in URLs,
+// only the hosts of webhooks are left
+func redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range t {
+			if s, ok := vv.(string); ok && s != "" && secretName.MatchString(k) {
+				t[k] = redacted
+			} else if opaqueName.MatchString(k) {
+				t[k] = redactOpaque(vv)
+			} else {
+				t[k] = redact(vv)
+			}
+		}
+	case []interface{}:
+		for i, vv := range t {
+			t[i] = redact(vv)
+		}
+	case string:
+		return redactURL(t)
+	}
+	return v
+}
+
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	} else {
+		u.User = url.User(redacted)
+	}
+	return u.String()
+}
+
+func redactOpaque(v interface{}) interface{} {
+	switch t := v.(type) {
+	case []interface{}:
+		for i, vv := range t {
+			t[i] = redactOpaque(vv)
+		}
+	case string:
+		if t == "" {
+			return t
+		}
+		u, err := url.Parse(redactURL(t))
+		if err != nil || u.Host == "" {
+			return redacted
+		}
+		if u.Path != "" && u.Path != "/" {
+			u.Path = "/" + redacted
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = redacted
+		}
+		if u.Fragment != "" {
+			u.Fragment = redacted
+		}
+		u.RawPath = ""
+		return u.String()
+	}
+	return v
+}
+
+func registerAPI() {
+	http.Handle("/api/v1/servers", http.HandlerFunc(makeGzipHandler(APIServers)))
+	http.Handle("/api/v1/proxies", http.HandlerFunc(makeGzipHandler(APIProxies)))
+	http.Handle("/api/v1/buckets", http.HandlerFunc(makeGzipHandler(APIBuckets)))
+	http.Handle("/api/v1/scheduler", http.HandlerFunc(makeGzipHandler(APIScheduler)))
+	http.Handle("/api/v1/alerts", http.HandlerFunc(makeGzipHandler(APIAlerts)))
+	http.Handle("/api/v1/series", http.HandlerFunc(makeGzipHandler(APISeries)))
+	http.Handle("/api/v1/key", http.HandlerFunc(makeGzipHandler(APIKey)))
+	http.Handle("/api/v1/migrations", http.HandlerFunc(makeGzipHandler(APIMigrations)))
+	http.Handle("/api/v1/config", http.HandlerFunc(makeGzipHandler(APIConfig)))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "memcache"
+	"strconv"
+)
+
+// listBuckets counts records of n buckets in a node. a listing of `@` has 16
+// directories, more buckets are listed in `@0`, `@00` and so on.
+func listBuckets(h *Host, n int) ([]uint64, error) {
+	if n <= 0 {
+		return nil, errors.New("no buckets")
+	}
+	// 16^digits >= n
+	digits, dirs := 1, 16
+	for dirs < n {
+		digits++
+		dirs *= 16
+	}
+	bs := make([]uint64, n)
+	prefixes := dirs / 16
+	for p := 0; p < prefixes; p++ {
+		dir := "@"
+		if digits > 1 {
+			dir += fmt.Sprintf("%0*x", digits-1, p)
+		}
+		rs, err := h.Get(dir)
+		if err != nil {
+			return nil, err
+		}
+		if rs == nil {
+			continue
+		}
+		for _, line := range bytes.Split(rs.Body, []byte("\n")) {
+			vv := bytes.Fields(line)
+			if len(vv) != 3 || len(vv[0]) != 2 || vv[0][1] != '/' {
+				continue
+			}
+			d, err := strconv.ParseUint(string(vv[0][:1]), 16, 8)
+			if err != nil {
+				continue
+			}
+			cnt, _ := strconv.ParseUint(string(vv[2]), 10, 64)
+			// less buckets than directories are merged
+			bs[(p*16+int(d))*n/dirs] += cnt
+		}
+	}
+	return bs, nil
+}
+
+// servers having at least 98% of the most records in each bucket
+func bucketReplicas(servers []map[string]interface{}, n int) (replicas []int, most []uint64) {
+	replicas = make([]int, n)
+	most = make([]uint64, n)
+	for _, st := range servers {
+		if st == nil || st["buckets"] == nil {
+			continue
+		}
+		for i, c := range st["buckets"].([]uint64) {
+			if i < n && c > most[i] {
+				most[i] = c
+			}
+		}
+	}
+	for _, st := range servers {
+		if st == nil || st["buckets"] == nil {
+			continue
+		}
+		for i, c := range st["buckets"].([]uint64) {
+			if i < n && c > most[i]*98/100 {
+				replicas[i]++
+			}
+		}
+	}
+	return
+}
+
+// the matrix of records shows numbers of up to 16 buckets in a page,
+// more buckets are shown in a heat map, colored by the ratio to the most
+const matrixPageSize = 256
+
+type matrixCell struct {
+	Count uint64
+	Color string
+}
+
+type matrixRow struct {
+	Name   string
+	Status string
+	Cells  []matrixCell
+	Total  uint64
+}
+
+type matrixBucket struct {
+	Index  string
+	Status string
+}
+
+// the buckets shown in a page of the tables of buckets
+type bucketPage struct {
+	Heat               bool
+	Columns            int
+	Buckets            []matrixBucket
+	Page, Pages        int
+	First, Last        string
+	HasPrev, HasNext   bool
+	PrevPage, NextPage int
+	start, end         int
+}
+
+type matrix struct {
+	bucketPage
+	Rows []matrixRow
+}
+
+func heatColor(c, most uint64) string {
+	if most == 0 {
+		return "#FFFFFF"
+	}
+	// red for empty, green for complete
+	r := float64(c) / float64(most)
+	if r > 1 {
+		r = 1
+	}
+	return fmt.Sprintf("#%02X%02X40", int(255*(1-r)), int(64+160*r))
+}
+
+// up to 16 buckets are shown in one page, more in pages of a heat map
+func pageBuckets(status []string, page int) bucketPage {
+	n := len(status)
+	p := bucketPage{Heat: n > 16}
+	size := n
+	if p.Heat {
+		size = matrixPageSize
+	}
+	if size <= 0 {
+		return p
+	}
+	p.Pages = (n + size - 1) / size
+	if page < 0 || page >= p.Pages {
+		page = 0
+	}
+	p.Page = page
+	p.HasPrev, p.PrevPage = page > 0, page-1
+	p.HasNext, p.NextPage = page+1 < p.Pages, page+1
+	p.start, p.end = page*size, min((page+1)*size, n)
+
+	digits := len(fmt.Sprintf("%x", n-1))
+	for i := p.start; i < p.end; i++ {
+		p.Buckets = append(p.Buckets, matrixBucket{fmt.Sprintf("%0*X", digits, i), status[i]})
+	}
+	p.Columns = len(p.Buckets) + 2
+	if len(p.Buckets) > 0 {
+		p.First, p.Last = p.Buckets[0].Index, p.Buckets[len(p.Buckets)-1].Index
+	}
+	return p
+}
+
+func buildMatrix(servers []map[string]interface{}, status []string, page int) *matrix {
+	mx := &matrix{bucketPage: pageBuckets(status, page)}
+	n := len(status)
+	if mx.Pages == 0 {
+		return mx
+	}
+	start, end := mx.start, mx.end
+
+	_, most := bucketReplicas(servers, n)
+	for _, st := range servers {
+		if st == nil {
+			continue
+		}
+		row := matrixRow{Name: st["name"].(string)}
+		if s, ok := st["status"].(string); ok {
+			row.Status = s
+		}
+		if st["buckets"] != nil {
+			bs := st["buckets"].([]uint64)
+			row.Total = sum(bs)
+			for i := start; i < end && i < len(bs); i++ {
+				row.Cells = append(row.Cells, matrixCell{bs[i], heatColor(bs[i], most[i])})
+			}
+		}
+		mx.Rows = append(mx.Rows, row)
+	}
+	return mx
+}
+
+// the scheduler table shows the latency of servers in buckets, or the
+// stats of the scheduler without scores, in the same pages as the matrix
+type schedCell struct {
+	Text  string
+	Class string
+	Title string
+	Color string
+}
+
+type schedRow struct {
+	Name  string
+	Cells []schedCell
+}
+
+type schedTable struct {
+	bucketPage
+	Rows []schedRow
+}
+
+var stateColors = map[string]string{"healthy": "#40E040", "suspect": "#BFBF00", "down": "#FF0000"}
+
+func scoreCell(sc HostScore) (c schedCell) {
+	if sc.State == "" {
+		return
+	}
+	c.Text = fmt.Sprintf("%.1f", sc.Latency)
+	c.Title = fmt.Sprintf("%s, error rate %.2f", sc.State, sc.ErrorRate)
+	c.Color = stateColors[sc.State]
+	switch sc.State {
+	case "suspect":
+		c.Class = "warning"
+	case "down":
+		c.Class = "dangerous"
+	}
+	return
+}
+
+func buildSchedTable(names []string, stats map[string][]float64, scores map[string][]HostScore,
+	status []string, page int) *schedTable {
+	tb := &schedTable{bucketPage: pageBuckets(status, page)}
+	if tb.Pages == 0 {
+		return tb
+	}
+	most := 0.0
+	for _, name := range names {
+		for i, v := range stats[name] {
+			if i >= tb.start && i < tb.end && v > most {
+				most = v
+			}
+		}
+	}
+	for _, name := range names {
+		row := schedRow{Name: name}
+		for i := tb.start; i < tb.end; i++ {
+			var c schedCell
+			if scores != nil {
+				if i < len(scores[name]) {
+					c = scoreCell(scores[name][i])
+				}
+			} else if i < len(stats[name]) && stats[name][i] != 0 {
+				v := stats[name][i]
+				c.Text = sizer(v)
+				c.Title = c.Text
+				// blue for the most, lighter for less
+				light := 0
+				if v > 0 {
+					light = int(255 * (1 - v/most))
+				}
+				c.Color = fmt.Sprintf("#%02X%02XFF", light, light)
+			}
+			if c.Color == "" {
+				c.Color = "#FFFFFF"
+			}
+			row.Cells = append(row.Cells, c)
+		}
+		tb.Rows = append(tb.Rows, row)
+	}
+	return tb
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	. "memcache"
+	"net"
+	"strings"
+	"testing"
+)
+
+// a node answering listings of `@` with count of records = index of bucket
+func fakeNode(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					key := strings.Fields(line)[1]
+					prefix := key[1:]
+					body := ""
+					for d := 0; d < 16; d++ {
+						var index int
+						fmt.Sscanf(fmt.Sprintf("%s%x", prefix, d), "%x", &index)
+						body += fmt.Sprintf("%x/ 123 %d\n", d, index)
+					}
+					fmt.Fprintf(conn, "VALUE %s 0 %d\r\n%s\r\nEND\r\n", key, len(body), body)
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestListBuckets(t *testing.T) {
+	l := fakeNode(t)
+	defer l.Close()
+	h := NewHost(l.Addr().String())
+
+	for _, n := range []int{16, 256, 4096} {
+		bs, err := listBuckets(h, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bs) != n {
+			t.Fatalf("expect %d buckets, got %d", n, len(bs))
+		}
+		for i, c := range bs {
+			if c != uint64(i) {
+				t.Errorf("bucket %x of %d: %d", i, n, c)
+				break
+			}
+		}
+	}
+	// merged into less buckets
+	bs, err := listBuckets(h, 4)
+	if err != nil || len(bs) != 4 || bs[0] != 0+1+2+3 || bs[3] != 12+13+14+15 {
+		t.Error("bad merged buckets", bs, err)
+	}
+	// 32 buckets need 256 directories
+	bs, err = listBuckets(h, 32)
+	if err != nil || len(bs) != 32 || bs[1] != 8*8+(7*8/2) {
+		t.Error("bad 32 buckets", bs, err)
+	}
+}
+
+func TestBuildMatrix(t *testing.T) {
+	status := make([]string, 600)
+	bs := make([]uint64, 600)
+	bs[599] = 10
+	servers := []map[string]interface{}{
+		{"name": "a", "buckets": bs},
+		{"name": "b"},
+		nil,
+	}
+	mx := buildMatrix(servers, status, 2)
+	if !mx.Heat || mx.Pages != 3 || mx.Page != 2 || !mx.HasPrev || mx.HasNext {
+		t.Error("bad pages", mx)
+	}
+	if len(mx.Buckets) != 600-512 || mx.First != "200" || mx.Last != "257" {
+		t.Error("bad buckets", mx.First, mx.Last, len(mx.Buckets))
+	}
+	if len(mx.Rows) != 2 || len(mx.Rows[0].Cells) != 88 || mx.Rows[0].Total != 10 || len(mx.Rows[1].Cells) != 0 {
+		t.Error("bad rows", mx.Rows)
+	}
+
+	mx = buildMatrix(servers, status[:16], 5)
+	if mx.Heat || mx.Pages != 1 || mx.Page != 0 || len(mx.Buckets) != 16 || mx.Buckets[10].Index != "A" {
+		t.Error("bad small matrix", mx)
+	}
+}
+
+func TestBuildSchedTable(t *testing.T) {
+	status := make([]string, 300)
+	names := []string{"a", "b"}
+	scores := map[string][]HostScore{"a": make([]HostScore, 300)}
+	scores["a"][299] = HostScore{Latency: 1.5, State: "down"}
+	tb := buildSchedTable(names, nil, scores, status, 1)
+	if !tb.Heat || tb.Pages != 2 || tb.Page != 1 || tb.First != "100" || tb.Columns != 300-256+2 {
+		t.Error("bad pages", tb.bucketPage)
+	}
+	if len(tb.Rows) != 2 || len(tb.Rows[0].Cells) != 44 || len(tb.Rows[1].Cells) != 44 {
+		t.Fatal("bad rows", tb.Rows)
+	}
+	if c := tb.Rows[0].Cells[43]; c.Text != "1.5" || c.Class != "dangerous" || c.Color != stateColors["down"] {
+		t.Error("bad score cell", c)
+	}
+	if c := tb.Rows[1].Cells[0]; c.Text != "" || c.Color != "#FFFFFF" {
+		t.Error("cell of no score", c)
+	}
+
+	stats := map[string][]float64{"a": {0, 2048, 1024, 0}}
+	tb = buildSchedTable(names, stats, nil, status[:4], 0)
+	if tb.Heat || tb.Columns != 6 || len(tb.Buckets) != 4 || len(tb.Rows[0].Cells) != 4 {
+		t.Error("bad small table", tb)
+	}
+	if c := tb.Rows[0].Cells; c[0].Text != "" || c[1].Text != sizer(2048.0) || c[1].Color != "#0000FF" {
+		t.Error("bad stat cells", c)
+	}
+}
@@ -1,19 +1,320 @@
 package main
 
+import (
+	"fmt"
+	. "memcache"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 type Eye struct {
-	Servers   []string
-	Port      int
-	WebPort   int
-	Threads   int
-	N         int
-	W         int
-	R         int
-	Buckets   int
-	Slow      int
-	Listen    string
-	Proxies   []string
-	AccessLog string
-	ErrorLog  string
-	Basepath  string
-	Readonly  bool
+	Servers    []string
+	Port       int
+	WebPort    int
+	Threads    int
+	N          int
+	W          int
+	R          int
+	Buckets    int
+	Slow       int
+	Listen     string
+	Proxies    []string
+	AccessLog  string
+	ErrorLog   string
+	Basepath   string
+	Readonly   bool
+	Handoff    string
+	HandoffMax int    // most hints kept, the oldest are dropped beyond
+	Zone       string // zone of the proxy, servers set theirs by "zone=name"
+
+	AdminToken string // required by /admin/ as the X-Admin-Token header or the token field, or they are local only
+
+	Scheduler string // manual (default) by buckets, rendezvous or ketama by "weight=W" of servers
+	Hash      string // hash of keys: fnv1a1 (default), fnv1a, crc32 or md5 (default of ketama)
+	HashStrip string // prefix of keys removed before hashing
+	HashTag   string // chars like "{}", only the part of keys in them is hashed
+
+	AntiEntropy         int // seconds between scans, 0 to disable
+	AntiEntropyThrottle int // milliseconds between requests
+
+	HedgePercentile float64 // percent of get latency to hedge after
+	HedgeBudget     float64 // percent of extra gets allowed
+
+	Pipeline int // pipelined connections per backend, 0 to disable
+
+	MigrationFile     string // state of bucket migrations, kept across restarts
+	MigrationThrottle int    // milliseconds between copies of keys
+
+	Series     string // resolutions of stats history, like "10s:6h,1m:7d"
+	SeriesFile string // persist the history in the file
+
+	Alerts AlertConfig
+}
+
+// Validate checks the config with defaults set, all the problems are returned
+func (c *Eye) Validate() []error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if len(c.Servers) == 0 {
+		add("no servers")
+	}
+	ketama := c.Scheduler == "ketama"
+	weighted := ketama || c.Scheduler == "rendezvous"
+	if !weighted && c.Scheduler != "manual" {
+		add("unknown scheduler %q, should be manual, rendezvous or ketama", c.Scheduler)
+	}
+	// buckets of servers are checked only if the number is valid
+	var primaries []int
+	if ketama {
+		// servers have weights instead of buckets
+	} else if c.Buckets <= 0 || c.Buckets&(c.Buckets-1) != 0 {
+		add("buckets should be a power of 2, got %d", c.Buckets)
+	} else {
+		primaries = make([]int, c.Buckets)
+	}
+	addrs := make(map[string]bool)
+	weights := make(map[string]float64)
+	zones := make(map[string]string)
+	primaryZones := make([]map[string]bool, len(primaries))
+	for _, server := range c.Servers {
+		fields := strings.Fields(server)
+		if len(fields) == 0 {
+			add("empty server entry")
+			continue
+		}
+		addr := fields[0]
+		if addrs[addr] {
+			add("server %s is listed more than once", addr)
+		}
+		addrs[addr] = true
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			add("server %s: %s", addr, err)
+		} else if !validPort(port) {
+			add("server %s: invalid port %s", addr, port)
+		}
+		if weighted {
+			zones[addr] = serverZone(fields)
+			weights[addr] = 1
+			for _, token := range fields[1:] {
+				if isWeight(token) {
+					w, _ := strconv.Atoi(token[len("weight="):])
+					weights[addr] = float64(w)
+				} else if !isZone(token) {
+					add("server %s: %s is not a weight like weight=2", addr, token)
+				}
+			}
+			continue
+		}
+		if len(primaries) == 0 {
+			continue
+		}
+		zone := serverZone(fields)
+		zones[addr] = zone
+		for _, b := range fields[1:] {
+			if isZone(b) {
+				continue
+			}
+			n, backup, err := parseBucket(b, c.Buckets)
+			if err != nil {
+				add("server %s: %s", addr, err)
+			} else if !backup {
+				primaries[n]++
+				if primaryZones[n] == nil {
+					primaryZones[n] = make(map[string]bool)
+				}
+				primaryZones[n][zone] = true
+			}
+		}
+	}
+
+	if c.N < 1 {
+		add("n should be at least 1, got %d", c.N)
+	}
+	if c.W < 1 || c.W > c.N {
+		add("w should be between 1 and n=%d, got %d", c.N, c.W)
+	}
+	if c.R < 1 || c.R > c.N {
+		add("r should be between 1 and n=%d, got %d", c.N, c.R)
+	}
+	N, _, _ := replicas(c, len(addrs))
+	var lacking []string
+	for i, n := range primaries {
+		if n < N {
+			lacking = append(lacking, fmt.Sprintf("%X (%d)", i, n))
+		}
+	}
+	if len(lacking) > 0 && !weighted {
+		add("buckets with less than %d primaries: %s", N, strings.Join(lacking, ", "))
+	}
+	// the primaries of rendezvous are derived from the weights
+	if c.Scheduler == "rendezvous" && len(primaries) > 0 {
+		for addr, buckets := range RendezvousBuckets(weights, c.Buckets, N) {
+			for _, b := range buckets {
+				n, _ := strconv.ParseInt(b, 16, 32)
+				if primaryZones[n] == nil {
+					primaryZones[n] = make(map[string]bool)
+				}
+				primaryZones[n][zones[addr]] = true
+			}
+		}
+	}
+
+	errs = append(errs, validateZones(c, zones, primaryZones)...)
+
+	if _, err := hashMethod(c); err != nil {
+		add("%s", err)
+	} else if ketama && c.Hash != "md5" {
+		add("ketama clients hash keys by md5, not %s", c.Hash)
+	}
+	if c.AntiEntropy > 0 {
+		if ketama {
+			add("anti-entropy needs the manual scheduler")
+		} else if !serverHashing(c) {
+			add("anti-entropy lists buckets by the %s hash of servers, keys hashed otherwise are missed", DefaultHashName)
+		}
+	}
+
+	if !validPort(strconv.Itoa(c.Port)) {
+		add("invalid port %d", c.Port)
+	}
+	// webport 0 disables the monitor
+	if c.WebPort != 0 && !validPort(strconv.Itoa(c.WebPort)) {
+		add("invalid webport %d", c.WebPort)
+	}
+	if c.WebPort == c.Port {
+		add("port and webport are both %d", c.Port)
+	}
+
+	for _, path := range []string{c.AccessLog, c.ErrorLog, c.Handoff} {
+		if path == "" {
+			continue
+		}
+		if err := checkWritable(path); err != nil {
+			add("%s is not writable: %s", path, err)
+		}
+	}
+	if _, err := parseResolutions(c.Series); err != nil {
+		add("series: %s", err)
+	}
+	if _, err := NewAlertEngine(c.Alerts); err != nil {
+		add("alerts: %s", err)
+	}
+	return errs
+}
+
+// zones are optional, but all the servers have one if any does, and the
+// primaries of a bucket span zones if there are more than one
+func validateZones(c *Eye, zones map[string]string, primaryZones []map[string]bool) []error {
+	var errs []error
+	all := make(map[string]bool)
+	var unlabeled []string
+	for addr, zone := range zones {
+		if zone == "" {
+			unlabeled = append(unlabeled, addr)
+		} else {
+			all[zone] = true
+		}
+	}
+	if len(all) == 0 {
+		if c.Zone != "" {
+			errs = append(errs, fmt.Errorf("zone %s is set but servers have no zones", c.Zone))
+		}
+		return errs
+	}
+	if len(unlabeled) > 0 {
+		sort.Strings(unlabeled)
+		errs = append(errs, fmt.Errorf("servers without zone: %s", strings.Join(unlabeled, ", ")))
+	}
+	if c.Zone != "" && !all[c.Zone] {
+		errs = append(errs, fmt.Errorf("zone %s of the proxy has no servers", c.Zone))
+	}
+	if len(all) > 1 {
+		var single []string
+		for i, zs := range primaryZones {
+			if len(zs) == 1 {
+				for z := range zs {
+					single = append(single, fmt.Sprintf("%X (%s)", i, z))
+				}
+			}
+		}
+		if len(single) > 0 {
+			errs = append(errs, fmt.Errorf("buckets with all primaries in one zone: %s", strings.Join(single, ", ")))
+		}
+	}
+	return errs
+}
+
+func isZone(token string) bool {
+	return strings.HasPrefix(token, "zone=")
+}
+
+func serverZone(fields []string) string {
+	for _, f := range fields[1:] {
+		if isZone(f) {
+			return f[len("zone="):]
+		}
+	}
+	return ""
+}
+
+func isWeight(token string) bool {
+	w, err := strconv.Atoi(strings.TrimPrefix(token, "weight="))
+	return strings.HasPrefix(token, "weight=") && err == nil && w > 0
+}
+
+// the hash of keys in the scheduler, with the transforms of keys
+func hashMethod(c *Eye) (HashMethod, error) {
+	var transforms []KeyTransform
+	if c.HashStrip != "" {
+		transforms = append(transforms, StripPrefix(c.HashStrip))
+	}
+	if c.HashTag != "" {
+		tag, err := HashTag(c.HashTag)
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, tag)
+	}
+	return NewHashMethod(c.Hash, transforms...)
+}
+
+// keys are in the same buckets as in the `@` listings of servers
+func serverHashing(c *Eye) bool {
+	return c.Hash == DefaultHashName && c.HashStrip == "" && c.HashTag == ""
+}
+
+// the bucket is a hex number, starting with - for a backup
+func parseBucket(s string, buckets int) (bucket int, backup bool, err error) {
+	backup = strings.HasPrefix(s, "-")
+	n, e := strconv.ParseInt(strings.TrimPrefix(s, "-"), 16, 32)
+	if e != nil || n < 0 || int(n) >= buckets {
+		return 0, backup, fmt.Errorf("bucket %s is not a hex number in [0, %X]", s, buckets-1)
+	}
+	return int(n), backup, nil
+}
+
+func validPort(s string) bool {
+	p, err := strconv.Atoi(s)
+	return err == nil && p > 0 && p < 65536
+}
+
+// the file is opened for appending, or created and removed if missing
+func checkWritable(path string) error {
+	_, err := os.Stat(path)
+	missing := os.IsNotExist(err)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if missing {
+		os.Remove(path)
+	}
+	return nil
 }
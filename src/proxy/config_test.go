@@ -1,11 +1,13 @@
 package main
 
 import (
-	"fmt"
-	"github.com/douban/goyaml"
+	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
-    "os"
 )
 
 func Test_GetEyeConfig(t *testing.T) {
@@ -17,26 +19,125 @@ func Test_GetEyeConfig(t *testing.T) {
 		N:         3,
 		W:         2,
 		R:         1,
-        Buckets:   16,
-        Listen:    "0.0.0.0",
-        Slow:      200,
+		Buckets:   16,
+		Listen:    "0.0.0.0",
+		Slow:      200,
 		Proxies:   []string{"localhost:7905"},
 		AccessLog: "/log/beansproxy/beansproxy.log",
 		ErrorLog:  "/log/beansproxy/beansproxy_error.log",
 		Basepath:  "/var/lib/beanseye",
-        Readonly:  false,
+		Readonly:  false,
 	}
 
-    content1, _ := goyaml.Marshal(eye)
-    ioutil.WriteFile("./example.yaml", content1, os.ModePerm)
+	dir, _ := ioutil.TempDir("", "eye")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "example.yaml")
+	content1, err := yaml.Marshal(eye)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path, content1, 0644)
 
 	var new_eye Eye
-	content, _ := ioutil.ReadFile("./example.yaml")
+	content, _ := ioutil.ReadFile(path)
+	if err := yaml.Unmarshal(content, &new_eye); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(new_eye.Servers, eye.Servers) || new_eye.Port != eye.Port ||
+		new_eye.Buckets != eye.Buckets || new_eye.N != eye.N || new_eye.W != eye.W ||
+		new_eye.AccessLog != eye.AccessLog || !reflect.DeepEqual(new_eye.Proxies, eye.Proxies) {
+		t.Errorf("round trip: %v <> %v", new_eye, *eye)
+	}
+}
 
-	goyaml.Unmarshal(content, &new_eye)
-	fmt.Println("eye")
-	fmt.Println(*eye)
-	fmt.Println("new_eye")
-	fmt.Println(new_eye)
+func validConfig() *Eye {
+	c := &Eye{
+		Servers: []string{"a:7900 0 1 -2 -3", "b:7900 2 3 -0 -1", "c:7900 0 1 2 3"},
+		Port:    7905,
+		WebPort: 7908,
+		Buckets: 4,
+		N:       2,
+	}
+	setDefaults(c)
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	if errs := validConfig().Validate(); len(errs) != 0 {
+		t.Fatal("valid config", errs)
+	}
 
+	dir, _ := ioutil.TempDir("", "validate")
+	defer os.RemoveAll(dir)
+	cases := []struct {
+		change func(c *Eye)
+		err    string
+	}{
+		{func(c *Eye) { c.Buckets = 3 }, "power of 2"},
+		{func(c *Eye) { c.Servers[0] = "a:7900 0 1 4" }, "bucket 4 is not a hex number"},
+		{func(c *Eye) { c.Servers[0] = "a:7900 0 1 X" }, "bucket X is not a hex number"},
+		{func(c *Eye) { c.Servers[2] = "c:7900 0 1" }, "less than 2 primaries: 2 (1), 3 (1)"},
+		{func(c *Eye) { c.Servers = append(c.Servers, "a:7900") }, "more than once"},
+		{func(c *Eye) { c.Servers[2] = "c 0 1 2 3" }, "missing port"},
+		{func(c *Eye) { c.Servers[2] = "c:0 0 1 2 3" }, "invalid port 0"},
+		{func(c *Eye) { c.W = 3 }, "w should be between"},
+		{func(c *Eye) { c.Port = 70000 }, "invalid port 70000"},
+		{func(c *Eye) { c.WebPort = c.Port }, "port and webport"},
+		{func(c *Eye) { c.ErrorLog = filepath.Join(dir, "missing", "error.log") }, "not writable"},
+		{func(c *Eye) { c.Series = "1m" }, "series"},
+		{func(c *Eye) { c.Zone = "a" }, "servers have no zones"},
+		{func(c *Eye) { c.Servers[0] += " zone=a" }, "servers without zone: b:7900, c:7900"},
+		{func(c *Eye) {
+			c.Servers = []string{"a:7900 0 1 zone=a", "b:7900 0 1 2 3 zone=a", "c:7900 2 3 zone=b"}
+		}, "all primaries in one zone: 0 (a), 1 (a)"},
+		{func(c *Eye) {
+			c.Servers = []string{"a:7900 0 1 2 3 zone=a", "c:7900 0 1 2 3 zone=b"}
+			c.Zone = "c"
+		}, "zone c of the proxy has no servers"},
+		{func(c *Eye) { c.Hash = "sha1" }, "unknown hash method"},
+		{func(c *Eye) { c.HashTag = "{" }, "hash tag"},
+		{func(c *Eye) { c.HashTag = "{}"; c.AntiEntropy = 60 }, "anti-entropy"},
+		{func(c *Eye) { c.Scheduler = "random" }, "unknown scheduler"},
+		{func(c *Eye) {
+			c.Scheduler = "rendezvous"
+			c.Servers = []string{"a:7900 weight=2", "b:7900 weight=0"}
+		}, "weight=0 is not a weight"},
+		{func(c *Eye) {
+			c.Scheduler = "rendezvous"
+			c.Servers = []string{"a:7900 zone=a weight=100", "b:7900 zone=a weight=100", "c:7900 zone=b"}
+		}, "all primaries in one zone"},
+		{func(c *Eye) {
+			c.Scheduler, c.Hash = "ketama", "md5"
+			c.Servers = []string{"a:11211 weight=2", "b:11211 0"}
+		}, "0 is not a weight"},
+		{func(c *Eye) {
+			c.Scheduler = "ketama"
+			c.Servers = []string{"a:11211 weight=2", "b:11211"}
+		}, "ketama clients hash keys by md5"},
+	}
+	for _, cs := range cases {
+		c := validConfig()
+		cs.change(c)
+		errs := c.Validate()
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), cs.err) {
+			t.Errorf("expected %q, got %v", cs.err, errs)
+		}
+	}
+
+	c := validConfig()
+	c.Scheduler = "rendezvous"
+	c.Servers = []string{"a:7900 zone=a weight=2", "b:7900 zone=b", "c:7900 zone=b"}
+	c.N = 3
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Error("rendezvous across zones", errs)
+	}
+
+	c = validConfig()
+	c.AccessLog = filepath.Join(dir, "access.log")
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Error("writable log", errs)
+	}
+	if _, err := os.Stat(c.AccessLog); !os.IsNotExist(err) {
+		t.Error("checking log leaves the file")
+	}
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// the INI config, like conf/example.ini:
+//
+//   [default]  servers, server_port for bare hostnames, and shared settings
+//   [proxy]    port is the proxy port, and the settings of the proxy
+//   [monitor]  port is the web port, proxy is the list of proxies, and the
+//              settings of the monitor
+//
+// other keys are the fields of Eye, case and underscores ignored, lists are
+// separated by commas. any field can be set in [default], those of [proxy]
+// and [monitor] only in their own section.
+//
+// a server may be followed by its buckets, like "localhost:7900 0 1 -2".
+// if none of the servers has buckets, every server serves all the buckets,
+// 16 unless buckets is set.
+
+const defaultServerPort = 7900
+
+const defaultINIBuckets = 16
+
+var iniSections = map[string]bool{"default": true, "proxy": true, "monitor": true}
+
+// keys whose field depends on the section
+var iniAliases = map[string]string{
+	"proxy/port":    "Port",
+	"monitor/port":  "WebPort",
+	"monitor/proxy": "Proxies",
+}
+
+// fields which belong to a section other than [default]
+var iniFieldSections = map[string]string{
+	"Port": "proxy", "Threads": "proxy", "N": "proxy", "W": "proxy", "R": "proxy",
+	"Slow": "proxy", "Readonly": "proxy", "Handoff": "proxy", "HandoffMax": "proxy",
+	"Zone": "proxy", "HedgePercentile": "proxy", "HedgeBudget": "proxy", "Pipeline": "proxy",
+
+	"WebPort": "monitor", "Proxies": "monitor", "AdminToken": "monitor",
+	"AntiEntropy": "monitor", "AntiEntropyThrottle": "monitor",
+	"MigrationFile": "monitor", "MigrationThrottle": "monitor",
+	"Series": "monitor", "SeriesFile": "monitor",
+}
+
+func isINI(path string, content []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ini", ".conf", ".cfg":
+		return true
+	case ".yaml", ".yml", ".json":
+		return false
+	}
+	// the first line which is not a comment is a section
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := stripComment(scanner.Text())
+		if line != "" {
+			return strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]")
+		}
+	}
+	return false
+}
+
+// comments start with # or ;, at the beginning or after a space
+func stripComment(line string) string {
+	for i, c := range line {
+		if (c == '#' || c == ';') && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			line = line[:i]
+			break
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+func parseINI(content []byte) (*Eye, error) {
+	conf := new(Eye)
+	v := reflect.ValueOf(conf).Elem()
+	section := ""
+	serverPort := defaultServerPort
+	var servers []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for no := 1; scanner.Scan(); no++ {
+		line := stripComment(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if !iniSections[section] {
+				return nil, fmt.Errorf("line %d: unknown section [%s]", no, section)
+			}
+			continue
+		}
+		if section == "" {
+			return nil, fmt.Errorf("line %d: key outside of sections", no)
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: expect key=value", no)
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		value := strings.TrimSpace(kv[1])
+
+		switch key {
+		case "server_port":
+			p, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid server_port %s", no, value)
+			}
+			serverPort = p
+			continue
+		case "servers":
+			servers = splitList(value)
+			continue
+		}
+		name, ok := iniAliases[section+"/"+key]
+		if !ok {
+			name = iniField(v.Type(), key)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("line %d: unknown key %s in [%s]", no, key, section)
+		}
+		if s := iniFieldSections[name]; s != "" && section != "default" && section != s {
+			return nil, fmt.Errorf("line %d: %s belongs to [%s], not [%s]", no, key, s, section)
+		}
+		if err := setField(v.FieldByName(name), value); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %s", no, key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var bare []string
+	for _, server := range servers {
+		fields := strings.Fields(server)
+		if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+			host := strings.TrimSuffix(strings.TrimPrefix(fields[0], "["), "]")
+			fields[0] = net.JoinHostPort(host, strconv.Itoa(serverPort))
+		}
+		if len(fields) == 1 {
+			bare = append(bare, fields[0])
+		}
+		conf.Servers = append(conf.Servers, strings.Join(fields, " "))
+	}
+	// servers of weighted schedulers have no buckets
+	if len(bare) > 0 && (conf.Scheduler == "" || conf.Scheduler == "manual") {
+		if len(bare) < len(servers) {
+			return nil, fmt.Errorf("servers without buckets: %s, list buckets for all servers or none",
+				strings.Join(bare, ", "))
+		}
+		if conf.Buckets == 0 {
+			conf.Buckets = defaultINIBuckets
+		}
+		all := make([]string, conf.Buckets)
+		for b := range all {
+			all[b] = fmt.Sprintf("%X", b)
+		}
+		for i, server := range conf.Servers {
+			conf.Servers[i] = server + " " + strings.Join(all, " ")
+		}
+	}
+	return conf, nil
+}
+
+func iniField(t reflect.Type, key string) string {
+	key = strings.Replace(key, "_", "", -1)
+	for i := 0; i < t.NumField(); i++ {
+		if strings.ToLower(t.Field(i).Name) == key {
+			return t.Field(i).Name
+		}
+	}
+	return ""
+}
+
+func splitList(value string) []string {
+	var l []string
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			l = append(l, s)
+		}
+	}
+	return l
+}
+
+func setField(f reflect.Value, value string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number %s", value)
+		}
+		f.SetInt(int64(n))
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %s", value)
+		}
+		f.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid bool %s", value)
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		f.Set(reflect.ValueOf(splitList(value)))
+	default:
+		return fmt.Errorf("not supported in ini, use yaml")
+	}
+	return nil
+}
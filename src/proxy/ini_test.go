@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testINI = `
+# comment
+[default]
+server_port=7902  # default port
+servers=localhost 0 -1, 127.0.0.1:7901 1 -0,[::1] 0 1
+buckets=2
+access_log=/tmp/access.log
+
+[proxy]
+port=7905
+N=2
+readonly=true
+hedge_percentile=95
+
+[monitor]
+port = 7908
+proxy=localhost:7905,localhost:7906
+`
+
+func TestParseINI(t *testing.T) {
+	c, err := parseINI([]byte(testINI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Eye{
+		Servers:         []string{"localhost:7902 0 -1", "127.0.0.1:7901 1 -0", "[::1]:7902 0 1"},
+		Buckets:         2,
+		AccessLog:       "/tmp/access.log",
+		Port:            7905,
+		N:               2,
+		Readonly:        true,
+		HedgePercentile: 95,
+		WebPort:         7908,
+		Proxies:         []string{"localhost:7905", "localhost:7906"},
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected %+v, got %+v", expected, c)
+	}
+
+	invalid := []string{
+		"port=7905",
+		"[server]\nport=7905",
+		"[proxy]\nport",
+		"[proxy]\nport=x",
+		"[proxy]\nunknown=1",
+		"[default]\nalerts=x",
+		"[monitor]\nreadonly=true",
+		"[proxy]\nweb_port=7908",
+		"[default]\nservers=a 0 1,b",
+	}
+	for _, s := range invalid {
+		if _, err := parseINI([]byte(s)); err == nil {
+			t.Errorf("invalid ini accepted: %q", s)
+		}
+	}
+}
+
+func TestParseINIWithoutBuckets(t *testing.T) {
+	c, err := parseINI([]byte("[default]\nservers=localhost,localhost:7901\n[proxy]\nN=3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := " 0 1 2 3 4 5 6 7 8 9 A B C D E F"
+	if c.Buckets != 16 || !reflect.DeepEqual(c.Servers, []string{"localhost:7900" + all, "localhost:7901" + all}) {
+		t.Error("servers serve all buckets", c.Buckets, c.Servers)
+	}
+	setDefaults(c)
+	c.Port, c.WebPort = 7905, 7908
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Error("invalid config", errs)
+	}
+
+	c, err = parseINI([]byte("[default]\nservers=a,b\nbuckets=2"))
+	if err != nil || !reflect.DeepEqual(c.Servers, []string{"a:7900 0 1", "b:7900 0 1"}) {
+		t.Error("servers serve 2 buckets", c, err)
+	}
+	c, err = parseINI([]byte("[default]\nservers=a weight=2,b\nscheduler=rendezvous"))
+	if err != nil || !reflect.DeepEqual(c.Servers, []string{"a:7900 weight=2", "b:7900"}) {
+		t.Error("servers of rendezvous have no buckets", c, err)
+	}
+	if _, err = parseINI([]byte("[default]\nservers=a 0 1,b,c")); err == nil ||
+		!strings.Contains(err.Error(), "servers without buckets: b:7900, c:7900") {
+		t.Error("mixed servers", err)
+	}
+}
+
+func TestIsINI(t *testing.T) {
+	cases := []struct {
+		path    string
+		content string
+		ini     bool
+	}{
+		{"a.ini", "servers: []", true},
+		{"a.yaml", "[default]", false},
+		{"a", "# comment\n\n[default]\n", true},
+		{"a", "servers:\n- a:7900\n", false},
+		{"a", `{"servers": []}`, false},
+	}
+	for _, c := range cases {
+		if isINI(c.path, []byte(c.content)) != c.ini {
+			t.Errorf("%s %q: expected ini %v", c.path, c.content, c.ini)
+		}
+	}
+}
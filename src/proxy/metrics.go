@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"cmem"
+	"fmt"
+	. "memcache"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+var proxyServer *Server
+var proxyClient DistributeStorage
+
+// counters in Stats which may go down
+var gaugeStats = map[string]bool{
+	"curr_connections": true, "threads": true, "time": true, "uptime": true,
+	"pid": true, "rusage_user": true, "rusage_system": true,
+	"rusage_maxrss": true, "handoff_depth": true,
+}
+
+type hostLister interface {
+	Hosts() []*Host
+}
+
+func escapeLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func labels(kv ...string) string {
+	if len(kv) == 0 {
+		return ""
+	}
+	ls := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		ls = append(ls, fmt.Sprintf(`%s="%s"`, kv[i], escapeLabel(kv[i+1])))
+	}
+	return "{" + strings.Join(ls, ",") + "}"
+}
+
+func writeMetricHeader(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHostMetrics(w *bufio.Writer, hosts []*Host) {
+	name := "beanseye_backend_request_duration_seconds"
+	writeMetricHeader(w, name, "histogram", "Latency of requests to backends.")
+	for _, h := range hosts {
+		m := h.Metrics()
+		cnt := uint64(0)
+		for i, b := range LatencyBuckets {
+			cnt += m.Latency[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels("host", h.Addr, "le", fmt.Sprint(b.Seconds())), cnt)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels("host", h.Addr, "le", "+Inf"), m.Requests)
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, labels("host", h.Addr), m.Sum.Seconds())
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels("host", h.Addr), m.Requests)
+	}
+
+	name = "beanseye_backend_errors_total"
+	writeMetricHeader(w, name, "counter", "Failed requests to backends.")
+	for _, h := range hosts {
+		fmt.Fprintf(w, "%s%s %d\n", name, labels("host", h.Addr), h.Metrics().Errors)
+	}
+}
+
+func writeProxyMetrics(w *bufio.Writer, st map[string]int64) {
+	keys := make([]string, 0, len(st))
+	for k := range st {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := "beanseye_proxy_" + k
+		if gaugeStats[k] {
+			writeMetricHeader(w, name, "gauge", "Proxy stat "+k+".")
+		} else {
+			name += "_total"
+			writeMetricHeader(w, name, "counter", "Proxy stat "+k+".")
+		}
+		fmt.Fprintf(w, "%s %d\n", name, st[k])
+	}
+}
+
+func writeSchedulerMetrics(w *bufio.Writer, scores map[string][]float64) {
+	name := "beanseye_scheduler_score"
+	writeMetricHeader(w, name, "gauge", "Score of backends for each bucket in the scheduler, the expected cost of a request in milliseconds negated.")
+	hosts := make([]string, 0, len(scores))
+	for h := range scores {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		for b, s := range scores[h] {
+			fmt.Fprintf(w, "%s%s %g\n", name, labels("host", h, "bucket", fmt.Sprintf("%x", b)), s)
+		}
+	}
+}
+
+func writeBucketMetrics(w *bufio.Writer, stats []map[string]interface{}) {
+	name := "beanseye_bucket_records"
+	writeMetricHeader(w, name, "gauge", "Records in each bucket of backends.")
+	for _, st := range stats {
+		if st == nil || st["buckets"] == nil {
+			continue
+		}
+		for b, n := range st["buckets"].([]uint64) {
+			fmt.Fprintf(w, "%s%s %d\n", name, labels("server", st["name"].(string), "bucket", fmt.Sprintf("%x", b)), n)
+		}
+	}
+	writeMetricHeader(w, "beanseye_records", "gauge", "Records in all backends.")
+	fmt.Fprintf(w, "beanseye_records %d\n", atomic.LoadUint64(&total_records))
+	writeMetricHeader(w, "beanseye_uniq_records", "gauge", "Unique records in all backends.")
+	fmt.Fprintf(w, "beanseye_uniq_records %d\n", atomic.LoadUint64(&uniq_records))
+}
+
+func Metrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	if proxyServer != nil {
+		st := proxyServer.Stats().Stats()
+		if r, ok := proxyClient.(StatsReporter); ok {
+			for k, v := range r.Stats() {
+				st[k] = v
+			}
+		}
+		writeProxyMetrics(bw, st)
+	}
+	if schd := currentScheduler(); schd != nil {
+		if l, ok := schd.(hostLister); ok {
+			writeHostMetrics(bw, l.Hosts())
+		}
+		writeSchedulerMetrics(bw, schd.Stats())
+	}
+	server_stats, _, _ := currentStats()
+	writeBucketMetrics(bw, server_stats)
+
+	writeMetricHeader(bw, "beanseye_cmem_alloced_bytes", "gauge", "Memory allocated by cmem.")
+	fmt.Fprintf(bw, "beanseye_cmem_alloced_bytes %d\n", cmem.Alloced())
+}
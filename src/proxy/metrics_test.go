@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	. "memcache"
+	"strings"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeProxyMetrics(w, map[string]int64{"cmd_get": 3, "curr_connections": 2})
+	writeSchedulerMetrics(w, map[string][]float64{"a:7900": []float64{1.5, 0}})
+	writeHostMetrics(w, []*Host{NewHost("a:7900")})
+	w.Flush()
+	out := buf.String()
+
+	expected := []string{
+		"# TYPE beanseye_proxy_cmd_get_total counter\nbeanseye_proxy_cmd_get_total 3\n",
+		"# TYPE beanseye_proxy_curr_connections gauge\nbeanseye_proxy_curr_connections 2\n",
+		`beanseye_scheduler_score{host="a:7900",bucket="0"} 1.5` + "\n",
+		`beanseye_scheduler_score{host="a:7900",bucket="1"} 0` + "\n",
+		`beanseye_backend_request_duration_seconds_bucket{host="a:7900",le="+Inf"} 0` + "\n",
+		`beanseye_backend_errors_total{host="a:7900"} 0` + "\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("%q not in metrics:\n%s", e, out)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if l := labels("k", "a\"b\\c\n"); l != `{k="a\"b\\c\n"}` {
+		t.Error("bad labels", l)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	. "memcache"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// migrations of buckets change the layout of the config, they are started
+// from the monitor or the admin api, and saved in MigrationFile
+
+var migrator *Migrator
+
+func startMigrator(conf *Eye) {
+	if conf.Scheduler != "manual" {
+		log.Print("migrations are disabled: they need the manual scheduler")
+		return
+	}
+	if !serverHashing(conf) {
+		log.Print("migrations are disabled: keys are not hashed as in servers")
+		return
+	}
+	base, err := ParseLayout(conf.Servers, conf.Buckets)
+	if err != nil {
+		log.Print("migrations are disabled: ", err)
+		return
+	}
+	if migrator, err = NewMigrator(base, conf.MigrationFile, applyMigrations); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// the scheduler of the config, with the migrations applied and keys
+// hashed as configured
+func newScheduler(conf *Eye, N int) Scheduler {
+	h, err := hashMethod(conf)
+	if err != nil {
+		log.Print("use the default hash: ", err)
+		h, _ = NewHashMethod(DefaultHashName)
+	}
+	if conf.Scheduler == "ketama" {
+		server_configs, _ := parseServers(conf)
+		ketama := NewKetamaScheduler(server_configs, N)
+		ketama.SetHashMethod(h)
+		return ketama
+	}
+	if conf.Scheduler == "rendezvous" {
+		server_configs, _ := parseServers(conf)
+		rendezvous := NewRendezvousScheduler(server_configs, conf.Buckets, N)
+		rendezvous.SetHashMethod(h)
+		return rendezvous
+	}
+	if migrator == nil {
+		server_configs, _ := parseServers(conf)
+		manual := NewManualScheduler(server_configs, conf.Buckets, N)
+		manual.SetHashMethod(h)
+		return manual
+	}
+	l, mirrors := migrator.Layout()
+	server_configs := make(map[string][]string, len(l.Nodes))
+	for _, server := range l.Servers() {
+		fields := strings.Fields(server)
+		server_configs[fields[0]] = fields[1:]
+	}
+	manual := NewManualScheduler(server_configs, conf.Buckets, N)
+	manual.SetHashMethod(h)
+	for b, addrs := range mirrors {
+		for _, addr := range addrs {
+			if err := manual.SetMirror(b, addr); err != nil {
+				log.Print("set mirror failed: ", err)
+			}
+		}
+	}
+	return manual
+}
+
+func applyMigrations() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	_, servers := parseServers(&eyeconfig)
+	N, W, R := replicas(&eyeconfig, len(servers))
+	swapScheduler(newScheduler(&eyeconfig, N), N, W, R)
+}
+
+func Migrations(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := make(map[string]interface{})
+	if migrator != nil {
+		data["migrations"] = migrator.Migrations()
+	}
+	data["token"] = currentConfig().AdminToken != ""
+	err := tmpls.ExecuteTemplate(w, "migrations.html", data)
+	if err != nil {
+		println("render", err.Error())
+	}
+}
+
+type migrationStatus struct {
+	*Migration
+	Progress float64
+}
+
+func APIMigrations(w http.ResponseWriter, req *http.Request) {
+	if migrator == nil {
+		writeJSONError(w, http.StatusNotFound, "migrations are not enabled")
+		return
+	}
+	var r []migrationStatus
+	for _, mg := range migrator.Migrations() {
+		r = append(r, migrationStatus{mg, mg.Progress()})
+	}
+	writeJSON(w, r)
+}
+
+// AdminMigrate takes the action of start, cancel, retry or clear, with the
+// bucket in hex, from and to for start, or the id
+func AdminMigrate(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST to migrate")
+		return
+	}
+	if !checkAdmin(w, req) {
+		return
+	}
+	if migrator == nil {
+		writeJSONError(w, http.StatusNotFound, "migrations are not enabled")
+		return
+	}
+	back := req.FormValue("redirect")
+	if back != "" && !localPath(back) {
+		writeJSONError(w, http.StatusBadRequest, "redirect should be a path of the monitor")
+		return
+	}
+	var result interface{} = map[string]string{"status": "ok"}
+	var err error
+	id, _ := strconv.Atoi(req.FormValue("id"))
+	action := req.FormValue("action")
+	// keys are copied by the `@` listings of servers
+	if (action == "start" || action == "retry") && !serverHashing(currentConfig()) {
+		writeJSONError(w, http.StatusBadRequest, "keys are not hashed as in servers")
+		return
+	}
+	switch action {
+	case "start":
+		var bucket int64
+		bucket, err = strconv.ParseInt(req.FormValue("bucket"), 16, 32)
+		if err != nil {
+			err = fmt.Errorf("invalid bucket %q", req.FormValue("bucket"))
+			break
+		}
+		result, err = migrator.Start(int(bucket), req.FormValue("from"), req.FormValue("to"))
+	case "cancel":
+		err = migrator.Cancel(id)
+	case "retry":
+		err = migrator.Retry(id)
+	case "clear":
+		migrator.Clear()
+	default:
+		err = fmt.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// the forms of the monitor go back to the page
+	if back != "" {
+		http.Redirect(w, req, back, http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// a path in the monitor, not "//host" or "/\host" which browsers take
+// as other sites
+func localPath(s string) bool {
+	if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") || strings.HasPrefix(s, "/\\") {
+		return false
+	}
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "" && u.Host == "" && u.User == nil
+}
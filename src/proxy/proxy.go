@@ -5,9 +5,7 @@ import (
 	"compress/gzip"
 	"flag"
 	"fmt"
-	"gopkg.in/yaml.v2"
 	"io"
-	"io/ioutil"
 	"log"
 	"math"
 	. "memcache"
@@ -18,9 +16,9 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"text/template"
 	"time"
-	"sort"
 )
 
 var conf *string = flag.String("conf", "conf/example.yaml", "config path")
@@ -28,6 +26,8 @@ var conf *string = flag.String("conf", "conf/example.yaml", "config path")
 //var debug *bool = flag.Bool("debug", false, "debug info")
 var allocLimit *int = flag.Int("alloc", 1024*4, "cmem alloc limit")
 var basepath = flag.String("basepath", "", "base path")
+var check = flag.Bool("check", false, "check the config and exit")
+var dump = flag.Bool("dump-config", false, "print the effective config as yaml and exit")
 
 var eyeconfig Eye
 
@@ -163,7 +163,15 @@ var total_records, uniq_records uint64
 var bucket_stats []string
 var schd Scheduler
 
-func update_stats(servers []string, hosts []*Host, server_stats []map[string]interface{}, isNode bool) {
+func update_stats(gen int32, servers []string, hosts []*Host, server_stats []map[string]interface{},
+	bucket_stats []string, isNode bool) {
+	// replaced after reload
+	if atomic.LoadInt32(&monitorGen) != gen {
+		for _, h := range hosts {
+			h.Close()
+		}
+		return
+	}
 	if hosts == nil {
 		hosts = make([]*Host, len(servers))
 		for i, s := range servers {
@@ -173,7 +181,7 @@ func update_stats(servers []string, hosts []*Host, server_stats []map[string]int
 
 	// call self after 10 seconds
 	time.AfterFunc(time.Second*10, func() {
-		update_stats(servers, hosts, server_stats, isNode)
+		update_stats(gen, servers, hosts, server_stats, bucket_stats, isNode)
 	})
 
 	defer func() {
@@ -254,54 +262,26 @@ func update_stats(servers []string, hosts []*Host, server_stats []map[string]int
 		for _, k := range keys {
 			st["curr_"+k] = float32(st["curr_"+k].(uint64)) / dt
 		}
+		recordSeries(st, time.Now())
 
 		if isNode {
-			rs, err := h.Get("@")
-			if err != nil || rs == nil {
-				server_stats[i] = st
-				continue
-			}
-			bs := make([]uint64, 16)
-			for i, line := range bytes.SplitN(rs.Body, []byte("\n"), 17) {
-				if bytes.Count(line, []byte(" ")) < 2 || line[1] != '/' {
-					continue
-				}
-				vv := bytes.SplitN(line, []byte(" "), 3)
-				cnt, _ := strconv.ParseUint(string(vv[2]), 10, 64)
-				bs[i] = cnt
+			if bs, err := listBuckets(h, len(bucket_stats)); err == nil {
+				st["buckets"] = bs
 			}
-			st["buckets"] = bs
 		}
 		server_stats[i] = st
 	}
 	if isNode {
 		total := uint64(0)
 		utotal := uint64(0)
-		cnt := make([]int, 16)
-		m := make([]uint64, 16)
-		for i := 0; i < 16; i++ {
-			for _, st := range server_stats {
-				if st == nil || st["buckets"] == nil {
-					continue
-				}
-				n := st["buckets"].([]uint64)[i]
-				total += n
-				if n > m[i] {
-					m[i] = n
-				}
-			}
-			utotal += m[i]
-			for _, st := range server_stats {
-				if st == nil || st["buckets"] == nil {
-					continue
-				}
-				n := st["buckets"].([]uint64)[i]
-				if n > m[i]*98/100 {
-					cnt[i] += 1
-				}
+		cnt, m := bucketReplicas(server_stats, len(bucket_stats))
+		for _, st := range server_stats {
+			if st != nil && st["buckets"] != nil {
+				total += sum(st["buckets"])
 			}
 		}
-		for i := 0; i < 16; i++ {
+		for i := range bucket_stats {
+			utotal += m[i]
 			switch cnt[i] {
 			case 2:
 				bucket_stats[i] = "warning"
@@ -309,6 +289,8 @@ func update_stats(servers []string, hosts []*Host, server_stats []map[string]int
 				bucket_stats[i] = "dangerous"
 			case 0:
 				bucket_stats[i] = "invalid"
+			default:
+				bucket_stats[i] = ""
 			}
 		}
 		for _, st := range server_stats {
@@ -324,13 +306,13 @@ func update_stats(servers []string, hosts []*Host, server_stats []map[string]int
 					}
 					break
 				}
-				if c > 0 && c < m[i]-5 {
+				if c > 0 && c+5 < m[i] {
 					st["status"] = "warning"
 				}
 			}
 		}
-		total_records = total
-		uniq_records = utotal
+		atomic.StoreUint64(&total_records, total)
+		atomic.StoreUint64(&uniq_records, utotal)
 	}
 }
 
@@ -341,6 +323,7 @@ func Init(basepath string) {
 	funcs["size"] = sizer
 	funcs["num"] = number
 	funcs["time"] = timer
+	funcs["spark"] = spark
 
 	if !bytes.HasSuffix([]byte(basepath), []byte("/")) {
 		basepath = basepath + "/"
@@ -351,7 +334,9 @@ func Init(basepath string) {
 	tmpls = template.Must(tmpls.ParseFiles(basepath+"static/index.html",
 		basepath+"static/header.html", basepath+"static/info.html",
 		basepath+"static/matrix.html", basepath+"static/server.html",
-		basepath+"static/stats.html"))
+		basepath+"static/stats.html", basepath+"static/proxy.html",
+		basepath+"static/antientropy.html", basepath+"static/key.html",
+		basepath+"static/alerts.html", basepath+"static/migrations.html"))
 }
 
 func Status(w http.ResponseWriter, req *http.Request) {
@@ -375,22 +360,27 @@ func Status(w http.ResponseWriter, req *http.Request) {
 	data := make(map[string]interface{})
 	data["sections"] = sections
 	data["all_sections"] = all_sections
+	server_stats, proxy_stats, bucket_stats := currentStats()
 	data["server_stats"] = server_stats
 	data["proxy_stats"] = proxy_stats
 	data["bucket_stats"] = bucket_stats
-	data["total_records"] = total_records
-	data["uniq_records"] = uniq_records
+	page, _ := strconv.Atoi(req.FormValue("page"))
+	data["matrix"] = buildMatrix(server_stats, bucket_stats, page)
+	data["total_records"] = atomic.LoadUint64(&total_records)
+	data["uniq_records"] = atomic.LoadUint64(&uniq_records)
 
+	schd := currentScheduler()
 	st := schd.Stats()
-	stats := make([]map[string]interface{}, len(server_stats))
-	for i, _ := range stats {
-		d := make(map[string]interface{})
-		name := server_stats[i]["name"].(string)
-		d["name"] = name
-		d["stat"] = st[name]
-		stats[i] = d
+	var scores map[string][]HostScore
+	if r, ok := schd.(scoreReporter); ok {
+		scores = r.HostScores()
+		data["score_params"] = CurrentScoreParams()
+	}
+	names := make([]string, len(server_stats))
+	for i, _ := range names {
+		names[i] = server_stats[i]["name"].(string)
 	}
-	data["stats"] = stats
+	data["sched"] = buildSchedTable(names, st, scores, bucket_stats, page)
 
 	err := tmpls.ExecuteTemplate(w, "index.html", data)
 	if err != nil {
@@ -398,6 +388,102 @@ func Status(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+var antiEntropy *AntiEntropy
+
+func AntiEntropyStatus(w http.ResponseWriter, req *http.Request) {
+	if antiEntropy == nil {
+		http.Error(w, "anti-entropy is not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := make(map[string]interface{})
+	data["running"] = antiEntropy.Running()
+	data["report"] = antiEntropy.LastReport()
+	data["token"] = currentConfig().AdminToken != ""
+	err := tmpls.ExecuteTemplate(w, "antientropy.html", data)
+	if err != nil {
+		println("render", err.Error())
+	}
+}
+
+// AdminAntiEntropy starts a dry run, which scans the hash trees of all buckets
+func AdminAntiEntropy(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST to run anti-entropy")
+		return
+	}
+	if !checkAdmin(w, req) {
+		return
+	}
+	if antiEntropy == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "anti-entropy is not ready")
+		return
+	}
+	back := req.FormValue("redirect")
+	if back != "" && !localPath(back) {
+		writeJSONError(w, http.StatusBadRequest, "redirect should be a path of the monitor")
+		return
+	}
+	if antiEntropy.Running() {
+		writeJSONError(w, http.StatusConflict, "anti-entropy is running")
+		return
+	}
+	go antiEntropy.Run(true)
+	if back != "" {
+		http.Redirect(w, req, back, http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+type keyInspector interface {
+	InspectKey(key string) *KeyReport
+}
+
+func inspectKey(key string) (*KeyReport, error) {
+	if len(key) == 0 || len(key) > MaxKeyLength {
+		return nil, fmt.Errorf("invalid key: %q", key)
+	}
+	ki, ok := currentScheduler().(keyInspector)
+	if !ok {
+		return nil, fmt.Errorf("scheduler does not support key inspection")
+	}
+	return ki.InspectKey(key), nil
+}
+
+func KeyInspector(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	key := req.FormValue("key")
+	data := make(map[string]interface{})
+	data["key"] = key
+	if len(key) > 0 {
+		if r, err := inspectKey(key); err != nil {
+			data["error"] = err.Error()
+		} else {
+			data["report"] = r
+		}
+	}
+	err := tmpls.ExecuteTemplate(w, "key.html", data)
+	if err != nil {
+		println("render", err.Error())
+	}
+}
+
+func Chart(w http.ResponseWriter, req *http.Request) {
+	if series == nil {
+		http.Error(w, "series is not enabled", http.StatusNotFound)
+		return
+	}
+	name := req.FormValue("name")
+	span, err := parseDuration(req.FormValue("span"))
+	if err != nil {
+		span = time.Hour * 6
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	io.WriteString(w, chartSVG(name, series.Get(name, span), 800, 240))
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -407,17 +493,20 @@ func min(a, b int) int {
 
 func main() {
 	flag.Parse()
-	//c, err := config.ReadDefault(*conf)
-	content, err := ioutil.ReadFile(*conf)
-	if err != nil {
-		log.Fatal("read config failed", *conf, err.Error())
+	if *check {
+		os.Exit(checkConfig(*conf))
 	}
-
-	if err := yaml.Unmarshal(content, &eyeconfig); err != nil {
-		log.Fatal("unmarshal yaml format config failed")
+	if *dump {
+		os.Exit(dumpConfig(*conf))
 	}
+	c, err := loadConfig(*conf)
+	if err != nil {
+		log.Fatal("read config failed ", *conf, ": ", err.Error())
+	}
+	warnConfig(c)
+	eyeconfig = *c
 	if *basepath == "" {
-		if eyeconfig.Basepath == "" {
+		if c.Basepath == "" {
 			curr_path, err1 := os.Getwd()
 			if err1 != nil {
 				log.Fatal("Cannot get pwd")
@@ -425,50 +514,61 @@ func main() {
 			}
 			*basepath = curr_path
 		} else {
-			*basepath = eyeconfig.Basepath
+			*basepath = c.Basepath
 		}
 	}
 	Init(*basepath)
 
-	if eyeconfig.Threads > 0 {
-		runtime.GOMAXPROCS(eyeconfig.Threads)
+	if c.Threads > 0 {
+		runtime.GOMAXPROCS(c.Threads)
 	}
 
-	if len(eyeconfig.Servers) == 0 {
-		log.Fatal("no servers in conf")
-	}
-	server_configs := make(map[string][]string, len(eyeconfig.Servers))
-	for _, server := range eyeconfig.Servers {
-		fields := strings.Split(server, " ")
-		server_configs[fields[0]] = fields[1:]
-	}
-	servers := make([]string, 0, len(server_configs))
-	for server, _ := range server_configs {
-		servers = append(servers, server)
-	}
-	sort.Sort(sort.StringSlice(servers))
+	_, servers := parseServers(c)
 
-	if eyeconfig.WebPort <= 0 {
-		log.Print("error webport in conf: ", eyeconfig.WebPort)
-	} else if eyeconfig.Buckets <= 0 {
-		log.Print("error buckets in conf: ", eyeconfig.Buckets)
+	if c.WebPort <= 0 {
+		log.Print("error webport in conf: ", c.WebPort)
+	} else if c.Buckets <= 0 {
+		log.Print("error buckets in conf: ", c.Buckets)
 	} else {
-		server_stats = make([]map[string]interface{}, len(servers))
-		bucket_stats = make([]string, eyeconfig.Buckets)
-		go update_stats(servers, nil, server_stats, true)
+		resolutions, err := parseResolutions(c.Series)
+		if err != nil {
+			log.Fatal("invalid series in conf: ", err)
+		}
+		series = NewSeriesStore(resolutions, c.SeriesFile)
+		if err := series.Load(); err != nil {
+			log.Print("load series failed: ", err)
+		}
+		if c.SeriesFile != "" {
+			go series.SaveEvery(time.Minute)
+		}
 
-		if len(eyeconfig.Proxies) > 0 {
-			proxy_stats = make([]map[string]interface{}, len(eyeconfig.Proxies))
-			go update_stats(eyeconfig.Proxies, nil, proxy_stats, false)
+		if len(c.Alerts.Rules) > 0 {
+			e, err := NewAlertEngine(c.Alerts)
+			if err != nil {
+				log.Fatal("invalid alerts in conf: ", err)
+			}
+			configLock.Lock()
+			alerts = e
+			configLock.Unlock()
+			go e.Run()
 		}
 
+		startMonitor(servers, c.Proxies, c.Buckets)
+
 		http.Handle("/", http.HandlerFunc(makeGzipHandler(Status)))
+		http.Handle("/antientropy", http.HandlerFunc(makeGzipHandler(AntiEntropyStatus)))
+		http.Handle("/metrics", http.HandlerFunc(makeGzipHandler(Metrics)))
+		http.Handle("/alerts", http.HandlerFunc(makeGzipHandler(AlertsStatus)))
+		http.Handle("/chart", http.HandlerFunc(makeGzipHandler(Chart)))
+		http.Handle("/key", http.HandlerFunc(makeGzipHandler(KeyInspector)))
+		http.Handle("/migrations", http.HandlerFunc(makeGzipHandler(Migrations)))
+		http.Handle("/admin/reload", http.HandlerFunc(AdminReload))
+		http.Handle("/admin/migrate", http.HandlerFunc(AdminMigrate))
+		http.Handle("/admin/antientropy", http.HandlerFunc(AdminAntiEntropy))
+		registerAPI()
 		http.Handle("/static/", http.FileServer(http.Dir(*basepath)))
 		go func() {
-			if len(eyeconfig.Listen) == 0 {
-				eyeconfig.Listen = "0.0.0.0"
-			}
-			addr := fmt.Sprintf("%s:%d", eyeconfig.Listen, eyeconfig.WebPort)
+			addr := fmt.Sprintf("%s:%d", c.Listen, c.WebPort)
 			lt, e := net.Listen("tcp", addr)
 			if e != nil {
 				log.Println("monitor listen failed on ", addr, e)
@@ -482,66 +582,69 @@ func main() {
 
     var success bool
 
-	if len(eyeconfig.AccessLog) > 0 {
-        AccessLogPath = eyeconfig.AccessLog
-        if success, err = OpenAccessLog(eyeconfig.AccessLog); !success {
-            log.Fatalf("open AccessLog file in path: %s with error : %s", eyeconfig.AccessLog, err.Error())
+	if len(c.AccessLog) > 0 {
+        AccessLogPath = c.AccessLog
+        if success, err = OpenAccessLog(c.AccessLog); !success {
+            log.Fatalf("open AccessLog file in path: %s with error : %s", c.AccessLog, err.Error())
         }
 	}
 
-	if len(eyeconfig.ErrorLog) > 0 {
-        ErrorLogPath = eyeconfig.ErrorLog
-        if success, err = OpenErrorLog(eyeconfig.ErrorLog); !success {
-            log.Fatalf("open ErrorLog file in path: %s with error : %s", eyeconfig.ErrorLog, err.Error())
+	if len(c.ErrorLog) > 0 {
+        ErrorLogPath = c.ErrorLog
+        if success, err = OpenErrorLog(c.ErrorLog); !success {
+            log.Fatalf("open ErrorLog file in path: %s with error : %s", c.ErrorLog, err.Error())
         }
 	}
 
-	slow := eyeconfig.Slow
-	if slow == 0 {
-		slow = 100
-	}
-	SlowCmdTime = time.Duration(int64(slow) * 1e6)
+	applyTunables(c)
 
-	readonly := eyeconfig.Readonly
+	readonly := c.Readonly
+	N, W, R := replicas(c, len(servers))
 
-	n := len(servers)
-	if eyeconfig.N == 0 {
-		eyeconfig.N = 3
+	if !readonly {
+		startMigrator(c)
 	}
-	N := min(eyeconfig.N, n)
-
-	if eyeconfig.W == 0 {
-		eyeconfig.W = 2
-	}
-	W := min(eyeconfig.W, n-1)
+	//schd = NewAutoScheduler(servers, 16)
+	schd := newScheduler(c, N)
+	swapScheduler(schd, N, W, R)
 
-	if eyeconfig.R == 0 {
-		eyeconfig.R = 1
+	if manual := bucketScheduler(schd); manual != nil {
+		antiEntropy = NewAntiEntropy(manual)
+		if !readonly && c.AntiEntropy > 0 {
+			antiEntropy.Start(time.Duration(c.AntiEntropy) * time.Second)
+		}
 	}
-	R := eyeconfig.R
-
-	//schd = NewAutoScheduler(servers, 16)
-	schd = NewManualScheduler(server_configs, eyeconfig.Buckets, N)
 
 	var client DistributeStorage
 	if readonly {
 		client = NewRClient(schd, N, W, R)
 	} else {
-		client = NewClient(schd, N, W, R)
+		mc := NewClient(schd, N, W, R)
+		if len(c.Handoff) > 0 {
+			if err := mc.OpenHandoff(c.Handoff); err != nil {
+				log.Fatalf("open handoff journal in path: %s with error : %s", c.Handoff, err.Error())
+			}
+		}
+		client = mc
 	}
 
 	http.HandleFunc("/data", func(w http.ResponseWriter, req *http.Request) {
 	})
 
 	proxy := NewServer(client)
-	if eyeconfig.Port <= 0 {
-		log.Fatal("error proxy port in config it is ", eyeconfig.Port)
+	proxyServer, proxyClient = proxy, client
+	if c.Port <= 0 {
+		log.Fatal("error proxy port in config it is ", c.Port)
 	}
-	addr := fmt.Sprintf("%s:%d", eyeconfig.Listen, eyeconfig.Port)
+	addr := fmt.Sprintf("%s:%d", c.Listen, c.Port)
 	if e := proxy.Listen(addr); e != nil {
 		log.Fatal("proxy listen failed", e.Error())
 	}
 
+	go handleReloadSignal()
+	if migrator != nil {
+		go migrator.Run()
+	}
 	log.Println("proxy listen on ", addr)
 	proxy.Serve()
 	log.Print("shut down gracefully.")
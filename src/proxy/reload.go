@@ -0,0 +1,469 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	. "memcache"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// read the config, problems which break the scheduler are errors, others
+// are reported by Validate
+func loadConfig(path string) (*Eye, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf *Eye
+	if isINI(path, content) {
+		if conf, err = parseINI(content); err != nil {
+			return nil, fmt.Errorf("parse ini format config failed: %s", err)
+		}
+	} else {
+		conf = new(Eye)
+		if err := yaml.Unmarshal(content, conf); err != nil {
+			return nil, fmt.Errorf("unmarshal yaml format config failed: %s", err)
+		}
+	}
+	setDefaults(conf)
+	if len(conf.Servers) == 0 {
+		return nil, errors.New("no servers in conf")
+	}
+	for _, server := range conf.Servers {
+		if len(strings.Fields(server)) == 0 {
+			return nil, errors.New("empty server in conf")
+		}
+	}
+	if conf.Buckets > 0 && conf.Scheduler == "manual" {
+		for _, server := range conf.Servers {
+			fields := strings.Fields(server)
+			for _, b := range fields[1:] {
+				if isZone(b) {
+					continue
+				}
+				if _, _, err := parseBucket(b, conf.Buckets); err != nil {
+					return nil, fmt.Errorf("server %s: %s", fields[0], err)
+				}
+			}
+		}
+	}
+	if conf.Scheduler != "manual" && conf.Scheduler != "rendezvous" && conf.Scheduler != "ketama" {
+		return nil, fmt.Errorf("unknown scheduler %q", conf.Scheduler)
+	}
+	if _, err := hashMethod(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func warnConfig(c *Eye) {
+	for _, err := range c.Validate() {
+		log.Print("config: ", err)
+	}
+}
+
+// checkConfig prints the problems of the config, and returns the exit code
+func checkConfig(path string) int {
+	c, err := loadConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 1
+	}
+	errs := c.Validate()
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d problems found\n", path, len(errs))
+		return 1
+	}
+	fmt.Printf("%s: ok\n", path)
+	return 0
+}
+
+// dumpConfig prints the effective config as yaml
+func dumpConfig(path string) int {
+	c, err := loadConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 1
+	}
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 1
+	}
+	os.Stdout.Write(content)
+	return 0
+}
+
+func setDefaults(conf *Eye) {
+	if conf.N == 0 {
+		conf.N = 3
+	}
+	if conf.W == 0 {
+		conf.W = 2
+	}
+	if conf.R == 0 {
+		conf.R = 1
+	}
+	if conf.Slow == 0 {
+		conf.Slow = 100
+	}
+	if conf.Scheduler == "" {
+		conf.Scheduler = "manual"
+	}
+	if conf.Hash == "" && conf.Scheduler == "ketama" {
+		conf.Hash = "md5"
+	} else if conf.Hash == "" {
+		conf.Hash = DefaultHashName
+	}
+	if conf.Series == "" {
+		conf.Series = "10s:6h,1m:7d"
+	}
+	if len(conf.Listen) == 0 {
+		conf.Listen = "0.0.0.0"
+	}
+}
+
+// servers are sorted by address
+func parseServers(conf *Eye) (map[string][]string, []string) {
+	server_configs := make(map[string][]string, len(conf.Servers))
+	for _, server := range conf.Servers {
+		fields := strings.Fields(server)
+		server_configs[fields[0]] = fields[1:]
+	}
+	servers := make([]string, 0, len(server_configs))
+	for server, _ := range server_configs {
+		servers = append(servers, server)
+	}
+	sort.Sort(sort.StringSlice(servers))
+	return server_configs, servers
+}
+
+func replicas(conf *Eye, n int) (N, W, R int) {
+	return min(conf.N, n), min(conf.W, n-1), conf.R
+}
+
+// settings of package memcache which take effect without restart
+func applyTunables(conf *Eye) {
+	SetTunables(func() {
+		SlowCmdTime = time.Duration(int64(conf.Slow) * 1e6)
+		if conf.HedgePercentile > 0 {
+			HedgePercentile = conf.HedgePercentile / 100
+		}
+		if conf.HedgeBudget > 0 {
+			HedgeBudget = conf.HedgeBudget / 100
+		}
+		PipelineConns = conf.Pipeline
+		LocalZone = conf.Zone
+		if conf.MigrationThrottle > 0 {
+			MigrationThrottle = time.Duration(conf.MigrationThrottle) * time.Millisecond
+		}
+		if conf.HandoffMax > 0 {
+			HandoffMaxHints = conf.HandoffMax
+		}
+		if conf.AntiEntropyThrottle > 0 {
+			AntiEntropyThrottle = time.Duration(conf.AntiEntropyThrottle) * time.Millisecond
+		}
+	})
+}
+
+var monitorGen int32
+
+// (re)start collecting stats of servers and proxies, the old goroutines
+// stop at their next round, writing to the stats of their own
+func startMonitor(servers, proxies []string, buckets int) {
+	gen := atomic.AddInt32(&monitorGen, 1)
+	stats := make([]map[string]interface{}, len(servers))
+	bstats := make([]string, buckets)
+	var pstats []map[string]interface{}
+	if len(proxies) > 0 {
+		pstats = make([]map[string]interface{}, len(proxies))
+	}
+	configLock.Lock()
+	server_stats, proxy_stats, bucket_stats = stats, pstats, bstats
+	configLock.Unlock()
+
+	go update_stats(gen, servers, nil, stats, bstats, true)
+	if pstats != nil {
+		go update_stats(gen, proxies, nil, pstats, nil, false)
+	}
+}
+
+// configDiff describes the changed fields, items of lists are compared
+func configDiff(old, new *Eye) []string {
+	var diff []string
+	ov, nv := reflect.ValueOf(*old), reflect.ValueOf(*new)
+	for i := 0; i < ov.NumField(); i++ {
+		name := ov.Type().Field(i).Name
+		o, n := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if reflect.DeepEqual(o, n) {
+			continue
+		}
+		switch ol := o.(type) {
+		case []string:
+			nl := n.([]string)
+			for _, s := range ol {
+				if !contains(nl, s) {
+					diff = append(diff, fmt.Sprintf("%s: - %s", name, redactURL(s)))
+				}
+			}
+			for _, s := range nl {
+				if !contains(ol, s) {
+					diff = append(diff, fmt.Sprintf("%s: + %s", name, redactURL(s)))
+				}
+			}
+		case AlertConfig:
+			diff = append(diff, name+": changed")
+		case string:
+			if secretName.MatchString(name) {
+				diff = append(diff, name+": changed")
+			} else {
+				diff = append(diff, fmt.Sprintf("%s: %v -> %v", name, o, n))
+			}
+		default:
+			diff = append(diff, fmt.Sprintf("%s: %v -> %v", name, o, n))
+		}
+	}
+	return diff
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type reloader interface {
+	Reload(sch Scheduler, N, W, R int) Scheduler
+}
+
+var reloadLock sync.Mutex
+
+// the config, scheduler, alert engine and stats of the monitor are swapped
+// by reload under configLock, they are read by the functions below out of
+// reloadLock
+var configLock sync.RWMutex
+
+func currentConfig() *Eye {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	c := eyeconfig
+	return &c
+}
+
+func currentScheduler() Scheduler {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return schd
+}
+
+func currentAlerts() *AlertEngine {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return alerts
+}
+
+func currentStats() (servers, proxies []map[string]interface{}, buckets []string) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return server_stats, proxy_stats, bucket_stats
+}
+
+// reload swaps in the scheduler built from the config, settings of
+// listening and logs need restart
+func reload() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	nc, err := loadConfig(*conf)
+	if err != nil {
+		return err
+	}
+	// rejected as by -check, the old config is kept
+	if errs := nc.Validate(); len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = e.Error()
+		}
+		return fmt.Errorf("invalid config: %s", strings.Join(msgs, "; "))
+	}
+	if nc.Scheduler != eyeconfig.Scheduler {
+		return fmt.Errorf("changing the scheduler from %s to %s needs restart", eyeconfig.Scheduler, nc.Scheduler)
+	}
+	if nc.Buckets <= 0 && nc.Scheduler != "ketama" {
+		return fmt.Errorf("error buckets in conf: %d", nc.Buckets)
+	}
+	diff := configDiff(&eyeconfig, nc)
+	if len(diff) == 0 {
+		log.Print("reload config: nothing changed")
+		return nil
+	}
+	for _, d := range diff {
+		log.Print("reload config: ", d)
+	}
+	if nc.Port != eyeconfig.Port || nc.WebPort != eyeconfig.WebPort || nc.Listen != eyeconfig.Listen ||
+		nc.Readonly != eyeconfig.Readonly || nc.AccessLog != eyeconfig.AccessLog || nc.ErrorLog != eyeconfig.ErrorLog {
+		log.Print("reload config: changes of listening, readonly and logs need restart")
+	}
+
+	// alerts are evaluated by a new engine, which keeps the firing ones
+	alertsChanged := !reflect.DeepEqual(nc.Alerts, eyeconfig.Alerts)
+	var newAlerts *AlertEngine
+	if alertsChanged && len(nc.Alerts.Rules) > 0 {
+		if newAlerts, err = NewAlertEngine(nc.Alerts); err != nil {
+			return fmt.Errorf("invalid alerts: %s", err)
+		}
+		newAlerts.Inherit(currentAlerts())
+	}
+
+	var base *Layout
+	if migrator != nil {
+		if base, err = ParseLayout(nc.Servers, nc.Buckets); err != nil {
+			return err
+		}
+	}
+
+	// nothing fails from now on
+	_, servers := parseServers(nc)
+	N, W, R := replicas(nc, len(servers))
+	applyTunables(nc)
+	if migrator != nil {
+		migrator.SetBase(base)
+	}
+	swapScheduler(newScheduler(nc, N), N, W, R)
+
+	if !reflect.DeepEqual(nc.Servers, eyeconfig.Servers) || !reflect.DeepEqual(nc.Proxies, eyeconfig.Proxies) ||
+		nc.Buckets != eyeconfig.Buckets {
+		startMonitor(servers, nc.Proxies, nc.Buckets)
+	}
+	configLock.Lock()
+	oldAlerts := alerts
+	if alertsChanged {
+		alerts = newAlerts
+	}
+	eyeconfig = *nc
+	configLock.Unlock()
+	if alertsChanged {
+		if oldAlerts != nil {
+			oldAlerts.Stop()
+		}
+		if newAlerts != nil {
+			go newAlerts.Run()
+		}
+	}
+	return nil
+}
+
+// the scheduler by buckets, used by anti-entropy
+func bucketScheduler(sch Scheduler) *ManualScheduler {
+	switch s := sch.(type) {
+	case *ManualScheduler:
+		return s
+	case *RendezvousScheduler:
+		return s.ManualScheduler
+	}
+	return nil
+}
+
+// swapScheduler installs the scheduler to the client, the old one is closed
+func swapScheduler(sch Scheduler, N, W, R int) {
+	var old Scheduler
+	if r, ok := proxyClient.(reloader); ok {
+		old = r.Reload(sch, N, W, R)
+	}
+	configLock.Lock()
+	schd = sch
+	configLock.Unlock()
+	if manual := bucketScheduler(sch); manual != nil && antiEntropy != nil {
+		antiEntropy.SetScheduler(manual)
+	}
+	if closer, ok := old.(Closer); ok {
+		closer.Close()
+	}
+}
+
+func handleReloadSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for _ = range ch {
+		if err := reload(); err != nil {
+			log.Print("reload config failed: ", err)
+		}
+	}
+}
+
+// requests posted by pages of other sites are rejected, browsers send
+// the Origin or the Referer of them
+func sameOrigin(req *http.Request) bool {
+	from := req.Header.Get("Origin")
+	if from == "" {
+		from = req.Header.Get("Referer")
+	}
+	if from == "" {
+		return true
+	}
+	u, err := url.Parse(from)
+	return err == nil && u.Host == req.Host
+}
+
+// checkAdmin allows requests with the admin token, or from the loopback if
+// there is no token, others are answered with an error
+func checkAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if !sameOrigin(req) {
+		writeJSONError(w, http.StatusForbidden, "cross-site admin request")
+		return false
+	}
+	token := currentConfig().AdminToken
+	if token == "" {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			writeJSONError(w, http.StatusForbidden, "admin is local only without admintoken")
+			return false
+		}
+		return true
+	}
+	given := req.Header.Get("X-Admin-Token")
+	if given == "" {
+		given = req.FormValue("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+		return false
+	}
+	return true
+}
+
+func AdminReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST to reload")
+		return
+	}
+	if !checkAdmin(w, req) {
+		return
+	}
+	if err := reload(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, map[string]string{"status": "reloaded"})
+}
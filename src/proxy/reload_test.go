@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	. "memcache"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "conf.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{"servers": ["localhost:7900 0 1 -F"], "buckets": 16}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.N != 3 || c.W != 2 || c.R != 1 || c.Listen != "0.0.0.0" || c.Slow != 100 ||
+		c.Scheduler != "manual" || c.Hash != "fnv1a1" {
+		t.Error("defaults not set", c)
+	}
+
+	// servers of ketama have weights, and keys are hashed by md5
+	path = writeConfig(t, `{"servers": ["localhost:11211 weight=2", "localhost:11212"], "scheduler": "ketama"}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	if c, err = loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if c.Hash != "md5" {
+		t.Error("hash of ketama", c.Hash)
+	}
+	if _, ok := newScheduler(c, 2).(*KetamaScheduler); !ok {
+		t.Error("scheduler is not ketama")
+	}
+
+	// servers of rendezvous have weights, buckets are served by them
+	path = writeConfig(t, `{"servers": ["localhost:7900 weight=2", "localhost:7901"], "buckets": 16, "port": 7905, "webport": 7908, "scheduler": "rendezvous"}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	if c, err = loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Error("rendezvous config", errs)
+	}
+	if sch := bucketScheduler(newScheduler(c, 2)); sch == nil || len(sch.GetHostsByBucket(0)) != 2 {
+		t.Error("scheduler of rendezvous", sch)
+	}
+
+	invalid := []string{
+		`{"buckets": 16}`,
+		`{"servers": ["localhost:7900 0 10"], "buckets": 16}`,
+		`{"servers": ["localhost:7900 0 x"], "buckets": 16}`,
+		`{"servers": [" "], "buckets": 16}`,
+		`{"servers": ["localhost:7900 0"], "buckets": 16, "scheduler": "random"}`,
+	}
+	for _, content := range invalid {
+		path := writeConfig(t, content)
+		defer os.RemoveAll(filepath.Dir(path))
+		if _, err := loadConfig(path); err == nil {
+			t.Errorf("invalid config accepted: %q", content)
+		}
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	old := &Eye{Servers: []string{"a:7900 0", "b:7900 1"}, N: 3, Port: 7905}
+	new := &Eye{Servers: []string{"a:7900 0", "c:7900 1"}, N: 2, Port: 7905}
+	diff := configDiff(old, new)
+	expected := []string{"Servers: - b:7900 1", "Servers: + c:7900 1", "N: 3 -> 2"}
+	if len(diff) != len(expected) {
+		t.Fatal("diff", diff)
+	}
+	for i, e := range expected {
+		if diff[i] != e {
+			t.Errorf("diff %d: expected %s, got %s", i, e, diff[i])
+		}
+	}
+	if len(configDiff(old, old)) != 0 {
+		t.Error("diff of the same config")
+	}
+}
+
+func TestConfigDiffSecret(t *testing.T) {
+	diff := configDiff(&Eye{AdminToken: "old"}, &Eye{AdminToken: "new"})
+	if len(diff) != 1 || diff[0] != "AdminToken: changed" {
+		t.Error("token in diff", diff)
+	}
+}
+
+func TestReloadAlerts(t *testing.T) {
+	base := `{"servers": ["localhost:7900 0"], "buckets": 1, "n": 1, "w": 1, "port": 7905, "webport": 7908`
+	path := writeConfig(t, base+`}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConf, oldEye, oldSchd := *conf, eyeconfig, schd
+	defer func() {
+		*conf, eyeconfig, schd, alerts = oldConf, oldEye, oldSchd, nil
+	}()
+	*conf, eyeconfig = path, *c
+
+	rules := `, "alerts": {"rules": [{"name": "down", "type": "unreachable"}%s]}}`
+	ioutil.WriteFile(path, []byte(base+fmt.Sprintf(rules, "")), 0644)
+	if err := reload(); err != nil {
+		t.Fatal("reload", err)
+	}
+	first := currentAlerts()
+	if first == nil || len(first.conf.Rules) != 1 {
+		t.Fatal("alerts are not enabled by reload", first)
+	}
+	first.Evaluate([]map[string]interface{}{{"name": "localhost:7900"}}, nil, time.Now())
+
+	ioutil.WriteFile(path, []byte(base+fmt.Sprintf(rules, `, {"name": "slow", "type": "slow", "threshold": 10}`)), 0644)
+	if err := reload(); err != nil {
+		t.Fatal("reload", err)
+	}
+	second := currentAlerts()
+	if second == first || len(second.conf.Rules) != 2 {
+		t.Fatal("alerts are not rebuilt by reload", second)
+	}
+	if firing, _ := second.Alerts(); len(firing) != 1 {
+		t.Error("firing alerts should be kept", firing)
+	}
+	select {
+	case <-first.stop:
+	default:
+		t.Error("the old engine is not stopped")
+	}
+
+	ioutil.WriteFile(path, []byte(base+`, "alerts": {"rules": [{"name": "bad", "type": "unknown"}]}}`), 0644)
+	if err := reload(); err == nil || currentAlerts() != second {
+		t.Error("invalid alerts should fail the reload", err)
+	}
+
+	// rejected by -check, nothing is applied
+	before := currentScheduler()
+	ioutil.WriteFile(path, []byte(`{"servers": ["localhost:7900 0"], "buckets": 3, "port": 7905, "webport": 7908, "slow": 999}`), 0644)
+	if err := reload(); err == nil || !strings.Contains(err.Error(), "power of 2") {
+		t.Error("invalid config should fail the reload", err)
+	}
+	if currentScheduler() != before || currentConfig().Buckets != 1 || SlowCmdTime == 999*time.Millisecond {
+		t.Error("invalid config is applied")
+	}
+}
+
+func TestCheckAdmin(t *testing.T) {
+	old := eyeconfig
+	defer func() { eyeconfig = old }()
+	check := func(remote, token string) int {
+		req, _ := http.NewRequest("POST", "/admin/reload", nil)
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("X-Admin-Token", token)
+		}
+		w := httptest.NewRecorder()
+		if checkAdmin(w, req) {
+			return http.StatusOK
+		}
+		return w.Code
+	}
+
+	eyeconfig.AdminToken = ""
+	if code := check("127.0.0.1:4000", ""); code != http.StatusOK {
+		t.Error("local admin without token", code)
+	}
+	if code := check("10.0.0.1:4000", ""); code != http.StatusForbidden {
+		t.Error("remote admin without token", code)
+	}
+	eyeconfig.AdminToken = "s3cr3t"
+	if code := check("10.0.0.1:4000", "s3cr3t"); code != http.StatusOK {
+		t.Error("admin with token", code)
+	}
+	if code := check("127.0.0.1:4000", "wrong"); code != http.StatusUnauthorized {
+		t.Error("admin with wrong token", code)
+	}
+}
+
+func TestAdminCrossSite(t *testing.T) {
+	old := eyeconfig
+	defer func() { eyeconfig = old }()
+	eyeconfig.AdminToken = "s3cr3t"
+	for origin, ok := range map[string]bool{"": true, "http://monitor:7908": true, "http://evil.example": false} {
+		req, _ := http.NewRequest("POST", "http://monitor:7908/admin/migrate", nil)
+		req.Header.Set("X-Admin-Token", "s3cr3t")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if checkAdmin(httptest.NewRecorder(), req) != ok {
+			t.Errorf("admin request from %q should be allowed: %v", origin, ok)
+		}
+	}
+	req, _ := http.NewRequest("POST", "http://monitor:7908/admin/migrate", nil)
+	req.Header.Set("X-Admin-Token", "s3cr3t")
+	req.Header.Set("Referer", "http://evil.example/page")
+	if checkAdmin(httptest.NewRecorder(), req) {
+		t.Error("admin request referred by other site")
+	}
+}
+
+func TestAdminAntiEntropy(t *testing.T) {
+	oldConfig, oldAE := eyeconfig, antiEntropy
+	defer func() { eyeconfig, antiEntropy = oldConfig, oldAE }()
+	eyeconfig.AdminToken = ""
+	antiEntropy = NewAntiEntropy(NewManualScheduler(map[string][]string{"localhost:11599": {"0"}}, 1, 1))
+
+	for _, c := range []struct {
+		method, remote string
+		code           int
+	}{
+		{"GET", "127.0.0.1:4000", http.StatusMethodNotAllowed},
+		{"POST", "10.0.0.1:4000", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(c.method, "/admin/antientropy", nil)
+		req.RemoteAddr = c.remote
+		w := httptest.NewRecorder()
+		AdminAntiEntropy(w, req)
+		if w.Code != c.code {
+			t.Errorf("%s from %s: expected %d but %d", c.method, c.remote, c.code, w.Code)
+		}
+	}
+	if antiEntropy.Running() || antiEntropy.LastReport() != nil {
+		t.Error("anti-entropy is started without admin")
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	for s, ok := range map[string]bool{
+		"/migrations": true, "/migrations?x=1": true, "": false, "migrations": false,
+		"//evil.example": false, "/\\evil.example": false, "http://evil.example/": false,
+	} {
+		if localPath(s) != ok {
+			t.Errorf("local path %q: expected %v", s, ok)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// in-process time series of the monitor stats, kept in rings of
+// several resolutions, like "10s:6h,1m:7d"
+
+type Resolution struct {
+	Step time.Duration
+	Span time.Duration
+}
+
+func parseResolutions(s string) ([]Resolution, error) {
+	var rs []Resolution
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fs := strings.Split(part, ":")
+		if len(fs) != 2 {
+			return nil, fmt.Errorf("invalid resolution %q, expect step:span", part)
+		}
+		step, err := parseDuration(fs[0])
+		if err != nil {
+			return nil, err
+		}
+		span, err := parseDuration(fs[1])
+		if err != nil {
+			return nil, err
+		}
+		if step < time.Second || span < step {
+			return nil, fmt.Errorf("invalid resolution %q", part)
+		}
+		rs = append(rs, Resolution{step, span})
+	}
+	if len(rs) == 0 {
+		return nil, errors.New("no resolution")
+	}
+	sort.Sort(resolutionSlice(rs))
+	return rs, nil
+}
+
+// time.ParseDuration with days, like "7d"
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		d, err := time.ParseDuration(s[:len(s)-1] + "h")
+		return d * 24, err
+	}
+	return time.ParseDuration(s)
+}
+
+type resolutionSlice []Resolution
+
+func (l resolutionSlice) Len() int {
+	return len(l)
+}
+
+func (l resolutionSlice) Less(i, j int) bool {
+	return l[i].Step < l[j].Step
+}
+
+func (l resolutionSlice) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+type Point struct {
+	Time  int64 // unix seconds
+	Value float64
+}
+
+// Ring keeps the average of values in each step, fields are exported for gob
+type Ring struct {
+	Step   int64
+	Times  []int64
+	Values []float64
+	Counts []int
+	Pos    int
+}
+
+func newRing(r Resolution) *Ring {
+	n := int(r.Span / r.Step)
+	step := int64(r.Step / time.Second)
+	return &Ring{Step: step, Times: make([]int64, n), Values: make([]float64, n), Counts: make([]int, n)}
+}
+
+func (r *Ring) Add(t int64, v float64) {
+	slot := t / r.Step * r.Step
+	if r.Times[r.Pos] != slot {
+		if slot < r.Times[r.Pos] {
+			return
+		}
+		r.Pos = (r.Pos + 1) % len(r.Times)
+		r.Times[r.Pos] = slot
+		r.Values[r.Pos] = 0
+		r.Counts[r.Pos] = 0
+	}
+	r.Values[r.Pos] += v
+	r.Counts[r.Pos]++
+}
+
+// Points since the time, in order
+func (r *Ring) Points(since int64) []Point {
+	ps := make([]Point, 0, len(r.Times))
+	for i := 1; i <= len(r.Times); i++ {
+		j := (r.Pos + i) % len(r.Times)
+		if r.Counts[j] == 0 || r.Times[j] < since {
+			continue
+		}
+		ps = append(ps, Point{r.Times[j], r.Values[j] / float64(r.Counts[j])})
+	}
+	return ps
+}
+
+type SeriesStore struct {
+	sync.Mutex
+	resolutions []Resolution
+	series      map[string][]*Ring
+	path        string
+}
+
+func NewSeriesStore(resolutions []Resolution, path string) *SeriesStore {
+	s := &SeriesStore{resolutions: resolutions, path: path}
+	s.series = make(map[string][]*Ring)
+	return s
+}
+
+func (s *SeriesStore) Add(name string, t time.Time, v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	rings, ok := s.series[name]
+	if !ok {
+		rings = make([]*Ring, len(s.resolutions))
+		for i, r := range s.resolutions {
+			rings[i] = newRing(r)
+		}
+		s.series[name] = rings
+	}
+	for _, r := range rings {
+		r.Add(t.Unix(), v)
+	}
+}
+
+// Get returns the points in the last span, from the finest resolution covering it
+func (s *SeriesStore) Get(name string, span time.Duration) []Point {
+	s.Lock()
+	defer s.Unlock()
+	rings, ok := s.series[name]
+	if !ok {
+		return nil
+	}
+	i := 0
+	for i < len(rings)-1 && s.resolutions[i].Span < span {
+		i++
+	}
+	return rings[i].Points(time.Now().Add(-span).Unix())
+}
+
+func (s *SeriesStore) Names() []string {
+	s.Lock()
+	defer s.Unlock()
+	names := make([]string, 0, len(s.series))
+	for name := range s.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *SeriesStore) Save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(f).Encode(s.series); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Load keeps the series whose resolutions are not changed
+func (s *SeriesStore) Load() error {
+	if s.path == "" {
+		return nil
+	}
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	var series map[string][]*Ring
+	if err = gob.NewDecoder(f).Decode(&series); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	for name, rings := range series {
+		if len(rings) != len(s.resolutions) {
+			continue
+		}
+		ok := true
+		for i, r := range s.resolutions {
+			if rings[i].Step != int64(r.Step/time.Second) || len(rings[i].Times) != int(r.Span/r.Step) {
+				ok = false
+			}
+		}
+		if ok {
+			s.series[name] = rings
+		}
+	}
+	return nil
+}
+
+func (s *SeriesStore) SaveEvery(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		if err := s.Save(); err != nil {
+			log.Print("save series failed: ", err)
+		}
+	}
+}
+
+var series *SeriesStore
+
+func toFloat(v interface{}) float64 {
+	switch i := v.(type) {
+	case int:
+		return float64(i)
+	case int64:
+		return float64(i)
+	case uint64:
+		return float64(i)
+	case float32:
+		return float64(i)
+	case float64:
+		return i
+	}
+	return math.NaN()
+}
+
+// record the rates computed by update_stats
+func recordSeries(st map[string]interface{}, t time.Time) {
+	if series == nil {
+		return
+	}
+	name := st["name"].(string)
+	qps := toFloat(st["curr_cmd_get"]) + toFloat(st["curr_cmd_set"]) + toFloat(st["curr_cmd_delete"])
+	series.Add(name+"/qps", t, qps)
+	series.Add(name+"/hit", t, toFloat(st["curr_hit"]))
+	series.Add(name+"/slow", t, toFloat(st["curr_slow"]))
+	series.Add(name+"/bytes_in", t, toFloat(st["curr_bytes_read"]))
+	series.Add(name+"/bytes_out", t, toFloat(st["curr_bytes_written"]))
+	series.Add(name+"/rss", t, toFloat(st["rusage_maxrss"]))
+}
+
+func scale(ps []Point, width, height, pad float64) (xs, ys []float64, lo, hi float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, p := range ps {
+		lo = math.Min(lo, p.Value)
+		hi = math.Max(hi, p.Value)
+	}
+	if hi == lo {
+		hi = lo + 1
+	}
+	t0, t1 := ps[0].Time, ps[len(ps)-1].Time
+	if t1 == t0 {
+		t1 = t0 + 1
+	}
+	xs = make([]float64, len(ps))
+	ys = make([]float64, len(ps))
+	for i, p := range ps {
+		xs[i] = pad + float64(p.Time-t0)/float64(t1-t0)*(width-2*pad)
+		ys[i] = height - pad - (p.Value-lo)/(hi-lo)*(height-2*pad)
+	}
+	return
+}
+
+func polyline(xs, ys []float64) string {
+	pts := make([]string, len(xs))
+	for i := range xs {
+		pts[i] = fmt.Sprintf("%.1f,%.1f", xs[i], ys[i])
+	}
+	return strings.Join(pts, " ")
+}
+
+func sparklineSVG(ps []Point, width, height int) string {
+	w, h := float64(width), float64(height)
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`, width, height)
+	if len(ps) > 1 {
+		xs, ys, _, _ := scale(ps, w, h, 1)
+		svg += fmt.Sprintf(`<polyline fill="none" stroke="#3465a4" stroke-width="1" points="%s"/>`, polyline(xs, ys))
+	}
+	return svg + "</svg>"
+}
+
+func chartSVG(title string, ps []Point, width, height int) string {
+	w, h := float64(width), float64(height)
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="11">`, width, height)
+	svg += fmt.Sprintf(`<text x="40" y="14">%s</text>`, escapeXML(title))
+	if len(ps) < 2 {
+		return svg + `<text x="40" y="40">no data</text></svg>`
+	}
+	pad := 40.0
+	xs, ys, lo, hi := scale(ps, w, h, pad)
+	svg += fmt.Sprintf(`<rect x="%.0f" y="%.0f" width="%.0f" height="%.0f" fill="none" stroke="#ccc"/>`, pad, pad, w-2*pad, h-2*pad)
+	svg += fmt.Sprintf(`<text x="2" y="%.0f">%s</text>`, pad+4, number(hi))
+	svg += fmt.Sprintf(`<text x="2" y="%.0f">%s</text>`, h-pad, number(lo))
+	layout := "01-02 15:04"
+	svg += fmt.Sprintf(`<text x="%.0f" y="%.0f">%s</text>`, pad, h-pad+16, time.Unix(ps[0].Time, 0).Format(layout))
+	svg += fmt.Sprintf(`<text x="%.0f" y="%.0f" text-anchor="end">%s</text>`, w-pad, h-pad+16, time.Unix(ps[len(ps)-1].Time, 0).Format(layout))
+	svg += fmt.Sprintf(`<polyline fill="none" stroke="#3465a4" stroke-width="1.5" points="%s"/>`, polyline(xs, ys))
+	return svg + "</svg>"
+}
+
+func escapeXML(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(s)
+}
+
+// template func: sparkline of the last hour, linked to the chart
+func spark(addr, metric string) string {
+	if series == nil {
+		return ""
+	}
+	name := addr + "/" + metric
+	ps := series.Get(name, time.Hour)
+	return fmt.Sprintf(`<a href="/chart?name=%s&amp;span=6h">%s</a>`, url.QueryEscape(name), sparklineSVG(ps, 80, 16))
+}
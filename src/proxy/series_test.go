@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseResolutions(t *testing.T) {
+	rs, err := parseResolutions("1m:7d, 10s:6h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Resolution{{10 * time.Second, 6 * time.Hour}, {time.Minute, 7 * 24 * time.Hour}}
+	if len(rs) != len(expected) || rs[0] != expected[0] || rs[1] != expected[1] {
+		t.Error("bad resolutions", rs)
+	}
+	for _, s := range []string{"", "10s", "1ms:1h", "1h:1m", "x:1h"} {
+		if _, err := parseResolutions(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := newRing(Resolution{10 * time.Second, 30 * time.Second})
+	r.Add(100, 1)
+	r.Add(105, 3) // same step
+	r.Add(110, 5)
+	ps := r.Points(0)
+	if len(ps) != 2 || ps[0] != (Point{100, 2}) || ps[1] != (Point{110, 5}) {
+		t.Error("bad points", ps)
+	}
+	r.Add(120, 6)
+	r.Add(130, 7) // overwrite the oldest one
+	r.Add(90, 8)  // too old
+	ps = r.Points(0)
+	if len(ps) != 3 || ps[0].Time != 110 || ps[2] != (Point{130, 7}) {
+		t.Error("bad points after wrap", ps)
+	}
+	if ps = r.Points(125); len(ps) != 1 {
+		t.Error("bad points since", ps)
+	}
+}
+
+func TestSeriesStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "series")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "series.gob")
+
+	rs, _ := parseResolutions("10s:1h,1m:1d")
+	s := NewSeriesStore(rs, path)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		s.Add("a/qps", now.Add(time.Duration(i-10)*10*time.Second), float64(i))
+	}
+	if ps := s.Get("a/qps", time.Hour); len(ps) != 10 {
+		t.Error("expect 10 points in 10s resolution", ps)
+	}
+	if ps := s.Get("a/qps", 2*time.Hour); len(ps) > 3 {
+		t.Error("expect 1m resolution", ps)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s2 := NewSeriesStore(rs, path)
+	if err := s2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if names := s2.Names(); len(names) != 1 || names[0] != "a/qps" || len(s2.Get("a/qps", time.Hour)) != 10 {
+		t.Error("bad loaded series", names)
+	}
+	// changed resolutions
+	rs, _ = parseResolutions("5s:1h")
+	s3 := NewSeriesStore(rs, path)
+	s3.Load()
+	if len(s3.Names()) != 0 {
+		t.Error("series of other resolutions should not be loaded")
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	svg := sparklineSVG([]Point{{1, 1}, {2, 3}, {3, 2}}, 80, 16)
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, "<polyline") {
+		t.Error("bad sparkline", svg)
+	}
+	if svg = chartSVG("a<b", nil, 800, 240); !strings.Contains(svg, "a&lt;b") {
+		t.Error("bad chart", svg)
+	}
+}